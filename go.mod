@@ -5,6 +5,7 @@ go 1.25.9
 require (
 	github.com/refractionPOINT/go-limacharlie/limacharlie v0.0.0-20260508000415-db50466f3ab1
 	github.com/refractionPOINT/shlex v0.0.0-20240130182828-ebac721e86ed
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -62,5 +63,4 @@ require (
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20260504160031-60b97b32f348 // indirect
 	google.golang.org/grpc v1.82.1 // indirect
 	google.golang.org/protobuf v1.36.11 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
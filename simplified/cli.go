@@ -24,6 +24,20 @@ type CLIDescriptor struct {
 	ProcessCommand    CLIHandler
 	CredentialsFormat string
 	ExampleCommand    string
+	// Optional, commands the tool is allowed to run.
+	Policy CLIPolicy
+	// Optional, structure of the credentials, which are then provided as a
+	// JSON object, validated and available through CLICredentialsFromContext.
+	CredentialsSchema *common.SchemaObject
+	// Optional, additional validation of the structured credentials.
+	ValidateCredentials func(credentials CLICredentials) error
+	// Optional, format of the raw output of the tool to parse it into
+	// OutputDict or OutputList, like CLIOutputFormats.Auto.
+	OutputFormat CLIOutputFormat
+	// Optional, custom parser of the raw output, instead of OutputFormat.
+	OutputParser CLIOutputParser
+	// Optional, commands exposed as their own request actions, by action name.
+	Templates map[string]CLICommandTemplate
 }
 
 type CLIReturnData struct {
@@ -31,6 +45,9 @@ type CLIReturnData struct {
 	OutputString string             `json:"output_string"`
 	OutputDict   limacharlie.Dict   `json:"output_dict"`
 	OutputList   []limacharlie.Dict `json:"output_list"`
+	ErrorString  string             `json:"error_string,omitempty"`
+	// Set instead of the outputs when they are too large for the response.
+	OutputReference *CLIOutputReference `json:"output_reference,omitempty"`
 }
 
 type CLIName = string
@@ -42,6 +59,28 @@ type CLIExtension struct {
 
 	Descriptors map[CLIName]CLIDescriptor
 
+	// Optional, how requests are isolated from each other, like a
+	// CLISandbox the handlers run their CLIs in, available to them through
+	// CLISandboxFromContext. Defaults to terminating the instance after
+	// each request, which does not support async runs: they require an
+	// isolation reusing the instance, like a CLISandbox or CLIReuseIsolation.
+	Isolation CLIIsolation
+
+	// Optional, size in bytes over which the output of a command is sent in
+	// chunks to the webhook adapter instead of being returned, defaults to 1MB.
+	MaxResponseOutputSize int
+	// Optional, uploads the outputs too large to be returned instead of
+	// sending them to the webhook adapter.
+	UploadOutput OutputUploadCallback
+	// Optional, timeout of async runs, defaults to 1 hour.
+	AsyncTimeout time.Duration
+	// Optional, returns the Orgs the async runs use, which are not
+	// supported without it.
+	JobOrg JobOrgCallback
+	// Optional, where the jobs of async runs are kept so that any instance
+	// can report them, defaults to the Hive of the Orgs.
+	JobStore CLIJobStore
+
 	extension *core.Extension
 }
 
@@ -50,6 +89,16 @@ type CLIRunRequest struct {
 	CommandTokens []string `json:"command_tokens"`
 	Credentials   string   `json:"credentials"`
 	Tool          string   `json:"tool"`
+	// Run the command in the background, returning a job to follow it.
+	// Only supported by an Isolation reusing the instance, with a JobOrg.
+	IsAsync bool `json:"async"`
+}
+
+type cliConfig struct {
+	// Restrictions on the commands, on top of the policies of the tools.
+	Policies []cliToolPolicy `json:"policies"`
+	// Default credentials and settings of the tools.
+	Tools []cliToolConfig `json:"tools"`
 }
 
 var errUnknownTool = errors.New("unknown tool")
@@ -86,7 +135,7 @@ var sendToWebhookAdapterFunc = func(ext *core.Extension, o *limacharlie.Organiza
 }
 
 // Default implementation of stopThisInstance. Only to be overridden by tests.
-var stopThisInstanceFunc = func(logger limacharlie.LCLogger, o *limacharlie.Organization, request *CLIRunRequest, error string) {
+var stopThisInstanceFunc = func(logger limacharlie.LCLogger, o *limacharlie.Organization, request *CLIRunRequest, error string, killTimeout time.Duration) {
 	if error == "" {
 		logger.Info(fmt.Sprintf("stopping instance after successful processing for oid %s and tool %s", o.GetOID(), request.Tool))
 	} else {
@@ -105,8 +154,57 @@ var stopThisInstanceFunc = func(logger limacharlie.LCLogger, o *limacharlie.Orga
 		return
 	}
 
-	// TODO: Should we add a safe guard and send SIGKILL if process is still alive after
-	// X seconds?
+	// Safe guard in case the process does not exit.
+	time.AfterFunc(killTimeout, func() {
+		logger.Error(fmt.Sprintf("process still running %s after SIGTERM, sending SIGKILL", killTimeout))
+		if err := p.Kill(); err != nil {
+			logger.Error(fmt.Sprintf("failed to send SIGKILL: %v", err))
+		}
+	})
+}
+
+var cliAsyncField = common.SchemaElement{
+	DataType:     common.SchemaDataTypes.Boolean,
+	Label:        "Async",
+	Description:  "Run the command in the background and return a job to follow it with get_job, if the extension supports it.",
+	DisplayIndex: 5,
+}
+
+var cliRunResponseSchema = common.SchemaObject{
+	Fields: map[common.SchemaKey]common.SchemaElement{
+		"output_list": {
+			DataType:    common.SchemaDataTypes.Object,
+			Label:       "Outputs",
+			Description: "The output JSON objects of the command.",
+			IsList:      true,
+		},
+		"output_dict": {
+			DataType:    common.SchemaDataTypes.Object,
+			Label:       "Output",
+			Description: "The output JSON object of the command.",
+			IsList:      false,
+		},
+		"output_string": {
+			DataType:    common.SchemaDataTypes.String,
+			Label:       "Raw Output",
+			Description: "The non-JSON output of the command.",
+		},
+		"error_string": {
+			DataType:    common.SchemaDataTypes.String,
+			Label:       "Error Output",
+			Description: "The error output of the command.",
+		},
+		"output_reference": {
+			DataType:    common.SchemaDataTypes.Object,
+			Label:       "Output Reference",
+			Description: "Where the output of the command is when it is too large to be returned.",
+		},
+		"status_code": {
+			DataType:    common.SchemaDataTypes.Integer,
+			Label:       "Status Code",
+			Description: "The status of the command.",
+		},
+	},
 }
 
 func Bool(v bool) *bool {
@@ -116,7 +214,8 @@ func Bool(v bool) *bool {
 func (e *CLIExtension) Init() (*core.Extension, error) {
 	isSingleTool := len(e.Descriptors) == 1
 
-	requiredFields := [][]common.SchemaKey{{"command_tokens", "command_line"}, {"credentials"}}
+	// Credentials can be omitted when the org configured default ones.
+	requiredFields := [][]common.SchemaKey{{"command_tokens", "command_line"}}
 	if !isSingleTool {
 		requiredFields = append(requiredFields, []common.SchemaKey{"tool"})
 	}
@@ -131,6 +230,10 @@ func (e *CLIExtension) Init() (*core.Extension, error) {
 		EnumValues:   toolList,
 		DisplayIndex: 2,
 	}
+	credentials := genericCredentialsField(e.Descriptors)
+	if isSingleTool {
+		credentials = credentialsField(toolList[0].(CLIName), e.Descriptors[toolList[0].(CLIName)])
+	}
 	longDesc := "Run a CLI command by choosing a CLI tool, a set of credentials to authenticate with, and a list of command line parameters to provide to the CLI tool."
 	if isSingleTool {
 		longDesc = fmt.Sprintf("Run a CLI command using the %s tool by providing a list of command line parameters to provide to it.", toolList[0])
@@ -139,7 +242,12 @@ func (e *CLIExtension) Init() (*core.Extension, error) {
 		ExtensionName: e.Name,
 		SecretKey:     e.SecretKey,
 		// The schema defining what the configuration for this Extension should look like.
-		ConfigSchema: common.SchemaObject{},
+		ConfigSchema: common.SchemaObject{
+			Fields: map[common.SchemaKey]common.SchemaElement{
+				"policies": cliPolicySchema,
+				"tools":    cliToolConfigSchema,
+			},
+		},
 		// The schema defining what requests to this Extension should look like.
 		RequiredEvents: []common.EventName{common.EventTypes.Subscribe, common.EventTypes.Unsubscribe},
 		ViewsSchema: []common.View{
@@ -151,80 +259,94 @@ func (e *CLIExtension) Init() (*core.Extension, error) {
 		},
 		RequestSchema: map[string]common.RequestSchema{
 			"run": {
-				IsUserFacing:     true,
-				Label:            "Run a CLI command",
-				ShortDescription: "Run a CLI command for a supported tool.",
-				LongDescription:  longDesc,
-				ParameterDefinitions: common.SchemaObject{
-					Requirements: requiredFields,
-					Fields: map[common.SchemaKey]common.SchemaElement{
-						"command_line": {
-							DataType:     common.SchemaDataTypes.String,
-							Label:        "Command Line",
-							Description:  "The command to run.",
-							IsList:       false,
-							DisplayIndex: 3,
-						},
-						"command_tokens": {
-							DataType:     common.SchemaDataTypes.String,
-							Label:        "Command Parameters",
-							Description:  "The command parameters to run as a tokenized list.",
-							IsList:       true,
-							DisplayIndex: 4,
-						},
-						"credentials": {
-							DataType:     common.SchemaDataTypes.Secret,
-							Label:        "Credentials",
-							Description:  `The credentials to use for the command. A GCP JSON key, a DigitalOcean Access Token or an AWS "accessKeyID/secretAccessKey" pair.`,
-							DisplayIndex: 1,
-						},
-					},
-				},
-				ResponseDefinition: &common.SchemaObject{
-					Fields: map[common.SchemaKey]common.SchemaElement{
-						"output_list": {
-							DataType:    common.SchemaDataTypes.Object,
-							Label:       "Outputs",
-							Description: "The output JSON objects of the command.",
-							IsList:      true,
-						},
-						"output_dict": {
-							DataType:    common.SchemaDataTypes.Object,
-							Label:       "Output",
-							Description: "The output JSON object of the command.",
-							IsList:      false,
-						},
-						"output_string": {
-							DataType:    common.SchemaDataTypes.String,
-							Label:       "Raw Output",
-							Description: "The non-JSON output of the command.",
-						},
-						"status_code": {
-							DataType:    common.SchemaDataTypes.Integer,
-							Label:       "Status Code",
-							Description: "The status of the command.",
-						},
-					},
-				},
+				IsUserFacing:         true,
+				Label:                "Run a CLI command",
+				ShortDescription:     "Run a CLI command for a supported tool.",
+				LongDescription:      longDesc,
+				ParameterDefinitions: e.runParameters(requiredFields, credentials),
+				ResponseDefinition:   &cliRunResponseSchema,
 			},
 		},
 	}
 
+	x.RequestSchema["get_job"] = common.RequestSchema{
+		IsUserFacing:         true,
+		Label:                "Get a job",
+		ShortDescription:     "Get the status and result of an async run.",
+		LongDescription:      "Get the status of a command run in the background and its result once it is done.",
+		ParameterDefinitions: cliJobParameters,
+		ResponseDefinition:   &cliJobSchema,
+	}
+	x.RequestSchema["cancel_job"] = common.RequestSchema{
+		IsUserFacing:         true,
+		Label:                "Cancel a job",
+		ShortDescription:     "Cancel an async run.",
+		LongDescription:      "Stop a command run in the background.",
+		ParameterDefinitions: cliJobParameters,
+		ResponseDefinition:   &cliJobSchema,
+	}
+
 	if !isSingleTool {
 		x.RequestSchema["run"].ParameterDefinitions.Fields["tool"] = toolField
+
+		// Tools with structured credentials also get their own run
+		// request to show the structure of their credentials.
+		for _, tool := range e.structuredTools() {
+			x.RequestSchema[runToolAction(tool)] = common.RequestSchema{
+				IsUserFacing:         true,
+				Label:                fmt.Sprintf("Run a %s command", tool),
+				ShortDescription:     fmt.Sprintf("Run a CLI command with the %s tool.", tool),
+				LongDescription:      fmt.Sprintf("Run a CLI command using the %s tool by providing a list of command line parameters to provide to it.", tool),
+				ParameterDefinitions: e.runParameters([][]common.SchemaKey{{"command_tokens", "command_line"}}, credentialsField(tool, e.Descriptors[tool])),
+				ResponseDefinition:   &cliRunResponseSchema,
+			}
+		}
+	}
+
+	// Templates are exposed as their own actions.
+	if err := e.validateTemplates(x.RequestSchema); err != nil {
+		return nil, err
+	}
+	for _, tool := range e.sortedTools() {
+		for name, t := range e.Descriptors[tool].Templates {
+			x.RequestSchema[name] = templateRequestSchema(tool, e.Descriptors[tool], t)
+		}
 	}
 
 	x.Callbacks = core.ExtensionCallbacks{
 		ValidateConfig: func(ctx context.Context, org *limacharlie.Organization, config limacharlie.Dict) common.Response {
 			e.Logger.Info(fmt.Sprintf("validate config from %s", org.GetOID()))
+			c, err := parseCLIConfig(config)
+			if err != nil {
+				return common.Response{Error: err.Error()}
+			}
+			for _, p := range c.Policies {
+				if p.Tool != "" {
+					if _, ok := e.Descriptors[p.Tool]; !ok {
+						return common.Response{Error: fmt.Sprintf("unknown tool in policy: %s", p.Tool)}
+					}
+				}
+				if err := validateCLIPolicy(p.CLIPolicy); err != nil {
+					return common.Response{Error: err.Error()}
+				}
+			}
+			if err := e.validateToolConfigs(c.Tools); err != nil {
+				return common.Response{Error: err.Error()}
+			}
 			return common.Response{}
 		},
 		RequestHandlers: map[common.ActionName]core.RequestCallback{
 			"run": {
 				RequestStruct: &CLIRunRequest{},
-				Callback: func(ctx context.Context, params core.RequestCallbackParams) common.Response {
-					return e.doRun(params.Org, params.Request.(*CLIRunRequest), params.Ident, params.InvestigationID)
-				},
+				Callback:      e.onRun(""),
+			},
+			"get_job": {
+				RequestStruct: &cliJobRequest{},
+				Callback:      e.onGetJob,
+			},
+			"cancel_job": {
+				RequestStruct: &cliJobRequest{},
+				Callback:      e.onCancelJob,
 			},
 		},
 		EventHandlers: map[common.EventName]core.EventCallback{
@@ -254,6 +376,23 @@ func (e *CLIExtension) Init() (*core.Extension, error) {
 		},
 	}
 
+	if !isSingleTool {
+		for _, tool := range e.structuredTools() {
+			x.Callbacks.RequestHandlers[runToolAction(tool)] = core.RequestCallback{
+				RequestStruct: &CLIRunRequest{},
+				Callback:      e.onRun(tool),
+			}
+		}
+	}
+
+	for _, tool := range e.sortedTools() {
+		for name, t := range e.Descriptors[tool].Templates {
+			x.Callbacks.RequestHandlers[name] = core.RequestCallback{
+				Callback: e.onTemplate(tool, name, t),
+			}
+		}
+	}
+
 	e.extension = x
 
 	// Start processing.
@@ -264,6 +403,59 @@ func (e *CLIExtension) Init() (*core.Extension, error) {
 	return x, nil
 }
 
+// onRun returns the callback of a run request, for the tool if set.
+func (e *CLIExtension) onRun(tool CLIName) func(ctx context.Context, params core.RequestCallbackParams) common.Response {
+	return func(ctx context.Context, params core.RequestCallbackParams) common.Response {
+		c, err := parseCLIConfig(params.Config)
+		if err != nil {
+			return common.Response{
+				Error:     fmt.Sprintf("invalid config: %v", err),
+				Retriable: Bool(false),
+			}
+		}
+		request := params.Request.(*CLIRunRequest)
+		if tool != "" {
+			request.Tool = tool
+		}
+		return e.doRun(params.Org, request, params.Ident, params.InvestigationID, c)
+	}
+}
+
+func parseCLIConfig(config limacharlie.Dict) (cliConfig, error) {
+	c := cliConfig{}
+	err := config.UnMarshalToStruct(&c)
+	return c, err
+}
+
+func runToolAction(tool CLIName) common.ActionName {
+	return fmt.Sprintf("run_%s", tool)
+}
+
+// runParameters returns the parameters of a run request.
+func (e *CLIExtension) runParameters(requiredFields [][]common.SchemaKey, credentials common.SchemaElement) common.SchemaObject {
+	return common.SchemaObject{
+		Requirements: requiredFields,
+		Fields: map[common.SchemaKey]common.SchemaElement{
+			"command_line": {
+				DataType:     common.SchemaDataTypes.String,
+				Label:        "Command Line",
+				Description:  "The command to run.",
+				IsList:       false,
+				DisplayIndex: 3,
+			},
+			"command_tokens": {
+				DataType:     common.SchemaDataTypes.String,
+				Label:        "Command Parameters",
+				Description:  "The command parameters to run as a tokenized list.",
+				IsList:       true,
+				DisplayIndex: 4,
+			},
+			"async":       cliAsyncField,
+			"credentials": credentials,
+		},
+	}
+}
+
 func (e *CLIExtension) installRulesIfNeeded(o *limacharlie.Organization) error {
 	if err := e.extension.CreateExtensionAdapter(o, limacharlie.Dict{
 		"event_type_path":       "action",
@@ -283,17 +475,26 @@ func (e *CLIExtension) uninstallAllRules(o *limacharlie.Organization) error {
 	return nil
 }
 
-func (e *CLIExtension) doRun(o *limacharlie.Organization, request *CLIRunRequest, ident string, invID string) common.Response {
+func (e *CLIExtension) doRun(o *limacharlie.Organization, request *CLIRunRequest, ident string, invID string, config cliConfig) common.Response {
 	// We're paranoid about this extension as in some cases we
-	// drop creds on disk in temp files and the CLIs are not
-	// isolated in sub-containers (yet).
-	// The service is set to let one request at a time and we
-	// will also terminate the container on exit by sending
-	// outselves a signal to terminate.
+	// drop creds on disk in temp files. Unless the isolation lets
+	// the instance be reused, like when the CLIs are isolated in a
+	// sandbox, the service is set to let one request at a time and
+	// we will also terminate the container on exit by sending
+	// ourselves a signal to terminate.
 	var doRunResp common.Response
 
+	ctx, done, err := e.isolation().StartRequest(context.Background(), e.Logger, o, request)
+	if err != nil {
+		e.Logger.Error(fmt.Sprintf("failed to start request for %s: %v", o.GetOID(), err))
+		return common.Response{Error: err.Error()}
+	}
+	// Async runs are done once their job is.
+	isDetached := false
 	defer func() {
-		e.stopThisInstance(o, request, doRunResp.Error)
+		if !isDetached {
+			done(doRunResp.Error)
+		}
 	}()
 
 	e.Logger.Debug(fmt.Sprintf("running command for %s and tool %s", o.GetOID(), request.Tool))
@@ -332,9 +533,11 @@ func (e *CLIExtension) doRun(o *limacharlie.Organization, request *CLIRunRequest
 	}
 
 	var handler CLIDescriptor
+	toolName := request.Tool
 
 	if len(e.Descriptors) == 1 {
-		for _, h := range e.Descriptors {
+		for name, h := range e.Descriptors {
+			toolName = name
 			handler = h
 			break
 		}
@@ -351,17 +554,68 @@ func (e *CLIExtension) doRun(o *limacharlie.Organization, request *CLIRunRequest
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), toolCommandExecutionTimeout)
+	toolConfig := config.toolConfig(toolName)
+	if toolConfig.IsDisabled {
+		e.Logger.Info(fmt.Sprintf("tool %s is disabled for %s", toolName, o.GetOID()))
+		doRunResp = common.Response{
+			Error:     fmt.Sprintf("tool %s is disabled", toolName),
+			Retriable: Bool(false),
+		}
+		return doRunResp
+	}
+
+	if err := checkCommand(toolName, request.CommandTokens, handler.Policy, config.Policies); err != nil {
+		e.Logger.Info(fmt.Sprintf("command not allowed for %s and tool %s: %v", o.GetOID(), toolName, err))
+		doRunResp = common.Response{
+			Error:     err.Error(),
+			Retriable: Bool(false),
+		}
+		return doRunResp
+	}
+
+	credentials := request.Credentials
+	if credentials == "" {
+		credentials = toolConfig.Credentials
+	}
+	creds, err := resolveCredentials(o, handler, credentials, toolConfig.Defaults)
+	if err != nil {
+		e.Logger.Info(fmt.Sprintf("invalid credentials for %s and tool %s: %v", o.GetOID(), toolName, err))
+		doRunResp = common.Response{
+			Error:     err.Error(),
+			Retriable: Bool(false),
+		}
+		return doRunResp
+	}
+
+	if request.IsAsync {
+		doRunResp = e.startJob(ctx, o, request, handler, creds, toolName, ident, invID, done)
+		isDetached = doRunResp.Error == ""
+		return doRunResp
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, toolCommandExecutionTimeout)
 	defer cancel()
+	doRunResp = e.runCommand(ctx, o, request, handler, creds, ident, invID, "")
+	return doRunResp
+}
+
+// runCommand runs a validated command with the tool, logging it to the adapter.
+func (e *CLIExtension) runCommand(ctx context.Context, o *limacharlie.Organization, request *CLIRunRequest, handler CLIDescriptor, creds resolvedCredentials, ident string, invID string, jobID string) common.Response {
+	ctx = withCLICredentials(ctx, creds.structured)
+	ctx = withCLIDefaults(ctx, creds.defaults)
 	start := time.Now()
-	resp, err := handler.ProcessCommand(ctx, request.CommandTokens, request.Credentials)
+	resp, err := handler.ProcessCommand(ctx, request.CommandTokens, creds.value)
 	elapsed := time.Since(start)
+	if err == nil {
+		resp = handler.parseOutput(resp)
+		resp, err = e.offloadLargeOutput(ctx, o, invID, resp)
+	}
 
 	// Log to the adapter.
 	anonReq := *request
 	anonReq.Credentials = "REDACTED"
-	anonReq.CommandLine = core.MaskSecrets(request.CommandLine, []string{request.Credentials})
-	anonReq.CommandTokens = core.MaskSecretsInSlice(request.CommandTokens, []string{request.Credentials})
+	anonReq.CommandLine = core.MaskSecrets(request.CommandLine, creds.secrets)
+	anonReq.CommandTokens = core.MaskSecretsInSlice(request.CommandTokens, creds.secrets)
 
 	hook := limacharlie.Dict{
 		"action":  "run",
@@ -369,6 +623,9 @@ func (e *CLIExtension) doRun(o *limacharlie.Organization, request *CLIRunRequest
 		"by":      ident,
 		"inv_id":  invID,
 	}
+	if jobID != "" {
+		hook["job_id"] = jobID
+	}
 
 	if err != nil {
 		hook["error"] = err.Error()
@@ -391,18 +648,20 @@ func (e *CLIExtension) doRun(o *limacharlie.Organization, request *CLIRunRequest
 	}
 
 	if err != nil {
-		doRunResp = common.Response{
+		return common.Response{
 			Data:      &resp,
 			Error:     err.Error(),
 			Retriable: Bool(isErrorRetriable(err)),
 		}
-		return doRunResp
 	}
-	doRunResp = common.Response{Data: &resp}
-	return doRunResp
+	return common.Response{Data: &resp}
 }
 
 func (e *CLIExtension) TryParsingOutput(output []byte) CLIReturnData {
+	return tryParsingOutput(output)
+}
+
+func tryParsingOutput(output []byte) CLIReturnData {
 	// Try to parse multiple dictionaries in a row.
 	r := bytes.NewReader(output)
 	l := []limacharlie.Dict{}
@@ -434,10 +693,6 @@ func (e *CLIExtension) TryParsingOutput(output []byte) CLIReturnData {
 	return CLIReturnData{OutputString: string(output)}
 }
 
-func (e *CLIExtension) stopThisInstance(o *limacharlie.Organization, request *CLIRunRequest, error string) {
-	stopThisInstanceFunc(e.Logger, o, request, error)
-}
-
 // Return true if a specific error is considered retriable.
 func isErrorRetriable(err error) bool {
 	if err == nil {
@@ -0,0 +1,96 @@
+package simplified
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/common"
+)
+
+// cliToolConfig are the settings of a tool for an org, so that
+// requests do not need to carry the credentials inline.
+type cliToolConfig struct {
+	Tool CLIName `json:"tool"`
+	// Do not allow the tool to be used by the org.
+	IsDisabled bool `json:"disabled"`
+	// Credentials used when a request does not have any,
+	// usually a hive://secret/ reference.
+	Credentials string `json:"credentials"`
+	// Default values like a region or a project. They fill in the missing
+	// fields of structured credentials and are available to the handlers
+	// through CLIDefaultsFromContext.
+	Defaults limacharlie.Dict `json:"defaults"`
+}
+
+var cliToolConfigSchema = common.SchemaElement{
+	DataType:    common.SchemaDataTypes.Object,
+	IsList:      true,
+	Label:       "Tools",
+	Description: "Default credentials and settings of the tools.",
+	Object: &common.SchemaObject{
+		Requirements: [][]common.SchemaKey{{"tool"}},
+		Fields: map[common.SchemaKey]common.SchemaElement{
+			"tool": {
+				DataType:    common.SchemaDataTypes.String,
+				Label:       "Tool",
+				Description: "The tool the settings apply to.",
+			},
+			"disabled": {
+				DataType:    common.SchemaDataTypes.Boolean,
+				Label:       "Disabled",
+				Description: "Do not allow commands to be run with the tool.",
+			},
+			"credentials": {
+				DataType:    common.SchemaDataTypes.Secret,
+				Label:       "Default Credentials",
+				Description: fmt.Sprintf("The credentials to use when a request does not provide any, as a %s reference.", secretReferencePrefix),
+			},
+			"defaults": {
+				DataType:    common.SchemaDataTypes.Object,
+				Label:       "Defaults",
+				Description: "Default values like a region or a project.",
+			},
+		},
+	},
+}
+
+// toolConfig returns the settings of the org for the tool, if any.
+func (c cliConfig) toolConfig(tool CLIName) cliToolConfig {
+	for _, t := range c.Tools {
+		if t.Tool == tool {
+			return t
+		}
+	}
+	return cliToolConfig{Tool: tool}
+}
+
+func (e *CLIExtension) validateToolConfigs(tools []cliToolConfig) error {
+	seen := map[CLIName]struct{}{}
+	for _, t := range tools {
+		if _, ok := e.Descriptors[t.Tool]; !ok {
+			return fmt.Errorf("unknown tool in settings: %s", t.Tool)
+		}
+		if _, ok := seen[t.Tool]; ok {
+			return fmt.Errorf("duplicate settings for tool: %s", t.Tool)
+		}
+		seen[t.Tool] = struct{}{}
+	}
+	return nil
+}
+
+type cliDefaultsContextKey struct{}
+
+// CLIDefaultsFromContext returns the default values configured
+// by the org for the tool, or nil if there are none.
+func CLIDefaultsFromContext(ctx context.Context) limacharlie.Dict {
+	d, _ := ctx.Value(cliDefaultsContextKey{}).(limacharlie.Dict)
+	return d
+}
+
+func withCLIDefaults(ctx context.Context, d limacharlie.Dict) context.Context {
+	if len(d) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, cliDefaultsContextKey{}, d)
+}
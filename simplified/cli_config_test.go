@@ -0,0 +1,107 @@
+package simplified
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/core"
+)
+
+func TestDoRunToolConfig(t *testing.T) {
+	originalSendToWebhook := sendToWebhookAdapterFunc
+	originalStopThisInstance := stopThisInstanceFunc
+	originalGetSecret := getSecretFunc
+	defer func() {
+		sendToWebhookAdapterFunc = originalSendToWebhook
+		stopThisInstanceFunc = originalStopThisInstance
+		getSecretFunc = originalGetSecret
+	}()
+	var hook limacharlie.Dict
+	sendToWebhookAdapterFunc = func(ext *core.Extension, o *limacharlie.Organization, h limacharlie.Dict) error {
+		hook = h
+		return nil
+	}
+	stopThisInstanceFunc = func(logger limacharlie.LCLogger, o *limacharlie.Organization, req *CLIRunRequest, errMsg string, killTimeout time.Duration) {
+	}
+	getSecretFunc = func(key string, o *limacharlie.Organization) (string, error) {
+		if key == "hive://secret/gcloud" {
+			return "service-account", nil
+		}
+		return "", errors.New("not found")
+	}
+
+	org, err := limacharlie.NewOrganizationFromClientOptions(dummyOpt, dummyLogger{})
+	if err != nil {
+		t.Fatalf("failed to create organization: %v", err)
+	}
+	var receivedCreds string
+	var receivedDefaults limacharlie.Dict
+	var receivedStructured CLICredentials
+	process := func(ctx context.Context, tokens []string, creds string) (CLIReturnData, error) {
+		receivedCreds = creds
+		receivedDefaults = CLIDefaultsFromContext(ctx)
+		receivedStructured = CLICredentialsFromContext(ctx)
+		return CLIReturnData{}, nil
+	}
+	cliExt := &CLIExtension{
+		Name:   "test-extension",
+		Logger: dummyLogger{},
+		Descriptors: map[CLIName]CLIDescriptor{
+			"gcloud": {ProcessCommand: process},
+			"aws":    {ProcessCommand: process, CredentialsSchema: awsCredentialsSchema},
+		},
+		extension: dummyCoreExt,
+	}
+	config := cliConfig{Tools: []cliToolConfig{
+		{Tool: "gcloud", Credentials: "hive://secret/gcloud", Defaults: limacharlie.Dict{"project": "my-project"}},
+		{Tool: "aws", Defaults: limacharlie.Dict{"region": "us-east-1"}},
+	}}
+
+	// The default credentials are used when the request has none.
+	if resp := cliExt.doRun(org, &CLIRunRequest{Tool: "gcloud", CommandLine: "projects list"}, "ident", "inv", config); resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if receivedCreds != "service-account" || receivedDefaults["project"] != "my-project" {
+		t.Errorf("expected the default credentials and settings: %s %v", receivedCreds, receivedDefaults)
+	}
+	if hook["request"].(CLIRunRequest).Credentials != "REDACTED" {
+		t.Errorf("credentials should be redacted")
+	}
+
+	// The credentials of the request take precedence.
+	if resp := cliExt.doRun(org, &CLIRunRequest{Tool: "gcloud", CommandLine: "projects list", Credentials: "other"}, "ident", "inv", config); resp.Error != "" || receivedCreds != "other" {
+		t.Errorf("expected the request credentials: %s %s", resp.Error, receivedCreds)
+	}
+
+	// Defaults fill in the missing fields of structured credentials.
+	if resp := cliExt.doRun(org, &CLIRunRequest{Tool: "aws", CommandLine: "s3 ls", Credentials: `{"role_arn":"arn:aws:iam::1:role/r"}`}, "ident", "inv", config); resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if receivedStructured["region"] != "us-east-1" || receivedStructured["role_arn"] != "arn:aws:iam::1:role/r" {
+		t.Errorf("expected the region default: %v", receivedStructured)
+	}
+
+	// Credentials are still required without defaults.
+	if resp := cliExt.doRun(org, &CLIRunRequest{Tool: "gcloud", CommandLine: "projects list"}, "ident", "inv", cliConfig{}); resp.Error == "" {
+		t.Errorf("expected an error without credentials")
+	}
+
+	// Disabled tools can not be used.
+	config.Tools[0].IsDisabled = true
+	if resp := cliExt.doRun(org, &CLIRunRequest{Tool: "gcloud", CommandLine: "projects list", Credentials: "creds"}, "ident", "inv", config); resp.Error == "" || resp.Retriable == nil || *resp.Retriable {
+		t.Errorf("expected a non-retriable error for a disabled tool: %+v", resp)
+	}
+
+	if err := cliExt.validateToolConfigs(config.Tools); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := cliExt.validateToolConfigs([]cliToolConfig{{Tool: "unknown"}}); err == nil {
+		t.Errorf("expected an error for an unknown tool")
+	}
+	if err := cliExt.validateToolConfigs([]cliToolConfig{{Tool: "aws"}, {Tool: "aws"}}); err == nil {
+		t.Errorf("expected an error for duplicate settings")
+	}
+}
@@ -0,0 +1,226 @@
+package simplified
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/common"
+	"github.com/refractionPOINT/lc-extension/core"
+)
+
+// Prefix of the references to records of the secret Hive.
+const secretReferencePrefix = "hive://secret/"
+
+// CLICredentials are the structured credentials of a tool, parsed according
+// to the CredentialsSchema of the tool, with their secret references resolved.
+type CLICredentials = limacharlie.Dict
+
+// Default implementation of resolving a secret. Only to be overridden by tests.
+var getSecretFunc = func(key string, o *limacharlie.Organization) (string, error) {
+	val, _, err := core.GetSecret(key, o)
+	return val, err
+}
+
+// resolvedCredentials are the credentials passed to a tool.
+type resolvedCredentials struct {
+	value      string
+	structured CLICredentials
+	// Defaults of the org for the tool.
+	defaults limacharlie.Dict
+	// Values to mask when logging the request.
+	secrets []string
+}
+
+type cliCredentialsContextKey struct{}
+
+// CLICredentialsFromContext returns the structured credentials of the
+// request, or nil if the tool does not have a CredentialsSchema.
+func CLICredentialsFromContext(ctx context.Context) CLICredentials {
+	c, _ := ctx.Value(cliCredentialsContextKey{}).(CLICredentials)
+	return c
+}
+
+func withCLICredentials(ctx context.Context, c CLICredentials) context.Context {
+	if c == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, cliCredentialsContextKey{}, c)
+}
+
+// UnmarshalJSON accepts structured credentials as a JSON object,
+// which are kept serialized in Credentials.
+func (r *CLIRunRequest) UnmarshalJSON(b []byte) error {
+	type request CLIRunRequest
+	raw := struct {
+		*request
+		Credentials json.RawMessage `json:"credentials"`
+	}{request: (*request)(r)}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if len(raw.Credentials) == 0 || string(raw.Credentials) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(raw.Credentials, &r.Credentials); err == nil {
+		return nil
+	}
+	r.Credentials = string(raw.Credentials)
+	return nil
+}
+
+// credentialsField returns the credentials parameter of a run request for
+// the tool, structured if the tool has a CredentialsSchema.
+func credentialsField(tool CLIName, descriptor CLIDescriptor) common.SchemaElement {
+	if descriptor.CredentialsSchema == nil {
+		return genericCredentialsField(map[CLIName]CLIDescriptor{tool: descriptor})
+	}
+	return common.SchemaElement{
+		DataType:     common.SchemaDataTypes.Object,
+		Label:        "Credentials",
+		Description:  fmt.Sprintf("The credentials to use for the %s tool, defaults to the ones configured for it. Values can be %s references.", tool, secretReferencePrefix),
+		DisplayIndex: 1,
+		Object:       descriptor.CredentialsSchema,
+	}
+}
+
+// genericCredentialsField returns the credentials parameter of a run
+// request for any of the tools, describing their formats.
+func genericCredentialsField(descriptors map[CLIName]CLIDescriptor) common.SchemaElement {
+	formats := []string{}
+	for tool, d := range descriptors {
+		format := d.CredentialsFormat
+		if format == "" && d.CredentialsSchema != nil {
+			format = fmt.Sprintf("A JSON object with %s.", strings.Join(credentialsFieldNames(d.CredentialsSchema), ", "))
+		}
+		if format == "" {
+			continue
+		}
+		if len(descriptors) != 1 {
+			format = fmt.Sprintf("%s: %s", tool, format)
+		}
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	desc := fmt.Sprintf("The credentials to use for the command, or a %s reference to them, defaults to the ones configured for the tool.", secretReferencePrefix)
+	if len(formats) != 0 {
+		desc += " " + strings.Join(formats, " ")
+	}
+	return common.SchemaElement{
+		DataType:     common.SchemaDataTypes.Secret,
+		Label:        "Credentials",
+		Description:  desc,
+		DisplayIndex: 1,
+	}
+}
+
+func credentialsFieldNames(schema *common.SchemaObject) []string {
+	names := []string{}
+	for k := range schema.Fields {
+		names = append(names, string(k))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveCredentials resolves the secret references in the credentials
+// and, if the tool has a CredentialsSchema, parses them, fills in their
+// missing fields from the defaults and validates them.
+func resolveCredentials(o *limacharlie.Organization, descriptor CLIDescriptor, credentials string, defaults limacharlie.Dict) (resolvedCredentials, error) {
+	res := resolvedCredentials{
+		value:    credentials,
+		defaults: defaults,
+	}
+	if credentials == "" && descriptor.CredentialsSchema == nil {
+		return res, fmt.Errorf("%w: credentials are required", ErrInvalidCredentials)
+	}
+	res.addSecret(credentials)
+	if strings.HasPrefix(credentials, secretReferencePrefix) {
+		val, err := getSecretFunc(credentials, o)
+		if err != nil {
+			return res, fmt.Errorf("failed to resolve credentials %s: %v", credentials, err)
+		}
+		res.value = val
+		res.addSecret(val)
+	}
+	if descriptor.CredentialsSchema == nil {
+		return res, nil
+	}
+
+	structured := CLICredentials{}
+	if res.value != "" {
+		if err := json.Unmarshal([]byte(res.value), &structured); err != nil {
+			return res, fmt.Errorf("%w: expected a JSON object", ErrInvalidCredentials)
+		}
+	}
+	for k, v := range defaults {
+		if _, ok := descriptor.CredentialsSchema.Fields[k]; !ok {
+			continue
+		}
+		if _, ok := structured[k]; !ok {
+			structured[k] = v
+		}
+	}
+	for k, v := range structured {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(s, secretReferencePrefix) {
+			val, err := getSecretFunc(s, o)
+			if err != nil {
+				return res, fmt.Errorf("failed to resolve credentials %s: %v", s, err)
+			}
+			structured[k] = val
+			res.addSecret(val)
+		} else if descriptor.CredentialsSchema.Fields[k].DataType == common.SchemaDataTypes.Secret {
+			res.addSecret(s)
+		}
+	}
+	if err := validateCredentials(descriptor.CredentialsSchema, structured); err != nil {
+		return res, err
+	}
+	if descriptor.ValidateCredentials != nil {
+		if err := descriptor.ValidateCredentials(structured); err != nil {
+			return res, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+		}
+	}
+
+	b, err := json.Marshal(structured)
+	if err != nil {
+		return res, err
+	}
+	res.value = string(b)
+	res.structured = structured
+	return res, nil
+}
+
+func (r *resolvedCredentials) addSecret(s string) {
+	if s != "" {
+		r.secrets = append(r.secrets, s)
+	}
+}
+
+// validateCredentials checks the credentials against their schema.
+func validateCredentials(schema *common.SchemaObject, credentials CLICredentials) error {
+	if err := checkSchemaValues(schema, credentials); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	return nil
+}
+
+// structuredTools returns the tools with a CredentialsSchema.
+func (e *CLIExtension) structuredTools() []CLIName {
+	tools := []CLIName{}
+	for tool, d := range e.Descriptors {
+		if d.CredentialsSchema != nil {
+			tools = append(tools, tool)
+		}
+	}
+	slices.Sort(tools)
+	return tools
+}
@@ -0,0 +1,185 @@
+package simplified
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/common"
+	"github.com/refractionPOINT/lc-extension/core"
+)
+
+var awsCredentialsSchema = &common.SchemaObject{
+	Requirements: [][]common.SchemaKey{{"access_key_id", "role_arn"}, {"region"}},
+	Fields: map[common.SchemaKey]common.SchemaElement{
+		"access_key_id":     {DataType: common.SchemaDataTypes.String},
+		"secret_access_key": {DataType: common.SchemaDataTypes.Secret},
+		"session_token":     {DataType: common.SchemaDataTypes.Secret},
+		"role_arn":          {DataType: common.SchemaDataTypes.String},
+		"region":            {DataType: common.SchemaDataTypes.String},
+	},
+}
+
+func TestCLIRunRequestUnmarshal(t *testing.T) {
+	r := CLIRunRequest{}
+	if err := json.Unmarshal([]byte(`{"tool":"aws","command_tokens":["s3","ls"],"credentials":"key:secret"}`), &r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Tool != "aws" || len(r.CommandTokens) != 2 || r.Credentials != "key:secret" {
+		t.Errorf("unexpected request: %+v", r)
+	}
+
+	r = CLIRunRequest{}
+	if err := json.Unmarshal([]byte(`{"credentials":{"region":"us-east-1"}}`), &r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Credentials != `{"region":"us-east-1"}` {
+		t.Errorf("expected serialized credentials: %s", r.Credentials)
+	}
+}
+
+func TestResolveCredentials(t *testing.T) {
+	originalGetSecret := getSecretFunc
+	defer func() {
+		getSecretFunc = originalGetSecret
+	}()
+	getSecretFunc = func(key string, o *limacharlie.Organization) (string, error) {
+		switch key {
+		case "hive://secret/aws":
+			return `{"access_key_id":"AKIA","secret_access_key":"hive://secret/aws-key","region":"us-east-1"}`, nil
+		case "hive://secret/aws-key":
+			return "s3cr3t", nil
+		}
+		return "", errors.New("not found")
+	}
+
+	// Unstructured credentials are passed as is.
+	creds, err := resolveCredentials(nil, CLIDescriptor{}, "key:secret", nil)
+	if err != nil || creds.value != "key:secret" || creds.structured != nil {
+		t.Errorf("unexpected credentials: %+v %v", creds, err)
+	}
+
+	descriptor := CLIDescriptor{CredentialsSchema: awsCredentialsSchema}
+	creds, err = resolveCredentials(nil, descriptor, "hive://secret/aws", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if creds.structured["secret_access_key"] != "s3cr3t" || creds.structured["region"] != "us-east-1" {
+		t.Errorf("unexpected credentials: %+v", creds.structured)
+	}
+	if strings.Contains(creds.value, "hive://") || !strings.Contains(creds.value, "s3cr3t") {
+		t.Errorf("expected the references to be resolved: %s", creds.value)
+	}
+	for _, s := range []string{"hive://secret/aws", "s3cr3t"} {
+		found := false
+		for _, secret := range creds.secrets {
+			found = found || secret == s
+		}
+		if !found {
+			t.Errorf("expected %s to be masked", s)
+		}
+	}
+
+	for _, test := range []struct {
+		name        string
+		credentials string
+	}{
+		{"not an object", "key:secret"},
+		{"missing requirement", `{"access_key_id":"AKIA"}`},
+		{"too many alternatives", `{"access_key_id":"AKIA","role_arn":"arn","region":"us-east-1"}`},
+		{"unknown field", `{"role_arn":"arn","region":"us-east-1","other":"x"}`},
+		{"invalid type", `{"role_arn":"arn","region":1}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := resolveCredentials(nil, descriptor, test.credentials, nil); !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("expected invalid credentials, got %v", err)
+			}
+		})
+	}
+
+	if _, err := resolveCredentials(nil, descriptor, "hive://secret/missing", nil); err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected a resolution error, got %v", err)
+	}
+
+	descriptor.ValidateCredentials = func(c CLICredentials) error {
+		if !strings.HasPrefix(c["role_arn"].(string), "arn:") {
+			return fmt.Errorf("invalid role")
+		}
+		return nil
+	}
+	if _, err := resolveCredentials(nil, descriptor, `{"role_arn":"role","region":"us-east-1"}`, nil); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected the custom validation to fail, got %v", err)
+	}
+}
+
+func TestDoRunStructuredCredentials(t *testing.T) {
+	originalSendToWebhook := sendToWebhookAdapterFunc
+	originalStopThisInstance := stopThisInstanceFunc
+	defer func() {
+		sendToWebhookAdapterFunc = originalSendToWebhook
+		stopThisInstanceFunc = originalStopThisInstance
+	}()
+	var hook limacharlie.Dict
+	sendToWebhookAdapterFunc = func(ext *core.Extension, o *limacharlie.Organization, h limacharlie.Dict) error {
+		hook = h
+		return nil
+	}
+	stopThisInstanceFunc = func(logger limacharlie.LCLogger, o *limacharlie.Organization, req *CLIRunRequest, errMsg string, killTimeout time.Duration) {
+	}
+
+	org, err := limacharlie.NewOrganizationFromClientOptions(dummyOpt, dummyLogger{})
+	if err != nil {
+		t.Fatalf("failed to create organization: %v", err)
+	}
+	var received CLICredentials
+	cliExt := &CLIExtension{
+		Name:   "test-extension",
+		Logger: dummyLogger{},
+		Descriptors: map[CLIName]CLIDescriptor{"aws": {
+			CredentialsSchema: awsCredentialsSchema,
+			ProcessCommand: func(ctx context.Context, tokens []string, creds string) (CLIReturnData, error) {
+				received = CLICredentialsFromContext(ctx)
+				return CLIReturnData{}, nil
+			},
+		}},
+		extension: dummyCoreExt,
+	}
+
+	request := CLIRunRequest{}
+	if err := json.Unmarshal([]byte(`{"command_line":"s3 ls","credentials":{"role_arn":"arn:aws:iam::1:role/r","region":"us-east-1"}}`), &request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp := cliExt.doRun(org, &request, "ident", "inv", cliConfig{}); resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if received["role_arn"] != "arn:aws:iam::1:role/r" {
+		t.Errorf("expected the credentials in the context: %v", received)
+	}
+	if hook == nil {
+		t.Errorf("expected the run to be reported")
+	}
+
+	request = CLIRunRequest{CommandLine: "s3 ls", Credentials: `{"region":"us-east-1"}`}
+	if resp := cliExt.doRun(org, &request, "ident", "inv", cliConfig{}); resp.Error == "" || resp.Retriable == nil || *resp.Retriable {
+		t.Errorf("expected a non-retriable error: %+v", resp)
+	}
+}
+
+func TestCredentialsField(t *testing.T) {
+	field := credentialsField("aws", CLIDescriptor{CredentialsSchema: awsCredentialsSchema})
+	if field.DataType != common.SchemaDataTypes.Object || field.Object != awsCredentialsSchema {
+		t.Errorf("expected a structured field: %+v", field)
+	}
+	field = genericCredentialsField(map[CLIName]CLIDescriptor{
+		"aws":    {CredentialsSchema: awsCredentialsSchema},
+		"gcloud": {CredentialsFormat: "A service account JSON key."},
+	})
+	if field.DataType != common.SchemaDataTypes.Secret || !strings.Contains(field.Description, "aws: A JSON object with access_key_id") || !strings.Contains(field.Description, "gcloud: A service account") {
+		t.Errorf("unexpected description: %s", field.Description)
+	}
+}
@@ -0,0 +1,108 @@
+package simplified
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+// How long a terminating instance has to exit before it is killed, by default.
+const defaultKillTimeout = 30 * time.Second
+
+// CLIIsolation is how the requests of a CLIExtension are isolated from
+// each other, since handlers may drop credentials on disk or leave state
+// behind in the configuration of the CLIs.
+type CLIIsolation interface {
+	// StartRequest returns the context the commands of the request run in
+	// and a function to call once the request is done, with its error if any.
+	StartRequest(ctx context.Context, logger limacharlie.LCLogger, o *limacharlie.Organization, request *CLIRunRequest) (context.Context, func(errMsg string), error)
+	// IsReusable returns true if the instance keeps serving requests once
+	// one is done, which is required to run commands in the background.
+	IsReusable() bool
+}
+
+// CLITerminateIsolation terminates the instance after each request, for
+// runtimes serving one request per container. The instance is killed if
+// it is still running after the KillTimeout.
+type CLITerminateIsolation struct {
+	// Optional, defaults to 30 seconds.
+	KillTimeout time.Duration
+}
+
+// CLIReuseIsolation keeps the instance serving requests, each of them
+// with its own work directory which is removed once it is done. The work
+// directory is available to the handlers through CLIWorkDirFromContext and
+// is the home directory of the CLIs run by a CLIProcess.
+type CLIReuseIsolation struct {
+	// Optional, additional cleanup done after each request.
+	Cleanup func() error
+}
+
+func (e *CLIExtension) isolation() CLIIsolation {
+	if e.Isolation == nil {
+		return &CLITerminateIsolation{}
+	}
+	return e.Isolation
+}
+
+func (t *CLITerminateIsolation) StartRequest(ctx context.Context, logger limacharlie.LCLogger, o *limacharlie.Organization, request *CLIRunRequest) (context.Context, func(errMsg string), error) {
+	return ctx, func(errMsg string) {
+		timeout := t.KillTimeout
+		if timeout <= 0 {
+			timeout = defaultKillTimeout
+		}
+		stopThisInstanceFunc(logger, o, request, errMsg, timeout)
+	}, nil
+}
+
+func (t *CLITerminateIsolation) IsReusable() bool {
+	return false
+}
+
+func (r *CLIReuseIsolation) StartRequest(ctx context.Context, logger limacharlie.LCLogger, o *limacharlie.Organization, request *CLIRunRequest) (context.Context, func(errMsg string), error) {
+	dir, err := os.MkdirTemp("", "lc-cli-request-")
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to create work directory: %v", err)
+	}
+	return context.WithValue(ctx, cliWorkDirContextKey{}, dir), func(errMsg string) {
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Error(fmt.Sprintf("failed to remove work directory %s: %v", dir, err))
+		}
+		if r.Cleanup != nil {
+			if err := r.Cleanup(); err != nil {
+				logger.Error(fmt.Sprintf("failed to clean up after request for %s: %v", o.GetOID(), err))
+			}
+		}
+	}, nil
+}
+
+func (r *CLIReuseIsolation) IsReusable() bool {
+	return true
+}
+
+// StartRequest runs the commands of the request in the sandbox, each of
+// them in a subprocess with its own temporary home directory. Without
+// namespaces the instance is terminated once the request is done.
+func (s *CLISandbox) StartRequest(ctx context.Context, logger limacharlie.LCLogger, o *limacharlie.Organization, request *CLIRunRequest) (context.Context, func(errMsg string), error) {
+	if s.DisableNamespaces {
+		t := &CLITerminateIsolation{KillTimeout: s.KillTimeout}
+		return t.StartRequest(withCLISandbox(ctx, s), logger, o, request)
+	}
+	return withCLISandbox(ctx, s), func(errMsg string) {}, nil
+}
+
+func (s *CLISandbox) IsReusable() bool {
+	return !s.DisableNamespaces
+}
+
+type cliWorkDirContextKey struct{}
+
+// CLIWorkDirFromContext returns the work directory of the request,
+// or an empty string if the isolation does not provide one.
+func CLIWorkDirFromContext(ctx context.Context) string {
+	d, _ := ctx.Value(cliWorkDirContextKey{}).(string)
+	return d
+}
@@ -0,0 +1,120 @@
+package simplified
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/common"
+	"github.com/refractionPOINT/lc-extension/core"
+)
+
+func TestCLIIsolation(t *testing.T) {
+	originalSendToWebhook := sendToWebhookAdapterFunc
+	originalStopThisInstance := stopThisInstanceFunc
+	defer func() {
+		sendToWebhookAdapterFunc = originalSendToWebhook
+		stopThisInstanceFunc = originalStopThisInstance
+	}()
+	hooks := make(chan limacharlie.Dict, 10)
+	sendToWebhookAdapterFunc = func(ext *core.Extension, o *limacharlie.Organization, hook limacharlie.Dict) error {
+		hooks <- hook
+		return nil
+	}
+	stopTimeouts := []time.Duration{}
+	stopThisInstanceFunc = func(logger limacharlie.LCLogger, o *limacharlie.Organization, req *CLIRunRequest, errMsg string, killTimeout time.Duration) {
+		stopTimeouts = append(stopTimeouts, killTimeout)
+	}
+
+	org, err := limacharlie.NewOrganizationFromClientOptions(dummyOpt, dummyLogger{})
+	if err != nil {
+		t.Fatalf("failed to create organization: %v", err)
+	}
+	var workDir string
+	cliExt := &CLIExtension{
+		Name:   "test-extension",
+		Logger: dummyLogger{},
+		Descriptors: map[CLIName]CLIDescriptor{"dummy": {ProcessCommand: func(ctx context.Context, tokens []string, creds string) (CLIReturnData, error) {
+			workDir = CLIWorkDirFromContext(ctx)
+			if workDir != "" {
+				if _, err := os.Stat(workDir); err != nil {
+					t.Errorf("expected the work directory to exist: %v", err)
+				}
+			}
+			return CLIReturnData{}, nil
+		}}},
+		JobStore:  newMemoryJobStore(),
+		extension: dummyCoreExt,
+	}
+	run := func(isAsync bool) common.Response {
+		return cliExt.doRun(org, &CLIRunRequest{CommandTokens: []string{"cmd"}, Credentials: "creds", IsAsync: isAsync}, "ident", "inv", cliConfig{})
+	}
+
+	// The instance is terminated by default.
+	if resp := run(false); resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	<-hooks
+	cliExt.Isolation = &CLITerminateIsolation{KillTimeout: time.Second}
+	run(false)
+	<-hooks
+	if len(stopTimeouts) != 2 || stopTimeouts[0] != defaultKillTimeout || stopTimeouts[1] != time.Second {
+		t.Errorf("unexpected stops: %v", stopTimeouts)
+	}
+	if resp := run(true); resp.Error == "" || len(stopTimeouts) != 3 {
+		t.Errorf("async runs should not be allowed when terminating: %+v", resp)
+	}
+
+	// Reused instances clean up after each request.
+	cleanups := 0
+	cliExt.Isolation = &CLIReuseIsolation{Cleanup: func() error {
+		cleanups++
+		return nil
+	}}
+	if resp := run(false); resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	<-hooks
+	if workDir == "" || cleanups != 1 || len(stopTimeouts) != 3 {
+		t.Errorf("unexpected request isolation: %q %d %v", workDir, cleanups, stopTimeouts)
+	}
+	if _, err := os.Stat(workDir); !os.IsNotExist(err) {
+		t.Errorf("expected the work directory to be removed: %v", err)
+	}
+
+	// Async runs are cleaned up once their job is done.
+	cliExt.JobOrg = func(oid string) (*limacharlie.Organization, error) {
+		return limacharlie.NewOrganizationFromClientOptions(dummyOpt, dummyLogger{})
+	}
+	resp := run(true)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	<-hooks
+	waitForJob(t, cliExt, org, resp.Data.(*CLIJob).JobID)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(workDir); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the work directory of the job to be removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCLIProcessWorkDir(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.WithValue(context.Background(), cliWorkDirContextKey{}, dir)
+	data, err := CLIProcess{Path: "/bin/sh"}.Run(ctx, []string{"-c", `echo "$HOME"; pwd`}, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lines := strings.Fields(data.OutputString); len(lines) != 2 || lines[0] != dir || lines[1] != dir {
+		t.Errorf("expected the CLI to run in the work directory: %q", data.OutputString)
+	}
+}
@@ -0,0 +1,376 @@
+package simplified
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/common"
+	"github.com/refractionPOINT/lc-extension/core"
+)
+
+// Timeout of async runs by default.
+const defaultAsyncCommandExecutionTimeout = 1 * time.Hour
+
+// How long jobs are kept once they are done.
+const cliJobRetention = 1 * time.Hour
+
+// Delay between the polls of a job by continuations.
+const cliJobPollDelay = 30
+
+// Delay after the timeout of a job still running after which
+// the instance running it is considered gone.
+const cliJobLostDelay = 5 * time.Minute
+
+// Delay between the checks of the cancellation of a job by the
+// instance running it. Only to be overridden by tests.
+var cliJobCancelCheckDelay = 10 * time.Second
+
+// CLIJobStatus is the status of an async run.
+type CLIJobStatus = string
+
+var CLIJobStatuses = struct {
+	Running   CLIJobStatus
+	Succeeded CLIJobStatus
+	Failed    CLIJobStatus
+	Canceled  CLIJobStatus
+}{
+	Running:   "running",
+	Succeeded: "succeeded",
+	Failed:    "failed",
+	Canceled:  "canceled",
+}
+
+// CLIJob is a command running in the background. Jobs are kept in the
+// CLIJobStore so that any instance can report them, while only the one
+// running a job updates it. Their outcome is also sent to the webhook
+// adapter of the extension like synchronous runs.
+type CLIJob struct {
+	JobID     string         `json:"job_id"`
+	Tool      string         `json:"tool"`
+	Status    CLIJobStatus   `json:"status"`
+	StartedAt int64          `json:"started_at"`
+	EndedAt   int64          `json:"ended_at,omitempty"`
+	Result    *CLIReturnData `json:"result,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+type cliJobRequest struct {
+	JobID string `json:"job_id"`
+	// Keep polling the job with continuations until it is done.
+	IsPolling bool `json:"poll"`
+}
+
+// JobOrgCallback returns an Org with the credentials of the extension,
+// like a user API key with access to the Orgs, for the async runs: they
+// outlive the requests and the short-lived JWT of their Org.
+type JobOrgCallback = func(oid string) (*limacharlie.Organization, error)
+
+// CLIJobStore keeps the jobs where all the instances of the extension
+// can find them, so that a job can be followed and canceled through
+// any of them, not only the one running it.
+type CLIJobStore interface {
+	// GetJob returns a job of the Org, or nil if there is none.
+	GetJob(ctx context.Context, o *limacharlie.Organization, jobID string) (*CLIJob, error)
+	// SetJob saves a job of the Org, which can be dropped after the expiry.
+	SetJob(ctx context.Context, o *limacharlie.Organization, job *CLIJob, expiry time.Time) error
+	// RequestCancel records that a job of the Org should be canceled,
+	// which the instance running it checks with IsCancelRequested.
+	RequestCancel(ctx context.Context, o *limacharlie.Organization, jobID string, expiry time.Time) error
+	IsCancelRequested(ctx context.Context, o *limacharlie.Organization, jobID string) (bool, error)
+}
+
+// hiveJobStore keeps the jobs as state records in the Hive of the Org.
+type hiveJobStore struct {
+	extName string
+}
+
+type cliJobCancel struct {
+	IsCanceled bool `json:"canceled"`
+}
+
+func (s hiveJobStore) recordName(jobID string) string {
+	return stateRecordName(s.extName, "job-"+jobID)
+}
+
+func (s hiveJobStore) cancelRecordName(jobID string) string {
+	return stateRecordName(s.extName, "job-cancel-"+jobID)
+}
+
+func (s hiveJobStore) tag() string {
+	return fmt.Sprintf("ext:%s", s.extName)
+}
+
+func (s hiveJobStore) GetJob(ctx context.Context, o *limacharlie.Organization, jobID string) (*CLIJob, error) {
+	job := &CLIJob{}
+	if err := loadState(o, s.recordName(jobID), job); err != nil {
+		return nil, err
+	}
+	if job.JobID != jobID {
+		return nil, nil
+	}
+	return job, nil
+}
+
+func (s hiveJobStore) SetJob(ctx context.Context, o *limacharlie.Organization, job *CLIJob, expiry time.Time) error {
+	return saveExpiringState(o, s.recordName(job.JobID), s.tag(), job, expiry.UnixMilli())
+}
+
+func (s hiveJobStore) RequestCancel(ctx context.Context, o *limacharlie.Organization, jobID string, expiry time.Time) error {
+	return saveExpiringState(o, s.cancelRecordName(jobID), s.tag(), cliJobCancel{IsCanceled: true}, expiry.UnixMilli())
+}
+
+func (s hiveJobStore) IsCancelRequested(ctx context.Context, o *limacharlie.Organization, jobID string) (bool, error) {
+	c := cliJobCancel{}
+	if err := loadState(o, s.cancelRecordName(jobID), &c); err != nil {
+		return false, err
+	}
+	return c.IsCanceled, nil
+}
+
+var cliJobSchema = common.SchemaObject{
+	Fields: map[common.SchemaKey]common.SchemaElement{
+		"job_id": {
+			DataType:    common.SchemaDataTypes.String,
+			Label:       "Job ID",
+			Description: "The ID of the job.",
+		},
+		"tool": {
+			DataType:    common.SchemaDataTypes.String,
+			Label:       "Tool",
+			Description: "The tool running the command.",
+		},
+		"status": {
+			DataType:    common.SchemaDataTypes.Enum,
+			Label:       "Status",
+			Description: "The status of the job.",
+			EnumValues:  []interface{}{CLIJobStatuses.Running, CLIJobStatuses.Succeeded, CLIJobStatuses.Failed, CLIJobStatuses.Canceled},
+		},
+		"started_at": {
+			DataType:    common.SchemaDataTypes.Time,
+			Label:       "Started At",
+			Description: "When the job started.",
+		},
+		"ended_at": {
+			DataType:    common.SchemaDataTypes.Time,
+			Label:       "Ended At",
+			Description: "When the job ended.",
+		},
+		"result": {
+			DataType:    common.SchemaDataTypes.Object,
+			Label:       "Result",
+			Description: "The outcome of the command once the job is done.",
+		},
+		"error": {
+			DataType:    common.SchemaDataTypes.String,
+			Label:       "Error",
+			Description: "The error of the command if it failed.",
+		},
+	},
+}
+
+var cliJobParameters = common.SchemaObject{
+	Requirements: [][]common.SchemaKey{{"job_id"}},
+	Fields: map[common.SchemaKey]common.SchemaElement{
+		"job_id": {
+			DataType:    common.SchemaDataTypes.String,
+			Label:       "Job ID",
+			Description: "The ID of the job returned by an async run.",
+		},
+	},
+}
+
+func (e *CLIExtension) asyncTimeout() time.Duration {
+	if e.AsyncTimeout <= 0 {
+		return defaultAsyncCommandExecutionTimeout
+	}
+	return e.AsyncTimeout
+}
+
+func (e *CLIExtension) jobStore() CLIJobStore {
+	if e.JobStore == nil {
+		return hiveJobStore{extName: e.Name}
+	}
+	return e.JobStore
+}
+
+// jobExpiry returns when a job started now can be dropped, once
+// it timed out and was kept for the retention.
+func (e *CLIExtension) jobExpiry() time.Time {
+	return time.Now().Add(e.asyncTimeout() + cliJobLostDelay + cliJobRetention)
+}
+
+// startJob runs a validated command in the background and returns the job
+// running it, with a continuation polling it until it is done.
+// The done function of the request is called once the job is done.
+func (e *CLIExtension) startJob(ctx context.Context, o *limacharlie.Organization, request *CLIRunRequest, handler CLIDescriptor, creds resolvedCredentials, tool string, ident string, invID string, done func(errMsg string)) common.Response {
+	if !e.isolation().IsReusable() {
+		return common.Response{
+			Error:     "async runs are only supported by extensions reusing their instance, like with a CLISandbox isolation",
+			Retriable: Bool(false),
+		}
+	}
+	if e.JobOrg == nil {
+		return common.Response{
+			Error:     "async runs are only supported by extensions with a JobOrg",
+			Retriable: Bool(false),
+		}
+	}
+	jobID, err := newRandomID()
+	if err != nil {
+		return common.Response{Error: err.Error()}
+	}
+	job := &CLIJob{
+		JobID:     jobID,
+		Tool:      tool,
+		Status:    CLIJobStatuses.Running,
+		StartedAt: time.Now().UnixMilli(),
+	}
+	// The Org of the request is closed once it returns.
+	jobOrg, err := e.JobOrg(o.GetOID())
+	if err != nil {
+		return common.Response{Error: fmt.Sprintf("failed to create organization for job: %v", err)}
+	}
+	if err := e.jobStore().SetJob(ctx, jobOrg, job, e.jobExpiry()); err != nil {
+		jobOrg.Close()
+		return common.Response{Error: fmt.Sprintf("failed to save job: %v", err)}
+	}
+	snapshot := *job
+
+	e.Logger.Info(fmt.Sprintf("starting job %s for %s and tool %s", jobID, o.GetOID(), tool))
+	go func() {
+		defer jobOrg.Close()
+		ctx, cancel := context.WithTimeout(ctx, e.asyncTimeout())
+		defer cancel()
+		isCanceled := e.watchJobCancel(ctx, jobOrg, jobID, cancel)
+		resp := e.runCommand(ctx, jobOrg, request, handler, creds, ident, invID, jobID)
+		cancel()
+		e.finishJob(jobOrg, job, resp, isCanceled())
+		done(resp.Error)
+	}()
+
+	return common.Response{
+		Data:          &snapshot,
+		Continuations: []common.ContinuationRequest{pollJobContinuation(jobID)},
+	}
+}
+
+// watchJobCancel cancels a job once it is requested, until the context
+// is done. The returned function waits for the watch to stop and
+// returns true if the job was canceled.
+func (e *CLIExtension) watchJobCancel(ctx context.Context, o *limacharlie.Organization, jobID string, cancel context.CancelFunc) func() bool {
+	isCanceled := false
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(cliJobCancelCheckDelay)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			ok, err := e.jobStore().IsCancelRequested(ctx, o, jobID)
+			if err != nil {
+				e.Logger.Warn(fmt.Sprintf("failed to check the cancellation of job %s for %s: %v", jobID, o.GetOID(), err))
+				continue
+			}
+			if ok && ctx.Err() == nil {
+				isCanceled = true
+				cancel()
+				return
+			}
+		}
+	}()
+	return func() bool {
+		<-stopped
+		return isCanceled
+	}
+}
+
+func (e *CLIExtension) finishJob(o *limacharlie.Organization, job *CLIJob, resp common.Response, isCanceled bool) {
+	job.EndedAt = time.Now().UnixMilli()
+	job.Result, _ = resp.Data.(*CLIReturnData)
+	job.Error = resp.Error
+	if isCanceled {
+		job.Status = CLIJobStatuses.Canceled
+	} else if resp.Error != "" {
+		job.Status = CLIJobStatuses.Failed
+	} else {
+		job.Status = CLIJobStatuses.Succeeded
+	}
+	// The context of the job is done, saving it must not be interrupted.
+	if err := e.jobStore().SetJob(context.Background(), o, job, time.Now().Add(cliJobRetention)); err != nil {
+		e.Logger.Error(fmt.Sprintf("failed to save job %s for %s: %v", job.JobID, o.GetOID(), err))
+	}
+}
+
+// getJob returns a job of the org, or nil if there is none. Jobs still
+// running long after their timeout are failed, their instance is gone.
+func (e *CLIExtension) getJob(ctx context.Context, o *limacharlie.Organization, jobID string) (*CLIJob, error) {
+	job, err := e.jobStore().GetJob(ctx, o, jobID)
+	if err != nil || job == nil {
+		return nil, err
+	}
+	lostAt := time.UnixMilli(job.StartedAt).Add(e.asyncTimeout() + cliJobLostDelay)
+	if job.Status == CLIJobStatuses.Running && time.Now().After(lostAt) {
+		job.Status = CLIJobStatuses.Failed
+		job.EndedAt = lostAt.UnixMilli()
+		job.Error = "the instance running the job stopped"
+	}
+	return job, nil
+}
+
+func (e *CLIExtension) onGetJob(ctx context.Context, params core.RequestCallbackParams) common.Response {
+	request := params.Request.(*cliJobRequest)
+	job, err := e.getJob(ctx, params.Org, request.JobID)
+	if err != nil {
+		return common.Response{Error: fmt.Sprintf("failed to get job: %v", err)}
+	}
+	if job == nil {
+		return unknownJobResponse(request.JobID)
+	}
+	resp := common.Response{Data: job}
+	if request.IsPolling && job.Status == CLIJobStatuses.Running {
+		resp.Continuations = []common.ContinuationRequest{pollJobContinuation(job.JobID)}
+	}
+	return resp
+}
+
+func (e *CLIExtension) onCancelJob(ctx context.Context, params core.RequestCallbackParams) common.Response {
+	request := params.Request.(*cliJobRequest)
+	job, err := e.getJob(ctx, params.Org, request.JobID)
+	if err != nil {
+		return common.Response{Error: fmt.Sprintf("failed to get job: %v", err)}
+	}
+	if job == nil {
+		return unknownJobResponse(request.JobID)
+	}
+	if job.Status == CLIJobStatuses.Running {
+		if err := e.jobStore().RequestCancel(ctx, params.Org, job.JobID, e.jobExpiry()); err != nil {
+			return common.Response{Error: fmt.Sprintf("failed to cancel job: %v", err)}
+		}
+		e.Logger.Info(fmt.Sprintf("requested the cancellation of job %s for %s", request.JobID, params.Org.GetOID()))
+	}
+	return common.Response{Data: job}
+}
+
+func pollJobContinuation(jobID string) common.ContinuationRequest {
+	return common.ContinuationRequest{
+		InDelaySeconds: cliJobPollDelay,
+		Action:         "get_job",
+		State: limacharlie.Dict{
+			"job_id": jobID,
+			"poll":   true,
+		},
+	}
+}
+
+func unknownJobResponse(jobID string) common.Response {
+	return common.Response{
+		Error:     fmt.Sprintf("unknown job %s, it may have expired", jobID),
+		Retriable: Bool(false),
+	}
+}
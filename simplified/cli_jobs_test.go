@@ -0,0 +1,193 @@
+package simplified
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/core"
+)
+
+func TestCLIJobs(t *testing.T) {
+	originalSendToWebhook := sendToWebhookAdapterFunc
+	originalStopThisInstance := stopThisInstanceFunc
+	defer func() {
+		sendToWebhookAdapterFunc = originalSendToWebhook
+		stopThisInstanceFunc = originalStopThisInstance
+	}()
+	hooks := make(chan limacharlie.Dict, 10)
+	jobOrgs := map[*limacharlie.Organization]bool{}
+	jobOrgsMutex := sync.Mutex{}
+	sendToWebhookAdapterFunc = func(ext *core.Extension, o *limacharlie.Organization, hook limacharlie.Dict) error {
+		jobOrgsMutex.Lock()
+		isJobOrg := jobOrgs[o]
+		jobOrgsMutex.Unlock()
+		if !isJobOrg {
+			t.Errorf("jobs should use their own organization")
+		}
+		hooks <- hook
+		return nil
+	}
+	stopThisInstanceFunc = func(logger limacharlie.LCLogger, o *limacharlie.Organization, req *CLIRunRequest, errMsg string, killTimeout time.Duration) {
+	}
+	originalCancelCheckDelay := cliJobCancelCheckDelay
+	defer func() {
+		cliJobCancelCheckDelay = originalCancelCheckDelay
+	}()
+	cliJobCancelCheckDelay = 10 * time.Millisecond
+
+	org, err := limacharlie.NewOrganizationFromClientOptions(dummyOpt, dummyLogger{})
+	if err != nil {
+		t.Fatalf("failed to create organization: %v", err)
+	}
+	cliExt := &CLIExtension{
+		Name:   "test-extension",
+		Logger: dummyLogger{},
+		Descriptors: map[CLIName]CLIDescriptor{"dummy": {ProcessCommand: func(ctx context.Context, tokens []string, creds string) (CLIReturnData, error) {
+			if tokens[0] == "wait" {
+				<-ctx.Done()
+				return CLIReturnData{}, ctx.Err()
+			}
+			return CLIReturnData{OutputString: "done"}, nil
+		}}},
+		JobStore:  newMemoryJobStore(),
+		extension: dummyCoreExt,
+	}
+	// Another instance of the extension, sharing the jobs.
+	otherInstance := &CLIExtension{
+		Name:      "test-extension",
+		Logger:    dummyLogger{},
+		JobStore:  cliExt.JobStore,
+		extension: dummyCoreExt,
+	}
+
+	resp := cliExt.doRun(org, &CLIRunRequest{CommandTokens: []string{"run"}, Credentials: "creds", IsAsync: true}, "ident", "inv", cliConfig{})
+	if resp.Error == "" {
+		t.Errorf("async runs should require a reusable instance")
+	}
+
+	cliExt.Isolation = &CLISandbox{}
+	resp = cliExt.doRun(org, &CLIRunRequest{CommandTokens: []string{"run"}, Credentials: "creds", IsAsync: true}, "ident", "inv", cliConfig{})
+	if resp.Error == "" {
+		t.Errorf("async runs should require a JobOrg")
+	}
+
+	// Jobs outlive the organization of the request.
+	cliExt.JobOrg = func(oid string) (*limacharlie.Organization, error) {
+		if oid != org.GetOID() {
+			t.Errorf("unexpected oid: %s", oid)
+		}
+		o, err := limacharlie.NewOrganizationFromClientOptions(dummyOpt, dummyLogger{})
+		jobOrgsMutex.Lock()
+		defer jobOrgsMutex.Unlock()
+		jobOrgs[o] = true
+		return o, err
+	}
+	getJob := func(jobID string, isPolling bool) (*CLIJob, bool) {
+		resp := otherInstance.onGetJob(context.Background(), core.RequestCallbackParams{Org: org, Request: &cliJobRequest{JobID: jobID, IsPolling: isPolling}})
+		if resp.Error != "" {
+			t.Fatalf("unexpected error: %s", resp.Error)
+		}
+		return resp.Data.(*CLIJob), len(resp.Continuations) != 0
+	}
+
+	// A job running to completion.
+	resp = cliExt.doRun(org, &CLIRunRequest{CommandTokens: []string{"run"}, Credentials: "creds", IsAsync: true}, "ident", "inv", cliConfig{})
+	job, ok := resp.Data.(*CLIJob)
+	if !ok || job.Status != CLIJobStatuses.Running || len(resp.Continuations) != 1 || resp.Continuations[0].Action != "get_job" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if hook := <-hooks; hook["job_id"] != job.JobID {
+		t.Errorf("expected the job id in the hook: %v", hook)
+	}
+	waitForJob(t, cliExt, org, job.JobID)
+	if done, isPolling := getJob(job.JobID, true); done.Status != CLIJobStatuses.Succeeded || done.Result.OutputString != "done" || isPolling {
+		t.Errorf("unexpected job: %+v", done)
+	}
+
+	// A job canceled.
+	resp = cliExt.doRun(org, &CLIRunRequest{CommandTokens: []string{"wait"}, Credentials: "creds", IsAsync: true}, "ident", "inv", cliConfig{})
+	job = resp.Data.(*CLIJob)
+	if running, isPolling := getJob(job.JobID, true); running.Status != CLIJobStatuses.Running || !isPolling {
+		t.Errorf("expected the job to be running and polled: %+v", running)
+	}
+	if resp := otherInstance.onCancelJob(context.Background(), core.RequestCallbackParams{Org: org, Request: &cliJobRequest{JobID: job.JobID}}); resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	<-hooks
+	waitForJob(t, cliExt, org, job.JobID)
+	if canceled, _ := getJob(job.JobID, false); canceled.Status != CLIJobStatuses.Canceled {
+		t.Errorf("expected the job to be canceled: %+v", canceled)
+	}
+
+	// Unknown jobs and jobs whose instance is gone.
+	if resp := cliExt.onGetJob(context.Background(), core.RequestCallbackParams{Org: org, Request: &cliJobRequest{JobID: "unknown"}}); resp.Error == "" {
+		t.Errorf("expected an error for an unknown job")
+	}
+	lost := &CLIJob{JobID: "lost", Status: CLIJobStatuses.Running, StartedAt: time.Now().Add(-2 * defaultAsyncCommandExecutionTimeout).UnixMilli()}
+	if err := cliExt.JobStore.SetJob(context.Background(), org, lost, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if job, isPolling := getJob("lost", true); job.Status != CLIJobStatuses.Failed || isPolling {
+		t.Errorf("expected the job of a stopped instance to be failed: %+v", job)
+	}
+}
+
+func waitForJob(t *testing.T, e *CLIExtension, o *limacharlie.Organization, jobID string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, _ := e.getJob(context.Background(), o, jobID); job != nil && job.Status != CLIJobStatuses.Running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", jobID)
+}
+
+// memoryJobStore keeps the jobs in memory, shared by the
+// extensions using it like the instances of an extension.
+type memoryJobStore struct {
+	sync.Mutex
+	jobs     map[string]CLIJob
+	canceled map[string]bool
+}
+
+func newMemoryJobStore() *memoryJobStore {
+	return &memoryJobStore{
+		jobs:     map[string]CLIJob{},
+		canceled: map[string]bool{},
+	}
+}
+
+func (s *memoryJobStore) GetJob(ctx context.Context, o *limacharlie.Organization, jobID string) (*CLIJob, error) {
+	s.Lock()
+	defer s.Unlock()
+	job, ok := s.jobs[o.GetOID()+"/"+jobID]
+	if !ok {
+		return nil, nil
+	}
+	return &job, nil
+}
+
+func (s *memoryJobStore) SetJob(ctx context.Context, o *limacharlie.Organization, job *CLIJob, expiry time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	s.jobs[o.GetOID()+"/"+job.JobID] = *job
+	return nil
+}
+
+func (s *memoryJobStore) RequestCancel(ctx context.Context, o *limacharlie.Organization, jobID string, expiry time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	s.canceled[o.GetOID()+"/"+jobID] = true
+	return nil
+}
+
+func (s *memoryJobStore) IsCancelRequested(ctx context.Context, o *limacharlie.Organization, jobID string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.canceled[o.GetOID()+"/"+jobID], nil
+}
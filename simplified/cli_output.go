@@ -0,0 +1,153 @@
+package simplified
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+// Size of the output of a command over which it is not returned in
+// the response but sent to the webhook adapter or uploaded, by default.
+const defaultMaxResponseOutputSize = 1024 * 1024
+
+// Size of the chunks of output sent to the webhook adapter.
+const outputChunkSize = 512 * 1024
+
+// Size of the beginning of the output returned when it is too large.
+const outputPreviewSize = 4 * 1024
+
+// OutputUploadCallback uploads the output of a command too large to be returned
+// in the response, e.g. as an artifact, and returns where it can be found.
+type OutputUploadCallback = func(ctx context.Context, o *limacharlie.Organization, outputID string, output []byte) (string, error)
+
+// CLIOutputReference is returned instead of the output of a command too large
+// to fit in the response. The output is either sent to the webhook adapter of
+// the extension, in chunks with the output ID, the investigation ID and their
+// sequence number, or uploaded to the location.
+type CLIOutputReference struct {
+	OutputID string `json:"output_id"`
+	// Size in bytes of the output, serialized as JSON.
+	Size int `json:"size"`
+	// Number of JSON objects in the output, if it is a list.
+	Items int `json:"items,omitempty"`
+	// Number of chunks sent to the webhook adapter.
+	Chunks int `json:"chunks,omitempty"`
+	// Where the output was uploaded to.
+	Location string `json:"location,omitempty"`
+}
+
+func (e *CLIExtension) maxResponseOutputSize() int {
+	if e.MaxResponseOutputSize <= 0 {
+		return defaultMaxResponseOutputSize
+	}
+	return e.MaxResponseOutputSize
+}
+
+// offloadLargeOutput returns the output as is if it fits in the response,
+// otherwise it sends or uploads it and returns a summary of it with a
+// reference to where it is.
+func (e *CLIExtension) offloadLargeOutput(ctx context.Context, o *limacharlie.Organization, invID string, data CLIReturnData) (CLIReturnData, error) {
+	output, err := json.Marshal(CLIReturnData{
+		OutputString: data.OutputString,
+		OutputDict:   data.OutputDict,
+		OutputList:   data.OutputList,
+	})
+	if err != nil {
+		return data, fmt.Errorf("failed to marshal output: %v", err)
+	}
+	if len(output) <= e.maxResponseOutputSize() {
+		return data, nil
+	}
+
+	outputID, err := newRandomID()
+	if err != nil {
+		return data, err
+	}
+	ref := &CLIOutputReference{
+		OutputID: outputID,
+		Size:     len(output),
+		Items:    len(data.OutputList),
+	}
+	if e.UploadOutput != nil {
+		if ref.Location, err = e.UploadOutput(ctx, o, outputID, output); err != nil {
+			return data, fmt.Errorf("failed to upload output: %v", err)
+		}
+	} else {
+		chunks := chunkOutput(output, outputChunkSize)
+		ref.Chunks = len(chunks)
+		for i, chunk := range chunks {
+			if err := ctx.Err(); err != nil {
+				return data, err
+			}
+			if err := sendToWebhookAdapterFunc(e.extension, o, limacharlie.Dict{
+				"action":    "run_output",
+				"inv_id":    invID,
+				"output_id": outputID,
+				"seq":       i,
+				"chunks":    len(chunks),
+				"data":      chunk,
+			}); err != nil {
+				return data, fmt.Errorf("failed to send output: %v", err)
+			}
+		}
+	}
+
+	preview, err := outputPreview(data)
+	if err != nil {
+		return data, err
+	}
+	return CLIReturnData{
+		StatusCode:      data.StatusCode,
+		ErrorString:     data.ErrorString,
+		OutputString:    preview + fmt.Sprintf(outputTruncatedMarker, len(preview)),
+		OutputReference: ref,
+	}, nil
+}
+
+// outputPreview returns the beginning of the output of a command,
+// its raw output or else the JSON of its parsed output.
+func outputPreview(data CLIReturnData) (string, error) {
+	preview := []byte(data.OutputString)
+	if len(preview) == 0 {
+		var parsed interface{} = data.OutputList
+		if data.OutputDict != nil {
+			parsed = data.OutputDict
+		}
+		var err error
+		if preview, err = json.Marshal(parsed); err != nil {
+			return "", fmt.Errorf("failed to marshal output: %v", err)
+		}
+	}
+	return chunkOutput(preview, outputPreviewSize)[0], nil
+}
+
+// chunkOutput splits the output in chunks of at most
+// size bytes, without splitting UTF-8 characters.
+func chunkOutput(output []byte, size int) []string {
+	chunks := []string{}
+	for len(output) > size {
+		end := size
+		for end > 0 && !utf8.RuneStart(output[end]) {
+			end--
+		}
+		if end == 0 {
+			end = size
+		}
+		chunks = append(chunks, string(output[:end]))
+		output = output[end:]
+	}
+	return append(chunks, string(output))
+}
+
+func newRandomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
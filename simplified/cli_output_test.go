@@ -0,0 +1,90 @@
+package simplified
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/core"
+)
+
+func TestOffloadLargeOutput(t *testing.T) {
+	originalSendToWebhook := sendToWebhookAdapterFunc
+	defer func() {
+		sendToWebhookAdapterFunc = originalSendToWebhook
+	}()
+	hooks := []limacharlie.Dict{}
+	sendToWebhookAdapterFunc = func(ext *core.Extension, o *limacharlie.Organization, hook limacharlie.Dict) error {
+		hooks = append(hooks, hook)
+		return nil
+	}
+
+	org, err := limacharlie.NewOrganizationFromClientOptions(dummyOpt, dummyLogger{})
+	if err != nil {
+		t.Fatalf("failed to create organization: %v", err)
+	}
+	cliExt := &CLIExtension{
+		Logger:                dummyLogger{},
+		MaxResponseOutputSize: 1024,
+		extension:             dummyCoreExt,
+	}
+
+	small := CLIReturnData{OutputString: "small"}
+	if data, err := cliExt.offloadLargeOutput(context.Background(), org, "inv", small); err != nil || data.OutputString != "small" || data.OutputReference != nil {
+		t.Errorf("small outputs should be returned as is: %+v %v", data, err)
+	}
+
+	items := []limacharlie.Dict{}
+	for i := 0; i < 40000; i++ {
+		items = append(items, limacharlie.Dict{"key": fmt.Sprintf("bucket/é-%d", i)})
+	}
+	data, err := cliExt.offloadLargeOutput(context.Background(), org, "inv", CLIReturnData{StatusCode: 1, OutputList: items})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ref := data.OutputReference
+	if ref == nil || data.OutputList != nil || data.StatusCode != 1 {
+		t.Fatalf("expected a reference to the output: %+v", data)
+	}
+	if ref.Items != len(items) || ref.Chunks != len(hooks) || ref.Chunks < 2 {
+		t.Errorf("unexpected reference: %+v for %d hooks", ref, len(hooks))
+	}
+	if len(data.OutputString) > outputPreviewSize+100 {
+		t.Errorf("preview is too large: %d", len(data.OutputString))
+	}
+	if !strings.HasPrefix(data.OutputString, `[{"key":"bucket/é-0"}`) {
+		t.Errorf("the preview should only be the output: %.40q", data.OutputString)
+	}
+
+	// The chunks can be put back together.
+	sb := strings.Builder{}
+	for i, hook := range hooks {
+		if hook["seq"] != i || hook["output_id"] != ref.OutputID || hook["inv_id"] != "inv" {
+			t.Errorf("unexpected chunk: %v", hook["seq"])
+		}
+		sb.WriteString(hook["data"].(string))
+	}
+	full := CLIReturnData{}
+	if err := json.Unmarshal([]byte(sb.String()), &full); err != nil {
+		t.Fatalf("failed to reassemble output: %v", err)
+	}
+	if len(full.OutputList) != len(items) || full.OutputList[39999]["key"] != "bucket/é-39999" {
+		t.Errorf("unexpected reassembled output")
+	}
+
+	// Outputs are uploaded instead if possible.
+	hooks = []limacharlie.Dict{}
+	cliExt.UploadOutput = func(ctx context.Context, o *limacharlie.Organization, outputID string, output []byte) (string, error) {
+		return "artifact://" + outputID, nil
+	}
+	data, err = cliExt.offloadLargeOutput(context.Background(), org, "inv", CLIReturnData{OutputString: strings.Repeat("a", 2048)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data.OutputReference.Location != "artifact://"+data.OutputReference.OutputID || len(hooks) != 0 {
+		t.Errorf("expected the output to be uploaded: %+v", data.OutputReference)
+	}
+}
@@ -0,0 +1,319 @@
+package simplified
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"gopkg.in/yaml.v3"
+)
+
+// CLIOutputFormat is the format the output of a tool is parsed from.
+type CLIOutputFormat = string
+
+var CLIOutputFormats = struct {
+	// Try all the formats below, in order of how specific they are.
+	Auto CLIOutputFormat
+	// Concatenated JSON objects or a JSON array, like TryParsingOutput.
+	JSON CLIOutputFormat
+	// One JSON object per line.
+	JSONLines CLIOutputFormat
+	// One or more YAML documents.
+	YAML CLIOutputFormat
+	// Comma separated values with a header.
+	CSV CLIOutputFormat
+	// Tab separated values with a header.
+	TSV CLIOutputFormat
+	// Blocks of "key: value" lines separated by empty lines.
+	KeyValue CLIOutputFormat
+	// Columns aligned with spaces under a header, like kubectl get.
+	Table CLIOutputFormat
+}{
+	Auto:      "auto",
+	JSON:      "json",
+	JSONLines: "jsonl",
+	YAML:      "yaml",
+	CSV:       "csv",
+	TSV:       "tsv",
+	KeyValue:  "key_value",
+	Table:     "table",
+}
+
+// CLIOutputParser parses the output of a tool into OutputDict or OutputList.
+type CLIOutputParser = func(output []byte) (CLIReturnData, error)
+
+var errUnknownOutputFormat = errors.New("unknown output format")
+
+var cliOutputParsers = map[CLIOutputFormat]CLIOutputParser{
+	CLIOutputFormats.JSON:      parseJSONOutput,
+	CLIOutputFormats.JSONLines: parseJSONLinesOutput,
+	CLIOutputFormats.YAML:      parseYAMLOutput,
+	CLIOutputFormats.CSV:       func(output []byte) (CLIReturnData, error) { return parseDelimitedOutput(output, ',') },
+	CLIOutputFormats.TSV:       func(output []byte) (CLIReturnData, error) { return parseDelimitedOutput(output, '\t') },
+	CLIOutputFormats.KeyValue:  parseKeyValueOutput,
+	CLIOutputFormats.Table:     parseTableOutput,
+}
+
+// Order in which the formats are tried when auto-detecting, the most
+// specific first since most text is valid in the more lenient formats.
+var cliOutputAutoFormats = []CLIOutputFormat{
+	CLIOutputFormats.JSON,
+	CLIOutputFormats.YAML,
+	CLIOutputFormats.KeyValue,
+	CLIOutputFormats.TSV,
+	CLIOutputFormats.CSV,
+	CLIOutputFormats.Table,
+}
+
+// ParseOutput parses the output of a tool in the format. With the Auto
+// format, the output is returned as is if it is in none of the formats.
+func ParseOutput(output []byte, format CLIOutputFormat) (CLIReturnData, error) {
+	if format != CLIOutputFormats.Auto {
+		parser, ok := cliOutputParsers[format]
+		if !ok {
+			return CLIReturnData{}, fmt.Errorf("%w: %s", errUnknownOutputFormat, format)
+		}
+		return parser(output)
+	}
+	for _, f := range cliOutputAutoFormats {
+		if data, err := cliOutputParsers[f](output); err == nil {
+			return data, nil
+		}
+	}
+	return CLIReturnData{OutputString: string(output)}, nil
+}
+
+// parseOutput parses the raw output returned by the handler of the tool,
+// if it declares a format and the handler did not parse it already.
+func (d CLIDescriptor) parseOutput(data CLIReturnData) CLIReturnData {
+	if data.OutputString == "" || data.OutputDict != nil || data.OutputList != nil {
+		return data
+	}
+	var parsed CLIReturnData
+	var err error
+	if d.OutputParser != nil {
+		parsed, err = d.OutputParser([]byte(data.OutputString))
+	} else if d.OutputFormat != "" {
+		parsed, err = ParseOutput([]byte(data.OutputString), d.OutputFormat)
+	} else {
+		return data
+	}
+	if err != nil || (parsed.OutputDict == nil && parsed.OutputList == nil) {
+		return data
+	}
+	data.OutputString = ""
+	data.OutputDict = parsed.OutputDict
+	data.OutputList = parsed.OutputList
+	return data
+}
+
+// outputFromList returns a single object as OutputDict,
+// and anything else as OutputList.
+func outputFromList(l []limacharlie.Dict) CLIReturnData {
+	if len(l) == 1 {
+		return CLIReturnData{OutputDict: l[0]}
+	}
+	return CLIReturnData{OutputList: l}
+}
+
+func parseJSONOutput(output []byte) (CLIReturnData, error) {
+	data := tryParsingOutput(output)
+	if data.OutputDict == nil && data.OutputList == nil {
+		return data, errors.New("not json")
+	}
+	return data, nil
+}
+
+func parseJSONLinesOutput(output []byte) (CLIReturnData, error) {
+	l := []limacharlie.Dict{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(output)+1)
+	for i := 1; scanner.Scan(); i++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		d := limacharlie.Dict{}
+		if err := json.Unmarshal(line, &d); err != nil {
+			return CLIReturnData{}, fmt.Errorf("invalid json on line %d: %v", i, err)
+		}
+		l = append(l, d)
+	}
+	if err := scanner.Err(); err != nil {
+		return CLIReturnData{}, err
+	}
+	if len(l) == 0 {
+		return CLIReturnData{}, errors.New("no json lines")
+	}
+	return CLIReturnData{OutputList: l}, nil
+}
+
+func parseYAMLOutput(output []byte) (CLIReturnData, error) {
+	l := []limacharlie.Dict{}
+	dec := yaml.NewDecoder(bytes.NewReader(output))
+	for {
+		var doc interface{}
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return CLIReturnData{}, err
+		}
+		switch v := normalizeYAML(doc).(type) {
+		case nil:
+			// Empty document.
+		case map[string]interface{}:
+			l = append(l, v)
+		case []interface{}:
+			for _, item := range v {
+				d, ok := item.(map[string]interface{})
+				if !ok {
+					return CLIReturnData{}, errors.New("yaml list items are not objects")
+				}
+				l = append(l, d)
+			}
+		default:
+			return CLIReturnData{}, errors.New("yaml document is not an object")
+		}
+	}
+	if len(l) == 0 {
+		return CLIReturnData{}, errors.New("no yaml documents")
+	}
+	return outputFromList(l), nil
+}
+
+// normalizeYAML converts the maps with non-string
+// keys so that the values can be serialized as JSON.
+func normalizeYAML(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, item := range t {
+			t[k] = normalizeYAML(item)
+		}
+		return t
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, item := range t {
+			m[fmt.Sprint(k)] = normalizeYAML(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range t {
+			t[i] = normalizeYAML(item)
+		}
+		return t
+	}
+	return v
+}
+
+// parseDelimitedOutput parses records with a header into a list of objects.
+func parseDelimitedOutput(output []byte, delimiter rune) (CLIReturnData, error) {
+	r := csv.NewReader(bytes.NewReader(output))
+	r.Comma = delimiter
+	r.LazyQuotes = delimiter == '\t'
+	records, err := r.ReadAll()
+	if err != nil {
+		return CLIReturnData{}, err
+	}
+	if len(records) < 2 || len(records[0]) < 2 {
+		return CLIReturnData{}, errors.New("expected a header with multiple columns and records")
+	}
+	header := records[0]
+	l := make([]limacharlie.Dict, 0, len(records)-1)
+	for _, record := range records[1:] {
+		d := limacharlie.Dict{}
+		for i, v := range record {
+			d[strings.TrimSpace(header[i])] = v
+		}
+		l = append(l, d)
+	}
+	return CLIReturnData{OutputList: l}, nil
+}
+
+func parseKeyValueOutput(output []byte) (CLIReturnData, error) {
+	l := []limacharlie.Dict{}
+	d := limacharlie.Dict{}
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			if len(d) != 0 {
+				l = append(l, d)
+				d = limacharlie.Dict{}
+			}
+			continue
+		}
+		k, v, ok := strings.Cut(line, ":")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return CLIReturnData{}, fmt.Errorf("invalid key value line: %q", line)
+		}
+		d[k] = strings.TrimSpace(v)
+	}
+	if len(d) != 0 {
+		l = append(l, d)
+	}
+	if len(l) == 0 {
+		return CLIReturnData{}, errors.New("no key value lines")
+	}
+	return outputFromList(l), nil
+}
+
+// parseTableOutput parses columns aligned under a header, where the
+// columns of the header are separated by at least two spaces so that
+// headers like "NOMINATED NODE" are kept as one column.
+func parseTableOutput(output []byte) (CLIReturnData, error) {
+	lines := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimRight(line, " \r")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) < 2 {
+		return CLIReturnData{}, errors.New("expected a header and rows")
+	}
+	header := []rune(lines[0])
+	if strings.ContainsAny(lines[0], "\t") || header[0] == ' ' {
+		return CLIReturnData{}, errors.New("invalid table header")
+	}
+
+	starts := []int{0}
+	for i := 2; i < len(header); i++ {
+		if header[i] != ' ' && header[i-1] == ' ' && header[i-2] == ' ' {
+			starts = append(starts, i)
+		}
+	}
+	if len(starts) < 2 {
+		return CLIReturnData{}, errors.New("expected multiple columns")
+	}
+	names := make([]string, len(starts))
+	for i := range starts {
+		names[i] = strings.TrimSpace(tableCell(header, starts, i))
+	}
+
+	l := make([]limacharlie.Dict, 0, len(lines)-1)
+	for _, line := range lines[1:] {
+		d := limacharlie.Dict{}
+		for i, name := range names {
+			d[name] = strings.TrimSpace(tableCell([]rune(line), starts, i))
+		}
+		l = append(l, d)
+	}
+	return CLIReturnData{OutputList: l}, nil
+}
+
+// tableCell returns the content of the column i of the line.
+func tableCell(line []rune, starts []int, i int) string {
+	if starts[i] >= len(line) {
+		return ""
+	}
+	if i == len(starts)-1 || starts[i+1] > len(line) {
+		return string(line[starts[i]:])
+	}
+	return string(line[starts[i]:starts[i+1]])
+}
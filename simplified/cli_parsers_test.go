@@ -0,0 +1,235 @@
+package simplified
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/core"
+)
+
+func TestParseOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   CLIOutputFormat
+		output   string
+		expected CLIReturnData
+		isError  bool
+	}{
+		{
+			name:     "json lines",
+			format:   CLIOutputFormats.JSONLines,
+			output:   "{\"a\":1}\n\n{\"a\":2}\n",
+			expected: CLIReturnData{OutputList: []limacharlie.Dict{{"a": 1.0}, {"a": 2.0}}},
+		},
+		{
+			name:    "invalid json lines",
+			format:  CLIOutputFormats.JSONLines,
+			output:  "{\"a\":1}\nnot json\n",
+			isError: true,
+		},
+		{
+			name:     "yaml document",
+			format:   CLIOutputFormats.YAML,
+			output:   "name: pod-1\nspec:\n  containers:\n    - name: app\n      ports: [80, 443]\n",
+			expected: CLIReturnData{OutputDict: limacharlie.Dict{"name": "pod-1", "spec": map[string]interface{}{"containers": []interface{}{map[string]interface{}{"name": "app", "ports": []interface{}{80, 443}}}}}},
+		},
+		{
+			name:     "yaml documents",
+			format:   CLIOutputFormats.YAML,
+			output:   "---\nname: a\n---\nname: b\n",
+			expected: CLIReturnData{OutputList: []limacharlie.Dict{{"name": "a"}, {"name": "b"}}},
+		},
+		{
+			name:     "yaml list",
+			format:   CLIOutputFormats.YAML,
+			output:   "- name: a\n- name: b\n",
+			expected: CLIReturnData{OutputList: []limacharlie.Dict{{"name": "a"}, {"name": "b"}}},
+		},
+		{
+			name:    "yaml scalar",
+			format:  CLIOutputFormats.YAML,
+			output:  "just some text\n",
+			isError: true,
+		},
+		{
+			name:     "csv",
+			format:   CLIOutputFormats.CSV,
+			output:   "name,zone\n\"vm, 1\",us-east1-b\nvm-2,us-west1-a\n",
+			expected: CLIReturnData{OutputList: []limacharlie.Dict{{"name": "vm, 1", "zone": "us-east1-b"}, {"name": "vm-2", "zone": "us-west1-a"}}},
+		},
+		{
+			name:    "csv with inconsistent records",
+			format:  CLIOutputFormats.CSV,
+			output:  "name,zone\nvm-1\n",
+			isError: true,
+		},
+		{
+			name:     "tsv",
+			format:   CLIOutputFormats.TSV,
+			output:   "Name\tLocation\nrg-1\teastus\n",
+			expected: CLIReturnData{OutputList: []limacharlie.Dict{{"Name": "rg-1", "Location": "eastus"}}},
+		},
+		{
+			name:     "key value block",
+			format:   CLIOutputFormats.KeyValue,
+			output:   "account: me@example.com\nproject: my-project\n",
+			expected: CLIReturnData{OutputDict: limacharlie.Dict{"account": "me@example.com", "project": "my-project"}},
+		},
+		{
+			name:     "key value blocks",
+			format:   CLIOutputFormats.KeyValue,
+			output:   "name: a\nurl: http://a\n\nname: b\nurl: http://b\n",
+			expected: CLIReturnData{OutputList: []limacharlie.Dict{{"name": "a", "url": "http://a"}, {"name": "b", "url": "http://b"}}},
+		},
+		{
+			name:    "not key value",
+			format:  CLIOutputFormats.KeyValue,
+			output:  "name: a\nno separator\n",
+			isError: true,
+		},
+		{
+			name:   "table",
+			format: CLIOutputFormats.Table,
+			output: "NAME    READY   STATUS    NOMINATED NODE   AGE\n" +
+				"pod-1   1/1     Running   <none>           5d\n" +
+				"pod-é   0/1     Pending                    1m\n",
+			expected: CLIReturnData{OutputList: []limacharlie.Dict{
+				{"NAME": "pod-1", "READY": "1/1", "STATUS": "Running", "NOMINATED NODE": "<none>", "AGE": "5d"},
+				{"NAME": "pod-é", "READY": "0/1", "STATUS": "Pending", "NOMINATED NODE": "", "AGE": "1m"},
+			}},
+		},
+		{
+			name:    "table without rows",
+			format:  CLIOutputFormats.Table,
+			output:  "NAME   READY\n",
+			isError: true,
+		},
+		{
+			name:     "auto json",
+			format:   CLIOutputFormats.Auto,
+			output:   `[{"a":1}]`,
+			expected: CLIReturnData{OutputList: []limacharlie.Dict{{"a": 1.0}}},
+		},
+		{
+			name:     "auto yaml",
+			format:   CLIOutputFormats.Auto,
+			output:   "kind: List\nitems: []\n",
+			expected: CLIReturnData{OutputDict: limacharlie.Dict{"kind": "List", "items": []interface{}{}}},
+		},
+		{
+			name:     "auto key value blocks",
+			format:   CLIOutputFormats.Auto,
+			output:   "name: a\n\nname: b\n",
+			expected: CLIReturnData{OutputList: []limacharlie.Dict{{"name": "a"}, {"name": "b"}}},
+		},
+		{
+			name:     "auto csv",
+			format:   CLIOutputFormats.Auto,
+			output:   "name,zone\nvm-1,us-east1-b\n",
+			expected: CLIReturnData{OutputList: []limacharlie.Dict{{"name": "vm-1", "zone": "us-east1-b"}}},
+		},
+		{
+			name:     "auto table",
+			format:   CLIOutputFormats.Auto,
+			output:   "NAME    STATUS\nvm-1    RUNNING\n",
+			expected: CLIReturnData{OutputList: []limacharlie.Dict{{"NAME": "vm-1", "STATUS": "RUNNING"}}},
+		},
+		{
+			name:     "auto raw",
+			format:   CLIOutputFormats.Auto,
+			output:   "Done.",
+			expected: CLIReturnData{OutputString: "Done."},
+		},
+		{
+			name:    "unknown format",
+			format:  "xml",
+			output:  "<a/>",
+			isError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := ParseOutput([]byte(test.output), test.format)
+			if test.isError {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(data, test.expected) {
+				t.Errorf("unexpected output:\n%#v\nexpected:\n%#v", data, test.expected)
+			}
+			// The outputs must be serializable in responses.
+			if _, err := json.Marshal(data); err != nil {
+				t.Errorf("failed to marshal output: %v", err)
+			}
+		})
+	}
+}
+
+func TestDoRunOutputFormat(t *testing.T) {
+	originalSendToWebhook := sendToWebhookAdapterFunc
+	originalStopThisInstance := stopThisInstanceFunc
+	defer func() {
+		sendToWebhookAdapterFunc = originalSendToWebhook
+		stopThisInstanceFunc = originalStopThisInstance
+	}()
+	sendToWebhookAdapterFunc = func(ext *core.Extension, o *limacharlie.Organization, hook limacharlie.Dict) error {
+		return nil
+	}
+	stopThisInstanceFunc = func(logger limacharlie.LCLogger, o *limacharlie.Organization, req *CLIRunRequest, errMsg string, killTimeout time.Duration) {
+	}
+
+	org, err := limacharlie.NewOrganizationFromClientOptions(dummyOpt, dummyLogger{})
+	if err != nil {
+		t.Fatalf("failed to create organization: %v", err)
+	}
+	process := func(ctx context.Context, tokens []string, creds string) (CLIReturnData, error) {
+		return CLIReturnData{OutputString: tokens[0], ErrorString: "warning"}, nil
+	}
+	cliExt := &CLIExtension{
+		Name:   "test-extension",
+		Logger: dummyLogger{},
+		Descriptors: map[CLIName]CLIDescriptor{
+			"kubectl": {ProcessCommand: process, OutputFormat: CLIOutputFormats.Auto},
+			"raw":     {ProcessCommand: process},
+			"custom": {ProcessCommand: process, OutputParser: func(output []byte) (CLIReturnData, error) {
+				if string(output) == "fail" {
+					return CLIReturnData{}, errors.New("unparsable")
+				}
+				return CLIReturnData{OutputDict: limacharlie.Dict{"value": string(output)}}, nil
+			}},
+		},
+		extension: dummyCoreExt,
+	}
+
+	run := func(tool string, output string) CLIReturnData {
+		resp := cliExt.doRun(org, &CLIRunRequest{Tool: tool, CommandTokens: []string{output}, Credentials: "creds"}, "ident", "inv", cliConfig{})
+		if resp.Error != "" {
+			t.Fatalf("unexpected error: %s", resp.Error)
+		}
+		return *resp.Data.(*CLIReturnData)
+	}
+
+	if data := run("kubectl", "NAME   AGE\npod   5d\n"); len(data.OutputList) != 1 || data.OutputString != "" || data.ErrorString != "warning" {
+		t.Errorf("expected the table to be parsed: %+v", data)
+	}
+	if data := run("raw", "name: a"); data.OutputString != "name: a" || data.OutputDict != nil {
+		t.Errorf("expected the output as is without a format: %+v", data)
+	}
+	if data := run("custom", "a"); data.OutputDict["value"] != "a" {
+		t.Errorf("expected the custom parser to be used: %+v", data)
+	}
+	if data := run("custom", "fail"); data.OutputString != "fail" {
+		t.Errorf("expected the output as is when it can not be parsed: %+v", data)
+	}
+}
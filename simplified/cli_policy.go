@@ -0,0 +1,239 @@
+package simplified
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/refractionPOINT/lc-extension/common"
+)
+
+// CLIPolicy restricts the commands a CLI tool can run. It is evaluated
+// before the ProcessCommand of the tool, returning a CommandError with
+// the offending token when a command is not allowed.
+// Commands are space separated subcommands, like "s3 ls", whose elements
+// can be glob patterns, like "ec2 describe-*". An allowed command matches
+// the tokens which are not flags if it is a prefix of them. A denied
+// command matches them if it is anywhere in them, so that the value of a
+// flag missing from the ValueFlags can not be used to get around it.
+type CLIPolicy struct {
+	// Optional, commands allowed, all are if empty.
+	AllowedCommands []string `json:"allowed_commands"`
+	// Optional, commands not allowed.
+	DeniedCommands []string `json:"denied_commands"`
+	// Optional, flags not allowed, like "--endpoint-url".
+	DeniedFlags []string `json:"denied_flags"`
+	// Optional, regular expressions every token must match.
+	ArgumentPatterns []string `json:"argument_patterns"`
+	// Optional, only allow the read-only commands of the tool.
+	IsReadOnly bool `json:"read_only"`
+
+	// Set by the tool only, commands which do not modify anything.
+	// Read-only mode is not supported by tools without them.
+	ReadOnlyCommands []string `json:"-"`
+	// Set by the tool only, flags followed by a value, like "--region",
+	// so that their value is not mistaken for a subcommand.
+	ValueFlags []string `json:"-"`
+}
+
+// cliToolPolicy is a policy set in the config of an org
+// further restricting the policy of a tool.
+type cliToolPolicy struct {
+	// The tool the policy applies to, or all tools if empty.
+	Tool CLIName `json:"tool"`
+	CLIPolicy
+}
+
+var cliPolicySchema = common.SchemaElement{
+	DataType:    common.SchemaDataTypes.Object,
+	IsList:      true,
+	Label:       "Command Policies",
+	Description: "Restrictions on the commands which can be run, in addition to the ones of the tools.",
+	Object: &common.SchemaObject{
+		Fields: map[common.SchemaKey]common.SchemaElement{
+			"tool": {
+				DataType:    common.SchemaDataTypes.String,
+				Label:       "Tool",
+				Description: "The tool the policy applies to, or all tools if empty.",
+			},
+			"allowed_commands": {
+				DataType:    common.SchemaDataTypes.String,
+				IsList:      true,
+				Label:       "Allowed Commands",
+				Description: `Only allow these subcommands, like "s3 ls" or "ec2 describe-*".`,
+			},
+			"denied_commands": {
+				DataType:    common.SchemaDataTypes.String,
+				IsList:      true,
+				Label:       "Denied Commands",
+				Description: `Do not allow these subcommands, like "iam create-*".`,
+			},
+			"denied_flags": {
+				DataType:    common.SchemaDataTypes.String,
+				IsList:      true,
+				Label:       "Denied Flags",
+				Description: `Do not allow these flags, like "--endpoint-url".`,
+			},
+			"argument_patterns": {
+				DataType:    common.SchemaDataTypes.String,
+				IsList:      true,
+				Label:       "Argument Patterns",
+				Description: "Regular expressions every argument of the commands must match.",
+			},
+			"read_only": {
+				DataType:    common.SchemaDataTypes.Boolean,
+				Label:       "Read Only",
+				Description: "Only allow commands which do not modify anything.",
+			},
+		},
+	},
+}
+
+// checkCommand returns an error if the tokens are not allowed by the policy
+// of the tool or by any of the policies of the org applying to the tool.
+// The policies of the org can only restrict further what the tool allows.
+func checkCommand(tool CLIName, tokens []string, policy CLIPolicy, orgPolicies []cliToolPolicy) error {
+	if err := policy.check(tokens, policy); err != nil {
+		return err
+	}
+	for _, p := range orgPolicies {
+		if p.Tool != "" && p.Tool != tool {
+			continue
+		}
+		if err := p.CLIPolicy.check(tokens, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check returns a CommandError if the tokens are not allowed by the policy.
+// The read-only commands and the flags taking a value come from the policy
+// of the tool.
+func (p CLIPolicy) check(tokens []string, tool CLIPolicy) error {
+	for _, pattern := range p.ArgumentPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			// Fail closed on invalid patterns.
+			return policyError("", tokens)
+		}
+		for _, token := range tokens {
+			if !re.MatchString(token) {
+				return NewCommandError(token)
+			}
+		}
+	}
+
+	for _, token := range tokens {
+		if !strings.HasPrefix(token, "-") {
+			continue
+		}
+		flag, _, _ := strings.Cut(token, "=")
+		if slices.Contains(p.DeniedFlags, flag) {
+			return NewCommandError(token)
+		}
+	}
+
+	args := commandArguments(tokens, tool.ValueFlags)
+	if len(p.AllowedCommands) != 0 {
+		if ok, token := matchCommands(p.AllowedCommands, args); !ok {
+			return policyError(token, tokens)
+		}
+	}
+	for _, command := range p.DeniedCommands {
+		n := len(strings.Fields(command))
+		for start := range args {
+			if matchCommand(command, args[start:]) == n {
+				return NewCommandError(strings.Join(args[start:start+n], " "))
+			}
+		}
+	}
+	if p.IsReadOnly {
+		if len(tool.ReadOnlyCommands) == 0 {
+			return policyError("", tokens)
+		}
+		if ok, token := matchCommands(tool.ReadOnlyCommands, args); !ok {
+			return policyError(token, tokens)
+		}
+	}
+	return nil
+}
+
+// commandArguments returns the tokens which are not flags or flag values.
+func commandArguments(tokens []string, valueFlags []string) []string {
+	args := []string{}
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		if !strings.HasPrefix(token, "-") {
+			args = append(args, token)
+			continue
+		}
+		if !strings.Contains(token, "=") && slices.Contains(valueFlags, token) {
+			// Skip the value.
+			i++
+		}
+	}
+	return args
+}
+
+// matchCommands returns true if any of the commands matches the
+// arguments, or false and the first argument not matching.
+func matchCommands(commands []string, args []string) (bool, string) {
+	longest := 0
+	for _, command := range commands {
+		n := matchCommand(command, args)
+		if n == len(strings.Fields(command)) {
+			return true, ""
+		}
+		longest = max(longest, n)
+	}
+	if longest < len(args) {
+		return false, args[longest]
+	}
+	return false, ""
+}
+
+// policyError returns a CommandError for the offending token,
+// or for the whole command if there is none.
+func policyError(token string, tokens []string) error {
+	if token == "" {
+		token = strings.Join(tokens, " ")
+	}
+	return NewCommandError(token)
+}
+
+// matchCommand returns how many elements of the command match the arguments.
+func matchCommand(command string, args []string) int {
+	elements := strings.Fields(command)
+	for i, element := range elements {
+		if i >= len(args) {
+			return i
+		}
+		if ok, err := path.Match(element, args[i]); err != nil || !ok {
+			return i
+		}
+	}
+	return len(elements)
+}
+
+// validateCLIPolicy returns an error if the policy is invalid.
+func validateCLIPolicy(p CLIPolicy) error {
+	for _, pattern := range p.ArgumentPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid argument pattern %q: %v", pattern, err)
+		}
+	}
+	for _, command := range append(append([]string{}, p.AllowedCommands...), p.DeniedCommands...) {
+		if strings.TrimSpace(command) == "" {
+			return fmt.Errorf("empty command")
+		}
+		for _, element := range strings.Fields(command) {
+			if _, err := path.Match(element, ""); err != nil {
+				return fmt.Errorf("invalid command %q: %v", command, err)
+			}
+		}
+	}
+	return nil
+}
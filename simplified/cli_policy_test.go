@@ -0,0 +1,83 @@
+package simplified
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckCommand(t *testing.T) {
+	tool := CLIPolicy{
+		AllowedCommands:  []string{"s3", "ec2 describe-*", "ec2 stop-instances", "sts get-caller-identity"},
+		DeniedCommands:   []string{"s3 rb"},
+		DeniedFlags:      []string{"--endpoint-url"},
+		ArgumentPatterns: []string{"^[^;|&]*$"},
+		ReadOnlyCommands: []string{"s3 ls", "ec2 describe-*", "sts get-caller-identity"},
+		ValueFlags:       []string{"--region", "--profile"},
+	}
+	readOnly := []cliToolPolicy{{Tool: "aws", CLIPolicy: CLIPolicy{IsReadOnly: true}}}
+	otherTool := []cliToolPolicy{{Tool: "gcloud", CLIPolicy: CLIPolicy{IsReadOnly: true}}}
+	widening := []cliToolPolicy{{CLIPolicy: CLIPolicy{AllowedCommands: []string{"iam"}}}}
+
+	tests := []struct {
+		name      string
+		tokens    []string
+		policies  []cliToolPolicy
+		offending string
+	}{
+		{"allowed", []string{"s3", "ls", "s3://bucket"}, nil, ""},
+		{"allowed glob", []string{"--region", "us-east-1", "ec2", "describe-instances"}, nil, ""},
+		{"not allowed", []string{"iam", "create-user"}, nil, "iam"},
+		{"not allowed subcommand", []string{"ec2", "terminate-instances"}, nil, "terminate-instances"},
+		{"denied", []string{"s3", "rb", "s3://bucket"}, nil, "s3 rb"},
+		{"denied flag", []string{"s3", "ls", "--endpoint-url=http://evil"}, nil, "--endpoint-url=http://evil"},
+		{"argument pattern", []string{"s3", "ls", "a;b"}, nil, "a;b"},
+		{"read only", []string{"ec2", "describe-instances"}, readOnly, ""},
+		{"read only modification", []string{"ec2", "stop-instances"}, readOnly, "stop-instances"},
+		{"policy of other tool", []string{"ec2", "stop-instances"}, otherTool, ""},
+		{"org cannot widen", []string{"iam", "list-users"}, widening, "iam"},
+		{"org restricts", []string{"s3", "ls"}, widening, "s3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCommand("aws", tt.tokens, tool, tt.policies)
+			if tt.offending == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			var cmdErr *CommandError
+			if !errors.As(err, &cmdErr) {
+				t.Fatalf("expected a command error, got %v", err)
+			}
+			if cmdErr.Command != tt.offending {
+				t.Errorf("expected %q to be reported, got %q", tt.offending, cmdErr.Command)
+			}
+		})
+	}
+
+	// The value of a flag the tool does not know can not hide a denied command.
+	denyRemove := []cliToolPolicy{{CLIPolicy: CLIPolicy{DeniedCommands: []string{"s3 rm"}}}}
+	err := checkCommand("aws", []string{"--output", "json", "s3", "rm", "s3://bucket", "--recursive"}, CLIPolicy{ValueFlags: tool.ValueFlags}, denyRemove)
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.Command != "s3 rm" {
+		t.Errorf("expected the denied command to be reported, got %v", err)
+	}
+
+	// Read-only mode is not supported without read-only commands.
+	if err := checkCommand("gcloud", []string{"compute", "instances", "list"}, CLIPolicy{}, otherTool); err == nil {
+		t.Errorf("expected read-only mode to be refused")
+	}
+}
+
+func TestValidateCLIPolicy(t *testing.T) {
+	if err := validateCLIPolicy(CLIPolicy{ArgumentPatterns: []string{"("}}); err == nil {
+		t.Errorf("expected an invalid pattern error")
+	}
+	if err := validateCLIPolicy(CLIPolicy{DeniedCommands: []string{"s3 ["}}); err == nil {
+		t.Errorf("expected an invalid command error")
+	}
+	if err := validateCLIPolicy(CLIPolicy{AllowedCommands: []string{"ec2 describe-*"}, ArgumentPatterns: []string{"^[a-z]+$"}}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
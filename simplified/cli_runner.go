@@ -0,0 +1,180 @@
+package simplified
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Maximum size of the output returned by default by a CLIProcess.
+const defaultCLIProcessMaxOutputSize = 1024 * 1024
+
+// Marker appended to outputs which were truncated.
+const outputTruncatedMarker = "\n[output truncated at %d bytes]"
+
+// CredentialsInjection is how credentials are provided to a CLI.
+type CredentialsInjection = string
+
+var CredentialsInjections = struct {
+	// The credentials are set in the CredentialsEnv environment variable.
+	Env CredentialsInjection
+	// The credentials are written to a private file whose path is set in the
+	// CredentialsEnv environment variable and/or passed after the CredentialsFlag.
+	File CredentialsInjection
+	// The credentials are passed after the CredentialsFlag.
+	Flag CredentialsInjection
+}{
+	Env:  "env",
+	File: "file",
+	Flag: "flag",
+}
+
+// CLIProcess runs a CLI binary and converts its outcome to a CLIReturnData.
+// Its Run method can be used directly as the ProcessCommand of a CLIDescriptor.
+// If the CLIExtension is sandboxed, the binary runs in its sandbox, otherwise
+// it inherits the environment of the extension, with the work directory of
+// the request as its home directory if the isolation provides one.
+type CLIProcess struct {
+	Path string
+	// Optional, how the credentials are provided to the CLI, they are not if empty.
+	CredentialsInjection CredentialsInjection
+	// Environment variable set to the credentials or to the path of their file.
+	CredentialsEnv string
+	// Flag followed by the credentials or by the path of their file.
+	CredentialsFlag string
+	// Optional, environment variables set for the CLI.
+	Env map[string]string
+	// Optional, maximum number of bytes of output returned, defaults to 1MB.
+	MaxOutputSize int
+}
+
+// Run runs the CLI with the tokens as arguments. The exit code of
+// the CLI is returned as the StatusCode, a non-zero exit code is not
+// an error. Outputs too large are truncated and not parsed.
+func (p CLIProcess) Run(ctx context.Context, tokens []string, credentials string) (CLIReturnData, error) {
+	for _, token := range tokens {
+		if strings.Contains(token, CredentialsFilePlaceholder) {
+			return CLIReturnData{}, NewCommandError(token)
+		}
+	}
+
+	command, err := p.command(tokens, credentials)
+	if err != nil {
+		return CLIReturnData{}, err
+	}
+
+	var res SandboxResult
+	if sandbox := CLISandboxFromContext(ctx); sandbox != nil {
+		res, err = sandbox.Run(ctx, command)
+	} else {
+		res, err = p.runUnsandboxed(ctx, command)
+	}
+	if err != nil {
+		return CLIReturnData{}, err
+	}
+
+	stdout, isStdoutTruncated := truncateOutput(res.Stdout, res.IsStdoutTruncated, p.maxOutputSize())
+	stderr, isStderrTruncated := truncateOutput(res.Stderr, res.IsStderrTruncated, p.maxOutputSize())
+
+	var data CLIReturnData
+	if isStdoutTruncated {
+		data = CLIReturnData{OutputString: string(stdout) + fmt.Sprintf(outputTruncatedMarker, p.maxOutputSize())}
+	} else {
+		data = tryParsingOutput(stdout)
+	}
+	data.StatusCode = res.ExitCode
+	data.ErrorString = string(stderr)
+	if isStderrTruncated {
+		data.ErrorString += fmt.Sprintf(outputTruncatedMarker, p.maxOutputSize())
+	}
+	return data, nil
+}
+
+// command returns the command to run, injecting the credentials.
+func (p CLIProcess) command(tokens []string, credentials string) (SandboxCommand, error) {
+	command := SandboxCommand{
+		Path: p.Path,
+		Args: tokens,
+		Env:  map[string]string{},
+	}
+	for k, v := range p.Env {
+		command.Env[k] = v
+	}
+	if credentials == "" || p.CredentialsInjection == "" {
+		return command, nil
+	}
+
+	switch p.CredentialsInjection {
+	case CredentialsInjections.Env:
+		if p.CredentialsEnv == "" {
+			return command, fmt.Errorf("no environment variable to set the credentials in")
+		}
+		command.Env[p.CredentialsEnv] = credentials
+	case CredentialsInjections.File:
+		if p.CredentialsEnv == "" && p.CredentialsFlag == "" {
+			return command, fmt.Errorf("no environment variable or flag to pass the credentials file with")
+		}
+		command.Credentials = credentials
+		command.CredentialsFileEnv = p.CredentialsEnv
+		if p.CredentialsFlag != "" {
+			command.Args = append([]string{p.CredentialsFlag, CredentialsFilePlaceholder}, tokens...)
+		}
+	case CredentialsInjections.Flag:
+		if p.CredentialsFlag == "" {
+			return command, fmt.Errorf("no flag to pass the credentials with")
+		}
+		command.Args = append([]string{p.CredentialsFlag, credentials}, tokens...)
+	default:
+		return command, fmt.Errorf("unknown credentials injection: %s", p.CredentialsInjection)
+	}
+	return command, nil
+}
+
+func (p CLIProcess) runUnsandboxed(ctx context.Context, command SandboxCommand) (res SandboxResult, err error) {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+	// The CLIs keep their state in the work directory of the request
+	// if there is one, so that it is removed once the request is done.
+	dir := CLIWorkDirFromContext(ctx)
+	if dir != "" {
+		env["HOME"] = dir
+		env["TMPDIR"] = dir
+	}
+	credsDir := dir
+	if credsDir == "" {
+		credsDir = os.TempDir()
+	}
+	args, cleanup, err := injectCredentialsFile(credsDir, command, env)
+	if err != nil {
+		return SandboxResult{}, err
+	}
+	defer func() {
+		if cleanupErr := cleanup(); cleanupErr != nil && err == nil {
+			err = cleanupErr
+		}
+	}()
+	for k, v := range command.Env {
+		env[k] = v
+	}
+	argv := append([]string{command.Path}, args...)
+	return execCommand(ctx, argv, dir, flattenEnv(env), p.maxOutputSize(), nil)
+}
+
+func (p CLIProcess) maxOutputSize() int {
+	if p.MaxOutputSize <= 0 {
+		return defaultCLIProcessMaxOutputSize
+	}
+	return p.MaxOutputSize
+}
+
+func truncateOutput(output []byte, isTruncated bool, maxSize int) ([]byte, bool) {
+	if len(output) > maxSize {
+		return output[:maxSize], true
+	}
+	return output, isTruncated
+}
@@ -0,0 +1,74 @@
+package simplified
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCLIProcessRun(t *testing.T) {
+	p := CLIProcess{Path: "/bin/sh"}
+
+	data, err := p.Run(context.Background(), []string{"-c", `echo '{"a": 1}'; echo warning >&2; exit 2`}, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data.StatusCode != 2 {
+		t.Errorf("expected status code 2, got %d", data.StatusCode)
+	}
+	if data.OutputDict["a"] != float64(1) {
+		t.Errorf("expected the output to be parsed, got %+v", data)
+	}
+	if data.ErrorString != "warning\n" {
+		t.Errorf("unexpected error output: %q", data.ErrorString)
+	}
+
+	p.MaxOutputSize = 4
+	data, err = p.Run(context.Background(), []string{"-c", `echo '{"a": 1}'`}, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data.OutputDict != nil || data.OutputString != `{"a"`+"\n[output truncated at 4 bytes]" {
+		t.Errorf("unexpected truncated output: %+v", data)
+	}
+}
+
+func TestCLIProcessCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		process  CLIProcess
+		expected string
+	}{
+		{"env", CLIProcess{CredentialsInjection: CredentialsInjections.Env, CredentialsEnv: "CREDS"}, "env:secret"},
+		{"file env", CLIProcess{CredentialsInjection: CredentialsInjections.File, CredentialsEnv: "CREDS_FILE"}, "file:secret"},
+		{"file flag", CLIProcess{CredentialsInjection: CredentialsInjections.File, CredentialsFlag: "--key-file"}, "flag:--key-file:file:secret"},
+		{"flag", CLIProcess{CredentialsInjection: CredentialsInjections.Flag, CredentialsFlag: "--token"}, "flag:--token:secret"},
+	}
+	script := filepath.Join(t.TempDir(), "cli.sh")
+	if err := os.WriteFile(script, []byte(`#!/bin/sh
+if [ -n "$CREDS" ]; then echo "env:$CREDS"; elif [ -n "$CREDS_FILE" ]; then echo "file:$(cat "$CREDS_FILE")"; elif [ "$1" = "--key-file" ]; then echo "flag:$1:file:$(cat "$2")"; else echo "flag:$1:$2"; fi
+`), 0o700); err != nil {
+		t.Fatalf("failed to write script: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.process.Path = script
+			data, err := tt.process.Run(context.Background(), []string{}, "secret")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.TrimSpace(data.OutputString) != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, data.OutputString)
+			}
+		})
+	}
+
+	_, err := CLIProcess{Path: "/bin/echo"}.Run(context.Background(), []string{CredentialsFilePlaceholder}, "secret")
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Errorf("expected a command error for the credentials placeholder, got %v", err)
+	}
+}
@@ -0,0 +1,426 @@
+package simplified
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Maximum size of stdout and stderr kept by default for a sandboxed command.
+const defaultSandboxMaxOutputSize = 10 * 1024 * 1024
+
+// Time given to a sandboxed command to exit after its context is done.
+const sandboxWaitDelay = 5 * time.Second
+
+// Placeholder in the arguments of a SandboxCommand replaced with
+// the path of the file holding the credentials.
+const CredentialsFilePlaceholder = "{{credentials_file}}"
+
+// Environment variables passed through to sandboxed commands by default.
+var defaultSandboxPassEnv = []string{"PATH", "LANG", "TZ", "SSL_CERT_FILE", "SSL_CERT_DIR"}
+
+// Directory backed by memory where credentials are written if it exists.
+var credentialsTmpfsDir = "/dev/shm"
+
+// CLISandbox runs CLI binaries isolated from the extension and from
+// the other requests so that an instance can serve more than one
+// request without being terminated after each one.
+// Every command gets its own temporary home directory, a scrubbed
+// environment and its own Linux namespaces. The sandbox does not
+// filter the syscalls of the commands: Go can't install a seccomp
+// filter between the fork and the exec, so a Wrapper like nsjail
+// or bwrap with a seccomp profile is needed for it.
+type CLISandbox struct {
+	// Optional, environment variables of the extension passed through to the
+	// commands, defaults to PATH, LANG, TZ and the SSL certificate locations.
+	PassEnv []string
+	// Optional, maximum number of bytes of stdout and stderr kept, defaults to 10MB.
+	MaxOutputSize int
+	// Optional, run the commands without namespaces, where the kernel does
+	// not allow them. By default the commands run in new user, mount, PID,
+	// IPC and UTS namespaces with private mounts of the temporary directory,
+	// /dev/shm and /proc, so that concurrent commands can not see the files
+	// of each other, which requires the mount binary and fails if the kernel
+	// does not allow it. Without them the commands share the user, /proc
+	// and /dev/shm of the extension, so the instance is terminated after
+	// each request like with a CLITerminateIsolation and async runs are
+	// not supported.
+	DisableNamespaces bool
+	// Optional, how long a terminating instance has to exit before it
+	// is killed when the namespaces are disabled, defaults to 30 seconds.
+	KillTimeout time.Duration
+	// Optional, resource limits applied to the commands.
+	Limits SandboxLimits
+	// Optional, command the binaries are run through, like "nsjail" or "bwrap"
+	// with their arguments, e.g. to apply a seccomp profile.
+	Wrapper []string
+}
+
+// SandboxLimits are resource limits applied to a sandboxed command, 0 means unlimited.
+type SandboxLimits struct {
+	CPUSeconds    int
+	MemoryBytes   int64
+	FileSizeBytes int64
+	OpenFiles     int
+}
+
+// SandboxCommand is a command to run in a CLISandbox.
+type SandboxCommand struct {
+	Path string
+	Args []string
+	// Optional, environment variables set for the command.
+	Env map[string]string
+	// Optional, credentials written to a private file which
+	// is overwritten and removed once the command exits.
+	Credentials string
+	// Optional, environment variable set to the path of the credentials file.
+	CredentialsFileEnv string
+}
+
+// SandboxResult is the outcome of a sandboxed command.
+type SandboxResult struct {
+	ExitCode          int
+	Stdout            []byte
+	Stderr            []byte
+	IsStdoutTruncated bool
+	IsStderrTruncated bool
+}
+
+// Run runs a command in the sandbox and waits for it to exit.
+// A non-zero exit code is not an error, it is reported in the result.
+func (s *CLISandbox) Run(ctx context.Context, command SandboxCommand) (SandboxResult, error) {
+	home, err := os.MkdirTemp("", "lc-cli-")
+	if err != nil {
+		return SandboxResult{}, fmt.Errorf("failed to create home directory: %v", err)
+	}
+	defer os.RemoveAll(home)
+
+	if s.DisableNamespaces {
+		return s.runShared(ctx, home, command)
+	}
+	return s.runIsolated(ctx, home, command)
+}
+
+// errSandboxUnsupported is returned when the namespaces of the
+// sandbox can not be set up, they then need to be disabled.
+var errSandboxUnsupported = errors.New("namespaces are not supported, they must be disabled in the sandbox")
+
+// runIsolated runs the command in new namespaces where the temporary
+// directory, /dev/shm and /proc are private mounts. The credentials are
+// passed through a pipe and written to the private temporary directory,
+// they never hit the disk and are gone with the namespaces.
+func (s *CLISandbox) runIsolated(ctx context.Context, home string, command SandboxCommand) (SandboxResult, error) {
+	// The temporary directory holding the homes of all the commands is
+	// replaced by a private one, which can't be done for the root.
+	tmpDir := filepath.Dir(home)
+	if tmpDir == "/" {
+		return SandboxResult{}, fmt.Errorf("%w: the temporary directory is the root", errSandboxUnsupported)
+	}
+	env := s.environment(home)
+	credsPath := ""
+	if command.Credentials != "" {
+		credsPath = filepath.Join(home, ".lc-credentials")
+	}
+	args := injectCredentialsPath(command, env, credsPath)
+	for k, v := range command.Env {
+		env[k] = v
+	}
+
+	// The setup is done by a shell in the namespaces before it replaces
+	// itself with the command, the paths are passed as arguments and the
+	// arguments of the command are never interpreted by it. Once done it
+	// signals it on fd 4, telling setup failures from command failures.
+	steps := []string{`mount -t tmpfs -o mode=1777 tmpfs "$1"`}
+	if fi, err := os.Stat(credentialsTmpfsDir); err == nil && fi.IsDir() {
+		steps = append(steps, fmt.Sprintf("mount -t tmpfs -o mode=1777 tmpfs %s", credentialsTmpfsDir))
+	}
+	steps = append(steps, "mount -t proc proc /proc", `mkdir -m 700 "$2"`, `cd "$2"`)
+	if credsPath != "" {
+		steps = append(steps, `(umask 077 && cat <&3 >"$3")`)
+	}
+	steps = append(steps, "echo ok >&4", "exec 3<&- 4>&-")
+	steps = append(steps, s.Limits.ulimitCommands()...)
+	steps = append(steps, `shift 3`, `exec "$@"`)
+	argv := append([]string{"/bin/sh", "-c", strings.Join(steps, " && "), "sh", tmpDir, home, credsPath}, s.commandLine(command.Path, args)...)
+
+	credsReader, credsWriter, err := os.Pipe()
+	if err != nil {
+		return SandboxResult{}, err
+	}
+	defer credsReader.Close()
+	statusReader, statusWriter, err := os.Pipe()
+	if err != nil {
+		credsWriter.Close()
+		return SandboxResult{}, err
+	}
+	defer statusReader.Close()
+	go func() {
+		// Fails once the reader is closed if the setup failed.
+		_, _ = io.WriteString(credsWriter, command.Credentials)
+		credsWriter.Close()
+	}()
+
+	res, err := execCommand(ctx, argv, "/", flattenEnv(env), s.maxOutputSize(), func(cmd *exec.Cmd) {
+		isolateCommand(cmd, true)
+		cmd.ExtraFiles = []*os.File{credsReader, statusWriter}
+	})
+	statusWriter.Close()
+	if err != nil {
+		if isNamespaceUnsupported(err) {
+			return res, fmt.Errorf("%w: %v", errSandboxUnsupported, err)
+		}
+		return res, err
+	}
+	status, _ := io.ReadAll(statusReader)
+	if string(status) != "ok\n" {
+		return res, fmt.Errorf("%w: %s", errSandboxUnsupported, strings.TrimSpace(string(res.Stderr)))
+	}
+	return res, nil
+}
+
+// runShared runs the command without namespaces, with its credentials
+// in a file only readable by the user of the extension, which is
+// overwritten and removed once the command exits.
+func (s *CLISandbox) runShared(ctx context.Context, home string, command SandboxCommand) (res SandboxResult, err error) {
+	env := s.environment(home)
+	args, cleanup, err := injectCredentialsFile(home, command, env)
+	if err != nil {
+		return SandboxResult{}, err
+	}
+	defer func() {
+		if cleanupErr := cleanup(); cleanupErr != nil && err == nil {
+			err = cleanupErr
+		}
+	}()
+	for k, v := range command.Env {
+		env[k] = v
+	}
+
+	argv := s.commandLine(command.Path, args)
+	if limits := s.Limits.ulimitCommands(); len(limits) != 0 {
+		// The limits are applied by a shell which then replaces itself
+		// with the command, the arguments are never interpreted by it.
+		script := strings.Join(append(limits, `exec "$@"`), " && ")
+		argv = append([]string{"/bin/sh", "-c", script, "sh"}, argv...)
+	}
+	return execCommand(ctx, argv, home, flattenEnv(env), s.maxOutputSize(), func(cmd *exec.Cmd) {
+		isolateCommand(cmd, false)
+	})
+}
+
+// execCommand runs a command and captures its output, up to maxOutputSize
+// bytes each for stdout and stderr.
+func execCommand(ctx context.Context, argv []string, dir string, env []string, maxOutputSize int, configure func(cmd *exec.Cmd)) (SandboxResult, error) {
+	stdout := &limitedBuffer{limit: maxOutputSize}
+	stderr := &limitedBuffer{limit: maxOutputSize}
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = sandboxWaitDelay
+	if configure != nil {
+		configure(cmd)
+	}
+
+	err := cmd.Run()
+	res := SandboxResult{
+		ExitCode:          cmd.ProcessState.ExitCode(),
+		Stdout:            stdout.buf.Bytes(),
+		Stderr:            stderr.buf.Bytes(),
+		IsStdoutTruncated: stdout.isTruncated,
+		IsStderrTruncated: stderr.isTruncated,
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return res, ctxErr
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return res, err
+	}
+	return res, nil
+}
+
+// injectCredentialsFile writes the credentials of the command to a file,
+// setting its path in the environment and in the arguments. The returned
+// function removes the file.
+func injectCredentialsFile(dir string, command SandboxCommand, env map[string]string) ([]string, func() error, error) {
+	if command.Credentials == "" {
+		return command.Args, func() error { return nil }, nil
+	}
+	credsPath, err := writeCredentialsFile(dir, command.Credentials)
+	if err != nil {
+		return nil, nil, err
+	}
+	return injectCredentialsPath(command, env, credsPath), func() error {
+		if err := shredFile(credsPath); err != nil {
+			return fmt.Errorf("failed to remove credentials file: %v", err)
+		}
+		return nil
+	}, nil
+}
+
+// injectCredentialsPath sets the path of the credentials file in the
+// environment and returns the arguments of the command with it.
+func injectCredentialsPath(command SandboxCommand, env map[string]string, credsPath string) []string {
+	if credsPath == "" {
+		return command.Args
+	}
+	if command.CredentialsFileEnv != "" {
+		env[command.CredentialsFileEnv] = credsPath
+	}
+	args := make([]string, len(command.Args))
+	for i, arg := range command.Args {
+		args[i] = strings.ReplaceAll(arg, CredentialsFilePlaceholder, credsPath)
+	}
+	return args
+}
+
+// commandLine returns the full command line with the wrapper.
+func (s *CLISandbox) commandLine(path string, args []string) []string {
+	argv := append(append([]string{}, s.Wrapper...), path)
+	return append(argv, args...)
+}
+
+func (s *CLISandbox) environment(home string) map[string]string {
+	env := map[string]string{}
+	passEnv := s.PassEnv
+	if len(passEnv) == 0 {
+		passEnv = defaultSandboxPassEnv
+	}
+	for _, k := range passEnv {
+		if v, ok := os.LookupEnv(k); ok {
+			env[k] = v
+		}
+	}
+	env["HOME"] = home
+	env["TMPDIR"] = home
+	env["XDG_CONFIG_HOME"] = filepath.Join(home, ".config")
+	env["XDG_CACHE_HOME"] = filepath.Join(home, ".cache")
+	return env
+}
+
+func (s *CLISandbox) maxOutputSize() int {
+	if s.MaxOutputSize <= 0 {
+		return defaultSandboxMaxOutputSize
+	}
+	return s.MaxOutputSize
+}
+
+// ulimitCommands returns the shell commands applying the limits, one
+// per limit since POSIX shells like dash only take one at a time.
+func (l SandboxLimits) ulimitCommands() []string {
+	cmds := []string{}
+	if l.CPUSeconds > 0 {
+		cmds = append(cmds, fmt.Sprintf("ulimit -t %d", l.CPUSeconds))
+	}
+	if l.MemoryBytes > 0 {
+		cmds = append(cmds, fmt.Sprintf("ulimit -v %d", max(l.MemoryBytes/1024, 1)))
+	}
+	if l.FileSizeBytes > 0 {
+		// In blocks of 512 bytes.
+		cmds = append(cmds, fmt.Sprintf("ulimit -f %d", max(l.FileSizeBytes/512, 1)))
+	}
+	if l.OpenFiles > 0 {
+		cmds = append(cmds, fmt.Sprintf("ulimit -n %d", l.OpenFiles))
+	}
+	return cmds
+}
+
+func flattenEnv(env map[string]string) []string {
+	res := make([]string, 0, len(env))
+	for k, v := range env {
+		res = append(res, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(res)
+	return res
+}
+
+// writeCredentialsFile writes the credentials to a file only readable
+// by the current user, in memory if possible so they never hit the disk.
+func writeCredentialsFile(home string, credentials string) (string, error) {
+	dir := home
+	if fi, err := os.Stat(credentialsTmpfsDir); err == nil && fi.IsDir() {
+		dir = credentialsTmpfsDir
+	}
+	f, err := os.CreateTemp(dir, "lc-creds-")
+	if err != nil && dir != home {
+		f, err = os.CreateTemp(home, "lc-creds-")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create credentials file: %v", err)
+	}
+	defer f.Close()
+	if err := f.Chmod(0o600); err != nil {
+		return "", errors.Join(fmt.Errorf("failed to secure credentials file: %v", err), shredFile(f.Name()))
+	}
+	if _, err := f.WriteString(credentials); err != nil {
+		return "", errors.Join(fmt.Errorf("failed to write credentials file: %v", err), shredFile(f.Name()))
+	}
+	return f.Name(), nil
+}
+
+// shredFile overwrites a file with zeros before removing it.
+func shredFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		_, err = f.Write(make([]byte, fi.Size()))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(path); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// limitedBuffer keeps at most limit bytes written to it,
+// discarding the rest without failing the writer.
+type limitedBuffer struct {
+	buf         bytes.Buffer
+	limit       int
+	isTruncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		b.isTruncated = true
+		p = p[:max(room, 0)]
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+type cliSandboxContextKey struct{}
+
+// CLISandboxFromContext returns the sandbox of the CLIExtension
+// handling the request, or nil if it is not sandboxed.
+func CLISandboxFromContext(ctx context.Context) *CLISandbox {
+	s, _ := ctx.Value(cliSandboxContextKey{}).(*CLISandbox)
+	return s
+}
+
+func withCLISandbox(ctx context.Context, s *CLISandbox) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, cliSandboxContextKey{}, s)
+}
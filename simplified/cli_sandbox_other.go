@@ -0,0 +1,14 @@
+//go:build !linux
+
+package simplified
+
+import (
+	"os/exec"
+)
+
+// Namespaces are only supported on Linux.
+func isolateCommand(cmd *exec.Cmd, useNamespaces bool) {}
+
+func isNamespaceUnsupported(err error) bool {
+	return false
+}
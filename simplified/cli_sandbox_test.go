@@ -0,0 +1,222 @@
+package simplified
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/core"
+)
+
+func TestCLISandboxRun(t *testing.T) {
+	t.Setenv("LC_SANDBOX_TEST_SECRET", "leaked")
+	s := &CLISandbox{DisableNamespaces: true}
+
+	res, err := s.Run(context.Background(), SandboxCommand{
+		Path:               "/bin/sh",
+		Args:               []string{"-c", `echo "$HOME"; echo "$LC_SANDBOX_TEST_SECRET"; cat "$CREDS_FILE"; echo; cat "$1"; echo oops >&2; exit 3`, "sh", CredentialsFilePlaceholder},
+		Env:                map[string]string{"EXTRA": "1"},
+		Credentials:        "my-secret",
+		CredentialsFileEnv: "CREDS_FILE",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.ExitCode != 3 {
+		t.Errorf("expected exit code 3, got %d", res.ExitCode)
+	}
+	if string(res.Stderr) != "oops\n" {
+		t.Errorf("unexpected stderr: %q", res.Stderr)
+	}
+	lines := strings.Split(string(res.Stdout), "\n")
+	if len(lines) < 4 {
+		t.Fatalf("unexpected stdout: %q", res.Stdout)
+	}
+	if home := lines[0]; !strings.Contains(home, "lc-cli-") {
+		t.Errorf("expected a temporary home, got %s", home)
+	} else if _, err := os.Stat(home); !os.IsNotExist(err) {
+		t.Errorf("home %s should be removed", home)
+	}
+	if lines[1] != "" {
+		t.Errorf("environment should be scrubbed, got %q", lines[1])
+	}
+	if lines[2] != "my-secret" || lines[3] != "my-secret" {
+		t.Errorf("credentials should be readable through the file: %q", res.Stdout)
+	}
+}
+
+func TestCLISandboxOutputLimit(t *testing.T) {
+	s := &CLISandbox{MaxOutputSize: 10, DisableNamespaces: true}
+	res, err := s.Run(context.Background(), SandboxCommand{
+		Path: "/bin/sh",
+		Args: []string{"-c", "echo 0123456789abcdef"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(res.Stdout) != "0123456789" || !res.IsStdoutTruncated || res.IsStderrTruncated {
+		t.Errorf("unexpected output: %q", res.Stdout)
+	}
+}
+
+func TestCLISandboxLimits(t *testing.T) {
+	for _, disableNamespaces := range []bool{true, false} {
+		s := &CLISandbox{
+			Limits: SandboxLimits{
+				CPUSeconds:    30,
+				MemoryBytes:   1024 * 1024 * 1024,
+				FileSizeBytes: 1024 * 1024,
+				OpenFiles:     64,
+			},
+			DisableNamespaces: disableNamespaces,
+		}
+		res, err := s.Run(context.Background(), SandboxCommand{
+			Path: "/bin/sh",
+			Args: []string{"-c", "ulimit -t; ulimit -v; ulimit -f; ulimit -n"},
+		})
+		if errors.Is(err, errSandboxUnsupported) {
+			t.Skipf("namespaces are not supported: %v", err)
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.ExitCode != 0 {
+			t.Fatalf("expected the limits to be applied, got %d: %s", res.ExitCode, res.Stderr)
+		}
+		if limits := strings.Fields(string(res.Stdout)); strings.Join(limits, " ") != "30 1048576 2048 64" {
+			t.Errorf("unexpected limits with namespaces disabled %v: %q", disableNamespaces, limits)
+		}
+	}
+}
+
+func TestCLISandboxNamespaces(t *testing.T) {
+	s := &CLISandbox{}
+	probe := func() (SandboxResult, error) {
+		return s.Run(context.Background(), SandboxCommand{
+			Path:               "/bin/sh",
+			Args:               []string{"-c", `pwd; cat "$CREDS_FILE"; echo; ls -A "$(dirname "$HOME")" "$0" /dev/shm`, CredentialsFilePlaceholder},
+			Credentials:        "my-secret",
+			CredentialsFileEnv: "CREDS_FILE",
+		})
+	}
+	if res, err := probe(); err != nil || res.ExitCode != 0 {
+		t.Skipf("namespaces are not supported: %v %s", err, res.Stderr)
+	}
+
+	// Files of the other requests, like their homes and credentials.
+	other, err := os.MkdirTemp("", "lc-cli-")
+	if err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(other)
+	otherCreds, err := writeCredentialsFile(other, "other-secret")
+	if err != nil {
+		t.Fatalf("failed to write credentials: %v", err)
+	}
+	defer func() { _ = shredFile(otherCreds) }()
+	res, err := probe()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(res.Stdout)), "\n")
+	if len(lines) < 3 || !strings.Contains(lines[0], "lc-cli-") || lines[1] != "my-secret" {
+		t.Fatalf("unexpected output: %q %s", res.Stdout, res.Stderr)
+	}
+	if strings.Contains(string(res.Stdout), filepath.Base(other)) || strings.Contains(string(res.Stdout), filepath.Base(otherCreds)) {
+		t.Errorf("the command should not see the files of other requests: %q", res.Stdout)
+	}
+	if _, err := os.Stat(lines[0]); !os.IsNotExist(err) {
+		t.Errorf("home %s should be removed", lines[0])
+	}
+}
+
+func TestCLISandboxTimeout(t *testing.T) {
+	s := &CLISandbox{DisableNamespaces: true}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := s.Run(ctx, SandboxCommand{
+		Path: "/bin/sh",
+		Args: []string{"-c", "sleep 10 & sleep 10"},
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command should be killed, took %s", elapsed)
+	}
+}
+
+func TestDoRunSandboxed(t *testing.T) {
+	originalSendToWebhook := sendToWebhookAdapterFunc
+	originalStopThisInstance := stopThisInstanceFunc
+	defer func() {
+		sendToWebhookAdapterFunc = originalSendToWebhook
+		stopThisInstanceFunc = originalStopThisInstance
+	}()
+	sendToWebhookAdapterFunc = func(ext *core.Extension, o *limacharlie.Organization, hook limacharlie.Dict) error {
+		return nil
+	}
+	stopThisInstanceFunc = func(logger limacharlie.LCLogger, o *limacharlie.Organization, req *CLIRunRequest, errMsg string, killTimeout time.Duration) {
+		t.Errorf("sandboxed instances should not be stopped")
+	}
+
+	org, err := limacharlie.NewOrganizationFromClientOptions(dummyOpt, dummyLogger{})
+	if err != nil {
+		t.Fatalf("failed to create organization: %v", err)
+	}
+	sandbox := &CLISandbox{}
+	cliExt := &CLIExtension{
+		Name:   "test-extension",
+		Logger: dummyLogger{},
+		Descriptors: map[CLIName]CLIDescriptor{"dummy": {ProcessCommand: func(ctx context.Context, tokens []string, creds string) (CLIReturnData, error) {
+			if CLISandboxFromContext(ctx) != sandbox {
+				t.Errorf("expected the sandbox in the context")
+			}
+			return CLIReturnData{}, nil
+		}}},
+		Isolation: sandbox,
+		extension: dummyCoreExt,
+	}
+	if resp := cliExt.doRun(org, &CLIRunRequest{CommandTokens: []string{"cmd"}, Credentials: "creds"}, "ident", "inv", cliConfig{}); resp.Error != "" {
+		t.Errorf("unexpected error: %s", resp.Error)
+	}
+}
+
+func TestCLISandboxWithoutNamespaces(t *testing.T) {
+	originalStopThisInstance := stopThisInstanceFunc
+	defer func() {
+		stopThisInstanceFunc = originalStopThisInstance
+	}()
+	stopped := time.Duration(0)
+	stopThisInstanceFunc = func(logger limacharlie.LCLogger, o *limacharlie.Organization, req *CLIRunRequest, errMsg string, killTimeout time.Duration) {
+		stopped = killTimeout
+	}
+
+	if s := (&CLISandbox{}); !s.IsReusable() {
+		t.Errorf("sandboxes with namespaces should be reusable")
+	}
+
+	// Commands are not isolated from each other without namespaces,
+	// so the instance is terminated after each request.
+	s := &CLISandbox{DisableNamespaces: true, KillTimeout: time.Minute}
+	if s.IsReusable() {
+		t.Errorf("sandboxes without namespaces should not be reusable")
+	}
+	ctx, done, err := s.StartRequest(context.Background(), dummyLogger{}, nil, &CLIRunRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if CLISandboxFromContext(ctx) != s {
+		t.Errorf("expected the sandbox in the context")
+	}
+	done("")
+	if stopped != time.Minute {
+		t.Errorf("expected the instance to be stopped, got %s", stopped)
+	}
+}
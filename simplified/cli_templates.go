@@ -0,0 +1,309 @@
+package simplified
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/common"
+	"github.com/refractionPOINT/lc-extension/core"
+)
+
+// CLICommandTemplate is a named command of a tool, exposed as its own
+// request action taking the parameters of the command.
+type CLICommandTemplate struct {
+	Label       string
+	Description string
+	// Tokens of the command where "{{name}}" is replaced by the value of the
+	// parameter. Values are never split or interpreted by a shell, a list
+	// parameter making up a whole token is expanded to one token per item
+	// and is joined with commas otherwise. Tokens using a parameter which is
+	// not set are dropped, so optional flags are written like "--flag={{name}}".
+	Tokens []string
+	// Parameters of the command, only strings, integers, booleans and enums.
+	Parameters common.SchemaObject
+}
+
+var templatePlaceholderRE = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// Parameters of the template actions which are not parameters of the command.
+var templateReservedParameters = []string{"credentials", "async"}
+
+// validateTemplates checks that the templates of the tools only use their
+// parameters and that their actions do not collide with other actions.
+func (e *CLIExtension) validateTemplates(actions map[string]common.RequestSchema) error {
+	seen := map[string]struct{}{}
+	for name := range actions {
+		seen[name] = struct{}{}
+	}
+	for _, tool := range e.sortedTools() {
+		for name, t := range e.Descriptors[tool].Templates {
+			if _, ok := seen[name]; ok {
+				return fmt.Errorf("template %s of tool %s collides with another action", name, tool)
+			}
+			seen[name] = struct{}{}
+			if len(t.Tokens) == 0 {
+				return fmt.Errorf("template %s of tool %s has no tokens", name, tool)
+			}
+			for k, field := range t.Parameters.Fields {
+				if slices.Contains(templateReservedParameters, k) {
+					return fmt.Errorf("template %s of tool %s uses the reserved parameter %s", name, tool, k)
+				}
+				switch field.DataType {
+				case common.SchemaDataTypes.Object, common.SchemaDataTypes.Secret:
+					return fmt.Errorf("template %s of tool %s has an unsupported type for %s: %s", name, tool, k, field.DataType)
+				}
+			}
+			for _, token := range t.Tokens {
+				for _, m := range templatePlaceholderRE.FindAllStringSubmatch(token, -1) {
+					if _, ok := t.Parameters.Fields[m[1]]; !ok {
+						return fmt.Errorf("template %s of tool %s uses an unknown parameter: %s", name, tool, m[1])
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// templateRequestSchema returns the request schema of the action of a template.
+func templateRequestSchema(tool CLIName, descriptor CLIDescriptor, t CLICommandTemplate) common.RequestSchema {
+	params := common.SchemaObject{
+		Requirements: t.Parameters.Requirements,
+		Fields:       map[common.SchemaKey]common.SchemaElement{},
+	}
+	for k, field := range t.Parameters.Fields {
+		params.Fields[k] = field
+	}
+	params.Fields["credentials"] = credentialsField(tool, descriptor)
+	params.Fields["async"] = cliAsyncField
+	return common.RequestSchema{
+		IsUserFacing:         true,
+		Label:                t.Label,
+		ShortDescription:     t.Description,
+		LongDescription:      fmt.Sprintf("%s Runs the %s command: %s", t.Description, tool, strings.Join(t.Tokens, " ")),
+		ParameterDefinitions: params,
+		ResponseDefinition:   &cliRunResponseSchema,
+	}
+}
+
+// onTemplate returns the callback of the action of a template.
+func (e *CLIExtension) onTemplate(tool CLIName, name string, t CLICommandTemplate) func(ctx context.Context, params core.RequestCallbackParams) common.Response {
+	return func(ctx context.Context, params core.RequestCallbackParams) common.Response {
+		c, err := parseCLIConfig(params.Config)
+		if err != nil {
+			return common.Response{
+				Error:     fmt.Sprintf("invalid config: %v", err),
+				Retriable: Bool(false),
+			}
+		}
+		request, err := t.request(params.Request.(limacharlie.Dict))
+		if err != nil {
+			e.Logger.Info(fmt.Sprintf("invalid template request %s for %s: %v", name, params.Org.GetOID(), err))
+			return common.Response{
+				Error:     err.Error(),
+				Retriable: Bool(false),
+			}
+		}
+		request.Tool = tool
+		return e.doRun(params.Org, request, params.Ident, params.InvestigationID, c)
+	}
+}
+
+// request returns the run request of the command with the parameters.
+func (t CLICommandTemplate) request(data limacharlie.Dict) (*CLIRunRequest, error) {
+	request := &CLIRunRequest{}
+	values := limacharlie.Dict{}
+	for k, v := range data {
+		switch k {
+		case "credentials":
+			if s, ok := v.(string); ok {
+				request.Credentials = s
+			} else if v != nil {
+				b, err := json.Marshal(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid credentials: %v", err)
+				}
+				request.Credentials = string(b)
+			}
+		case "async":
+			request.IsAsync, _ = v.(bool)
+		default:
+			values[k] = v
+		}
+	}
+	if err := checkSchemaValues(&t.Parameters, values); err != nil {
+		return nil, fmt.Errorf("invalid parameters: %v", err)
+	}
+	tokens, err := t.expand(values)
+	if err != nil {
+		return nil, err
+	}
+	request.CommandTokens = tokens
+	return request, nil
+}
+
+// expand returns the tokens of the command with the values of the parameters.
+func (t CLICommandTemplate) expand(values limacharlie.Dict) ([]string, error) {
+	tokens := []string{}
+	for _, token := range t.Tokens {
+		// A parameter making up the whole token.
+		if m := templatePlaceholderRE.FindStringSubmatch(token); m != nil && m[0] == token {
+			items, err := templateValues(m[1], values[m[1]])
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range items {
+				// Do not let values be interpreted as flags.
+				if strings.HasPrefix(item, "-") {
+					return nil, fmt.Errorf("invalid value for %s: must not start with -", m[1])
+				}
+			}
+			tokens = append(tokens, items...)
+			continue
+		}
+
+		isMissing := false
+		var err error
+		expanded := templatePlaceholderRE.ReplaceAllStringFunc(token, func(placeholder string) string {
+			name := templatePlaceholderRE.FindStringSubmatch(placeholder)[1]
+			items, e := templateValues(name, values[name])
+			if e != nil {
+				err = e
+			}
+			if len(items) == 0 {
+				isMissing = true
+			}
+			return strings.Join(items, ",")
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !isMissing {
+			tokens = append(tokens, expanded)
+		}
+	}
+	return tokens, nil
+}
+
+// templateValues returns the value of a parameter as strings,
+// one per item for lists, and none if it is not set.
+func templateValues(name string, v interface{}) ([]string, error) {
+	items, ok := v.([]interface{})
+	if !ok {
+		if v == nil || v == "" {
+			return nil, nil
+		}
+		items = []interface{}{v}
+	}
+	values := []string{}
+	for _, item := range items {
+		var s string
+		switch t := item.(type) {
+		case string:
+			s = t
+		case bool:
+			s = strconv.FormatBool(t)
+		case float64:
+			s = strconv.FormatFloat(t, 'f', -1, 64)
+		case int, int64, uint64:
+			s = fmt.Sprint(t)
+		default:
+			return nil, fmt.Errorf("invalid value for %s", name)
+		}
+		if strings.ContainsAny(s, "\x00\n\r") {
+			return nil, fmt.Errorf("invalid value for %s: must be a single line", name)
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+// checkSchemaValues checks the values against the schema, where exactly one
+// of the fields of each of the Requirements must be set.
+func checkSchemaValues(schema *common.SchemaObject, values limacharlie.Dict) error {
+	for k, v := range values {
+		field, ok := schema.Fields[k]
+		if !ok {
+			return fmt.Errorf("unknown field %s", k)
+		}
+		items := []interface{}{v}
+		if field.IsList {
+			if items, ok = v.([]interface{}); !ok {
+				return fmt.Errorf("invalid value for %s: expected a list", k)
+			}
+		}
+		for _, item := range items {
+			if !isValidSchemaValue(field, item) {
+				return fmt.Errorf("invalid value for %s", k)
+			}
+		}
+	}
+	for _, required := range schema.Requirements {
+		set := []string{}
+		for _, k := range required {
+			if v, ok := values[k]; ok && v != nil && v != "" {
+				set = append(set, k)
+			}
+		}
+		if len(set) == 1 {
+			continue
+		}
+		if len(required) == 1 {
+			return fmt.Errorf("%s is required", required[0])
+		}
+		return fmt.Errorf("exactly one of %s must be set", strings.Join(required, ", "))
+	}
+	return nil
+}
+
+func isValidSchemaValue(field common.SchemaElement, v interface{}) bool {
+	switch field.DataType {
+	case common.SchemaDataTypes.Integer:
+		switch n := v.(type) {
+		case float64:
+			return n == float64(int64(n))
+		case int, int64, uint64:
+			return true
+		}
+		return false
+	case common.SchemaDataTypes.Boolean:
+		_, ok := v.(bool)
+		return ok
+	case common.SchemaDataTypes.Object:
+		_, ok := v.(map[string]interface{})
+		return ok
+	case common.SchemaDataTypes.Enum:
+		for _, e := range field.EnumValues {
+			if fmt.Sprint(e) == fmt.Sprint(v) {
+				return true
+			}
+		}
+		return false
+	}
+	s, ok := v.(string)
+	if !ok {
+		return false
+	}
+	if field.Filter.ValidRE != "" {
+		if isValid, err := regexp.MatchString(field.Filter.ValidRE, s); err != nil || !isValid {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedTools returns the names of the tools, sorted.
+func (e *CLIExtension) sortedTools() []CLIName {
+	tools := []CLIName{}
+	for tool := range e.Descriptors {
+		tools = append(tools, tool)
+	}
+	slices.Sort(tools)
+	return tools
+}
@@ -0,0 +1,218 @@
+package simplified
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/common"
+	"github.com/refractionPOINT/lc-extension/core"
+)
+
+var isolateInstanceTemplate = CLICommandTemplate{
+	Label:       "Isolate an instance",
+	Description: "Move an instance to the quarantine security group.",
+	Tokens:      []string{"ec2", "modify-instance-attribute", "--instance-id", "{{instance_id}}", "--groups", "{{groups}}", "--region={{region}}", "--dry-run={{dry_run}}"},
+	Parameters: common.SchemaObject{
+		Requirements: [][]common.SchemaKey{{"instance_id"}, {"groups"}},
+		Fields: map[common.SchemaKey]common.SchemaElement{
+			"instance_id": {DataType: common.SchemaDataTypes.String, Filter: common.Validator{ValidRE: `^i-[0-9a-f]+$`}},
+			"groups":      {DataType: common.SchemaDataTypes.String, IsList: true},
+			"region":      {DataType: common.SchemaDataTypes.Enum, EnumValues: []interface{}{"us-east-1", "eu-west-1"}},
+			"dry_run":     {DataType: common.SchemaDataTypes.Boolean},
+		},
+	},
+}
+
+func TestTemplateRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     limacharlie.Dict
+		expected []string
+		isError  bool
+	}{
+		{
+			name:     "all parameters",
+			data:     limacharlie.Dict{"instance_id": "i-0abc", "groups": []interface{}{"sg-1", "sg-2"}, "region": "us-east-1", "dry_run": true},
+			expected: []string{"ec2", "modify-instance-attribute", "--instance-id", "i-0abc", "--groups", "sg-1", "sg-2", "--region=us-east-1", "--dry-run=true"},
+		},
+		{
+			name:     "optional parameters omitted",
+			data:     limacharlie.Dict{"instance_id": "i-0abc", "groups": []interface{}{"sg-1"}},
+			expected: []string{"ec2", "modify-instance-attribute", "--instance-id", "i-0abc", "--groups", "sg-1"},
+		},
+		{
+			name:     "values are not split",
+			data:     limacharlie.Dict{"instance_id": "i-0abc", "groups": []interface{}{"sg-1; rm -rf /"}},
+			expected: []string{"ec2", "modify-instance-attribute", "--instance-id", "i-0abc", "--groups", "sg-1; rm -rf /"},
+		},
+		{
+			name:    "missing required parameter",
+			data:    limacharlie.Dict{"instance_id": "i-0abc"},
+			isError: true,
+		},
+		{
+			name:    "invalid pattern",
+			data:    limacharlie.Dict{"instance_id": "i-0abc --force", "groups": []interface{}{"sg-1"}},
+			isError: true,
+		},
+		{
+			name:    "flag injection",
+			data:    limacharlie.Dict{"instance_id": "i-0abc", "groups": []interface{}{"--endpoint-url=http://evil"}},
+			isError: true,
+		},
+		{
+			name:    "multiple lines",
+			data:    limacharlie.Dict{"instance_id": "i-0abc", "groups": []interface{}{"sg-1\nsg-2"}},
+			isError: true,
+		},
+		{
+			name:    "invalid enum",
+			data:    limacharlie.Dict{"instance_id": "i-0abc", "groups": []interface{}{"sg-1"}, "region": "moon-1"},
+			isError: true,
+		},
+		{
+			name:    "invalid type",
+			data:    limacharlie.Dict{"instance_id": "i-0abc", "groups": []interface{}{"sg-1"}, "dry_run": "yes"},
+			isError: true,
+		},
+		{
+			name:    "unknown parameter",
+			data:    limacharlie.Dict{"instance_id": "i-0abc", "groups": []interface{}{"sg-1"}, "force": true},
+			isError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := isolateInstanceTemplate.request(test.data)
+			if test.isError {
+				if err == nil {
+					t.Errorf("expected an error, got %v", request.CommandTokens)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(request.CommandTokens, test.expected) {
+				t.Errorf("unexpected tokens: %q", request.CommandTokens)
+			}
+		})
+	}
+
+	request, err := isolateInstanceTemplate.request(limacharlie.Dict{
+		"instance_id": "i-0abc",
+		"groups":      []interface{}{"sg-1"},
+		"credentials": map[string]interface{}{"region": "us-east-1"},
+		"async":       true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if request.Credentials != `{"region":"us-east-1"}` || !request.IsAsync {
+		t.Errorf("unexpected request: %+v", request)
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	newExtension := func(templates map[string]CLICommandTemplate) *CLIExtension {
+		return &CLIExtension{Descriptors: map[CLIName]CLIDescriptor{"aws": {Templates: templates}}}
+	}
+	actions := map[string]common.RequestSchema{"run": {}}
+
+	if err := newExtension(map[string]CLICommandTemplate{"isolate_instance": isolateInstanceTemplate}).validateTemplates(actions); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(actions) != 1 {
+		t.Errorf("the actions should not be modified")
+	}
+	for name, templates := range map[string]map[string]CLICommandTemplate{
+		"collision":          {"run": isolateInstanceTemplate},
+		"unknown parameter":  {"list": {Tokens: []string{"s3", "ls", "{{bucket}}"}}},
+		"reserved parameter": {"list": {Tokens: []string{"s3", "ls"}, Parameters: common.SchemaObject{Fields: map[common.SchemaKey]common.SchemaElement{"credentials": {DataType: common.SchemaDataTypes.String}}}}},
+		"no tokens":          {"list": {}},
+	} {
+		if err := newExtension(templates).validateTemplates(actions); err == nil {
+			t.Errorf("expected an error for %s", name)
+		}
+	}
+
+	schema := templateRequestSchema("aws", CLIDescriptor{}, isolateInstanceTemplate)
+	for _, k := range []string{"instance_id", "groups", "credentials", "async"} {
+		if _, ok := schema.ParameterDefinitions.Fields[k]; !ok {
+			t.Errorf("expected the %s parameter", k)
+		}
+	}
+	if _, ok := isolateInstanceTemplate.Parameters.Fields["credentials"]; ok {
+		t.Errorf("the parameters of the template should not be modified")
+	}
+}
+
+func TestOnTemplate(t *testing.T) {
+	originalSendToWebhook := sendToWebhookAdapterFunc
+	originalStopThisInstance := stopThisInstanceFunc
+	defer func() {
+		sendToWebhookAdapterFunc = originalSendToWebhook
+		stopThisInstanceFunc = originalStopThisInstance
+	}()
+	sendToWebhookAdapterFunc = func(ext *core.Extension, o *limacharlie.Organization, hook limacharlie.Dict) error {
+		return nil
+	}
+	stopThisInstanceFunc = func(logger limacharlie.LCLogger, o *limacharlie.Organization, req *CLIRunRequest, errMsg string, killTimeout time.Duration) {
+	}
+
+	org, err := limacharlie.NewOrganizationFromClientOptions(dummyOpt, dummyLogger{})
+	if err != nil {
+		t.Fatalf("failed to create organization: %v", err)
+	}
+	var received []string
+	cliExt := &CLIExtension{
+		Name:   "test-extension",
+		Logger: dummyLogger{},
+		Descriptors: map[CLIName]CLIDescriptor{"aws": {
+			ProcessCommand: func(ctx context.Context, tokens []string, creds string) (CLIReturnData, error) {
+				received = tokens
+				return CLIReturnData{}, nil
+			},
+			Policy:    CLIPolicy{DeniedCommands: []string{"ec2 terminate-*"}},
+			Templates: map[string]CLICommandTemplate{"isolate_instance": isolateInstanceTemplate},
+		}},
+		extension: dummyCoreExt,
+	}
+	callback := cliExt.onTemplate("aws", "isolate_instance", isolateInstanceTemplate)
+
+	resp := callback(context.Background(), core.RequestCallbackParams{
+		Org:     org,
+		Request: limacharlie.Dict{"instance_id": "i-0abc", "groups": []interface{}{"sg-1"}, "credentials": "creds"},
+		Config:  limacharlie.Dict{},
+	})
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if len(received) != 6 || received[3] != "i-0abc" {
+		t.Errorf("unexpected tokens: %q", received)
+	}
+
+	resp = callback(context.Background(), core.RequestCallbackParams{
+		Org:     org,
+		Request: limacharlie.Dict{"instance_id": "not-an-instance", "groups": []interface{}{"sg-1"}, "credentials": "creds"},
+		Config:  limacharlie.Dict{},
+	})
+	if resp.Error == "" || resp.Retriable == nil || *resp.Retriable {
+		t.Errorf("expected a non-retriable error: %+v", resp)
+	}
+
+	// The policies still apply to the expanded commands.
+	terminate := CLICommandTemplate{Tokens: []string{"ec2", "terminate-instances"}}
+	resp = cliExt.onTemplate("aws", "terminate", terminate)(context.Background(), core.RequestCallbackParams{
+		Org:     org,
+		Request: limacharlie.Dict{"credentials": "creds"},
+		Config:  limacharlie.Dict{},
+	})
+	if resp.Error == "" {
+		t.Errorf("expected the policy to deny the command")
+	}
+}
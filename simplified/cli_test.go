@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/refractionPOINT/go-limacharlie/limacharlie"
 	"github.com/refractionPOINT/lc-extension/core"
@@ -81,7 +82,7 @@ func TestDoRun_ErrorHandling(t *testing.T) {
 		sendToWebhookCalled = true
 		return nil
 	}
-	stopThisInstanceFunc = func(logger limacharlie.LCLogger, o *limacharlie.Organization, req *CLIRunRequest, errMsg string) {
+	stopThisInstanceFunc = func(logger limacharlie.LCLogger, o *limacharlie.Organization, req *CLIRunRequest, errMsg string, killTimeout time.Duration) {
 		if o.GetOID() != dummyOpt.OID {
 			t.Errorf("expected OID %s, got %s", dummyOpt.OID, o.GetOID())
 		}
@@ -143,7 +144,7 @@ func TestDoRun_ErrorHandling(t *testing.T) {
 			Credentials:   "creds",
 			Tool:          "dummy",
 		}
-		resp := cliExt.doRun(org, req, "ident", "inv")
+		resp := cliExt.doRun(org, req, "ident", "inv", cliConfig{})
 		if !strings.Contains(resp.Error, "failed to parse command line") {
 			t.Errorf("expected parse error, got: %s", resp.Error)
 		}
@@ -161,7 +162,7 @@ func TestDoRun_ErrorHandling(t *testing.T) {
 			Credentials:   "creds",
 			Tool:          "dummy",
 		}
-		resp := cliExt.doRun(org, req, "ident", "inv")
+		resp := cliExt.doRun(org, req, "ident", "inv", cliConfig{})
 		expected := fmt.Sprintf("command line is too long, max size is %d bytes", commandArgumentsMaxSize)
 		if resp.Error != expected {
 			t.Errorf("expected error: %s, got: %s", expected, resp.Error)
@@ -180,7 +181,7 @@ func TestDoRun_ErrorHandling(t *testing.T) {
 			Credentials:   "creds",
 			Tool:          "dummy",
 		}
-		resp := cliExt.doRun(org, req, "ident", "inv")
+		resp := cliExt.doRun(org, req, "ident", "inv", cliConfig{})
 		expected := fmt.Sprintf("command arguments are too long, max count is %d", commandArgumentsMaxCount)
 		if resp.Error != expected {
 			t.Errorf("expected error: %s, got: %s", expected, resp.Error)
@@ -209,7 +210,7 @@ func TestDoRun_ErrorHandling(t *testing.T) {
 			Credentials:   "creds",
 			Tool:          "nonexistent",
 		}
-		resp := cliExtMulti.doRun(org, req, "ident", "inv")
+		resp := cliExtMulti.doRun(org, req, "ident", "inv", cliConfig{})
 		expected := "unknown tool: nonexistent"
 		if resp.Error != expected {
 			t.Errorf("expected error: %s, got: %s", expected, resp.Error)
@@ -228,7 +229,7 @@ func TestDoRun_ErrorHandling(t *testing.T) {
 			Credentials:   "creds",
 			Tool:          "dummy",
 		}
-		resp := cliExt.doRun(org, req, "ident", "inv")
+		resp := cliExt.doRun(org, req, "ident", "inv", cliConfig{})
 		// Expect error message to include DeadlineExceeded.
 		if !strings.Contains(resp.Error, "context deadline exceeded") {
 			t.Errorf("expected DeadlineExceeded error, got: %s", resp.Error)
@@ -247,7 +248,7 @@ func TestDoRun_ErrorHandling(t *testing.T) {
 			Credentials:   "creds",
 			Tool:          "dummy",
 		}
-		resp := cliExt.doRun(org, req, "ident", "inv")
+		resp := cliExt.doRun(org, req, "ident", "inv", cliConfig{})
 		// Expect error message to include "canceled" (case-insensitive check).
 		if !strings.Contains(strings.ToLower(resp.Error), "canceled") {
 			t.Errorf("expected canceled error, got: %s", resp.Error)
@@ -266,7 +267,7 @@ func TestDoRun_ErrorHandling(t *testing.T) {
 			Credentials:   "creds",
 			Tool:          "dummy",
 		}
-		resp := cliExt.doRun(org, req, "ident", "inv")
+		resp := cliExt.doRun(org, req, "ident", "inv", cliConfig{})
 		if resp.Error != "generic error" {
 			t.Errorf("expected generic error, got: %s", resp.Error)
 		}
@@ -294,7 +295,7 @@ func TestDoRun_ErrorHandling(t *testing.T) {
 			Tool:          "dummy",
 		}
 
-		resp := cliExt.doRun(org, req, "ident", "inv")
+		resp := cliExt.doRun(org, req, "ident", "inv", cliConfig{})
 
 		// Expect the error message to be "temporary error"
 		if resp.Error != "temporary error" {
@@ -307,6 +308,25 @@ func TestDoRun_ErrorHandling(t *testing.T) {
 		}
 	})
 
+	// Test case: command not allowed by the policy of the org.
+	t.Run("command not allowed", func(t *testing.T) {
+		cliExt.Descriptors["dummy"] = CLIDescriptor{ProcessCommand: dummyHandlerSuccess, CredentialsFormat: "", ExampleCommand: "cmd"}
+		req := &CLIRunRequest{
+			CommandLine:   "cmd delete",
+			CommandTokens: []string{"cmd", "delete"},
+			Credentials:   "creds",
+			Tool:          "dummy",
+		}
+		config := cliConfig{Policies: []cliToolPolicy{{CLIPolicy: CLIPolicy{DeniedCommands: []string{"cmd delete"}}}}}
+		resp := cliExt.doRun(org, req, "ident", "inv", config)
+		if resp.Error != "cmd delete command not allowed" {
+			t.Errorf("expected command not allowed error, got: %s", resp.Error)
+		}
+		if resp.Retriable == nil || *resp.Retriable {
+			t.Errorf("expected retriable to be false")
+		}
+	})
+
 	// Test case: successful ProcessCommand execution.
 	t.Run("ProcessCommand success", func(t *testing.T) {
 		cliExt.Descriptors["dummy"] = CLIDescriptor{ProcessCommand: dummyHandlerSuccess, CredentialsFormat: "", ExampleCommand: "cmd"}
@@ -316,7 +336,7 @@ func TestDoRun_ErrorHandling(t *testing.T) {
 			Credentials:   "creds",
 			Tool:          "dummy",
 		}
-		resp := cliExt.doRun(org, req, "ident", "inv")
+		resp := cliExt.doRun(org, req, "ident", "inv", cliConfig{})
 		if resp.Error != "" {
 			t.Errorf("expected no error, got: %s", resp.Error)
 		}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -31,17 +32,25 @@ type RuleExtension struct {
 	Logger    limacharlie.LCLogger
 
 	GetRules      GetRulesCallback
+	GetRulePack   GetRulePackCallback                     // Optional, used instead of GetRules to support versions.
+	RolloutPolicy *RolloutPolicy                          // Optional
+	Schedule      SyncSchedule                            // Optional, defaults to every 12h, can be overridden per Org in the config.
 	EventHandlers map[common.EventName]core.EventCallback // Optional
 
-	tag      string
-	ruleName string
+	tag       string
+	ruleName  string
+	extension *core.Extension
 }
 
-type ruleUpdateRequest struct{}
+type ruleUpdateRequest struct {
+	DryRun bool `json:"dry_run"`
+}
 
-type ruleConfig struct {
-	DisableByDefault      bool   `json:"disable_by_default"`
-	GlobalSuppressionTime string `json:"global_suppression_time"`
+var ruleDryRunField = common.SchemaElement{
+	DataType:     common.SchemaDataTypes.Boolean,
+	Description:  "only report the planned changes without applying them",
+	DefaultValue: false,
+	Label:        "Dry run",
 }
 
 var simplifiedRuleNamespaces = map[string]struct{}{
@@ -55,6 +64,14 @@ var isDebugLogRules = os.Getenv("DEBUG_LOG_RULES") != ""
 func (l *RuleExtension) Init() (*core.Extension, error) {
 	l.tag = fmt.Sprintf("ext:%s", l.Name)
 	l.ruleName = fmt.Sprintf("ext-%s-update", l.Name)
+	if err := validateSyncSchedule(l.Schedule); err != nil {
+		return nil, err
+	}
+	if l.RolloutPolicy != nil {
+		if err := l.RolloutPolicy.validate(); err != nil {
+			return nil, err
+		}
+	}
 
 	x := &core.Extension{
 		ExtensionName: l.Name,
@@ -65,32 +82,76 @@ func (l *RuleExtension) Init() (*core.Extension, error) {
 			common.EventTypes.Update,
 		},
 		// The schema defining what the configuration for this Extension should look like.
-		ConfigSchema: common.SchemaObject{
-			Fields: map[common.SchemaKey]common.SchemaElement{
-				"disable_by_default": {
-					DataType:     common.SchemaDataTypes.Boolean,
-					Description:  "disable new rules by default after the initial subscription",
-					DefaultValue: false,
-					Label:        "Disable new rules by default",
-				},
-				"global_suppression_time": {
-					DataType:     common.SchemaDataTypes.String,
-					Description:  "global suppression period for all detections for rules created by this extension like \"30m\" or \"1h\", with a max of \"24h\".",
-					DefaultValue: "",
-					Label:        "Global suppression time",
-					PlaceHolder:  "24h",
-				},
-			},
-			Requirements: [][]common.SchemaKey{},
-		},
+		ConfigSchema: ruleConfigSchema(),
+		ViewsSchema:  syncStatusViews,
 		// The schema defining what requests to this Extension should look like.
 		RequestSchema: map[string]common.RequestSchema{
 			"update_rules": {
-				IsUserFacing:         false,
-				ShortDescription:     "update the rules",
+				IsUserFacing:     false,
+				ShortDescription: "update the rules",
+				LongDescription:  "update the rules, or with dry_run only report the rules that would be added, updated and deleted per namespace",
+				IsImpersonated:   false,
+				ParameterDefinitions: common.SchemaObject{
+					Fields: map[common.SchemaKey]common.SchemaElement{
+						"dry_run": ruleDryRunField,
+					},
+				},
+				ResponseDefinition: &ruleUpdatePlanSchema,
+			},
+			"sync_now": {
+				IsUserFacing:     true,
+				Label:            "Sync now",
+				ShortDescription: "update the rules now",
+				LongDescription:  "update the rules right away instead of waiting for the next scheduled update, or with dry_run only report the planned changes",
+				IsImpersonated:   false,
+				ParameterDefinitions: common.SchemaObject{
+					Fields: map[common.SchemaKey]common.SchemaElement{
+						"dry_run": ruleDryRunField,
+					},
+				},
+				ResponseDefinition: &ruleUpdatePlanSchema,
+			},
+			"get_status": {
+				IsDefaultRequest:     true,
+				IsUserFacing:         true,
+				Label:                "Get status",
+				ShortDescription:     "get the version of the rules applied and the sync status",
+				LongDescription:      "get the version and content hash of the rules applied to the organization along with the history of previously applied versions and the outcome of the last update",
 				IsImpersonated:       false,
 				ParameterDefinitions: common.SchemaObject{},
-				ResponseDefinition:   &common.SchemaObject{},
+				ResponseDefinition: &common.SchemaObject{
+					Fields: map[common.SchemaKey]common.SchemaElement{
+						"rule_pack": {
+							DataType:    common.SchemaDataTypes.Object,
+							Description: "the version and content hash of the rules applied, when they were applied and the previously applied versions",
+							Label:       "Rules applied",
+						},
+						"pinned_version": {
+							DataType:    common.SchemaDataTypes.String,
+							Description: "the version the rules are pinned to in the config",
+							Label:       "Pinned version",
+						},
+						"sync": syncStatusSchema,
+					},
+				},
+			},
+			"rollback": {
+				IsUserFacing:     true,
+				Label:            "Roll back the rules",
+				ShortDescription: "roll back the rules to a previous version",
+				LongDescription:  "roll back the rules to a previous version and hold them at that version until rolling back to \"latest\"",
+				IsImpersonated:   false,
+				ParameterDefinitions: common.SchemaObject{
+					Fields: map[common.SchemaKey]common.SchemaElement{
+						"version": {
+							DataType:    common.SchemaDataTypes.String,
+							Description: "the version to roll back to, defaults to the previously applied version, use \"latest\" to resume getting the latest rules",
+							Label:       "Version",
+						},
+						"dry_run": ruleDryRunField,
+					},
+				},
+				ResponseDefinition: &ruleUpdatePlanSchema,
 			},
 		},
 	}
@@ -101,17 +162,11 @@ func (l *RuleExtension) Init() (*core.Extension, error) {
 			if err := config.UnMarshalToStruct(&c); err != nil {
 				return common.Response{Error: err.Error()}
 			}
-			if c.GlobalSuppressionTime != "" {
-				d, err := time.ParseDuration(c.GlobalSuppressionTime)
-				if err != nil {
-					return common.Response{Error: fmt.Sprintf("invalid global suppression time: %s", err.Error())}
-				}
-				if d > 24*time.Hour {
-					return common.Response{Error: "global suppression time cannot be more than 24h"}
-				}
-				if d < 1*time.Second {
-					return common.Response{Error: "global suppression time cannot be less than 1s"}
-				}
+			if err := c.validate(); err != nil {
+				return common.Response{Error: err.Error()}
+			}
+			if c.PinnedVersion != "" && l.GetRulePack == nil {
+				return common.Response{Error: "cannot pin a version, the rules are not versioned"}
 			}
 			return common.Response{}
 		},
@@ -120,6 +175,18 @@ func (l *RuleExtension) Init() (*core.Extension, error) {
 				RequestStruct: &ruleUpdateRequest{},
 				Callback:      l.onUpdate,
 			},
+			"sync_now": {
+				RequestStruct: &ruleUpdateRequest{},
+				Callback:      l.onUpdate,
+			},
+			"get_status": {
+				RequestStruct: &ruleStatusRequest{},
+				Callback:      l.onGetStatus,
+			},
+			"rollback": {
+				RequestStruct: &ruleRollbackRequest{},
+				Callback:      l.onRollback,
+			},
 		},
 		EventHandlers: map[common.EventName]core.EventCallback{
 			common.EventTypes.Subscribe: func(ctx context.Context, params core.EventCallbackParams) common.Response {
@@ -127,29 +194,7 @@ func (l *RuleExtension) Init() (*core.Extension, error) {
 				l.Logger.Info(fmt.Sprintf("subscribe to %s", org.GetOID()))
 
 				// We set up a D&R rule for recurring update.
-				h := limacharlie.NewHiveClient(org)
-				trueValue := true
-				if _, err := h.Add(limacharlie.HiveArgs{
-					HiveName:     updateRuleHive,
-					PartitionKey: org.GetOID(),
-					Key:          l.ruleName,
-					Data: limacharlie.Dict{
-						"detect": limacharlie.Dict{
-							"target": "schedule",
-							"event":  "12h_per_org",
-							"op":     "exists",
-							"path":   "event",
-						},
-						"respond": []limacharlie.Dict{{
-							"action":            "extension request",
-							"extension name":    l.Name,
-							"extension action":  "update_rules",
-							"extension request": limacharlie.Dict{},
-						}},
-					},
-					Tags:    []string{l.tag},
-					Enabled: &trueValue,
-				}); err != nil {
+				if err := l.setScheduleRule(org, params.Conf); err != nil {
 					l.Logger.Error(fmt.Sprintf("failed to add scheduling D&R rule: %s", err.Error()))
 					return common.Response{Error: err.Error()}
 				}
@@ -173,15 +218,12 @@ func (l *RuleExtension) Init() (*core.Extension, error) {
 				l.Logger.Info(fmt.Sprintf("unsubscribe from %s", org.GetOID()))
 
 				// Remove the D&R rule we set up.
-				h := limacharlie.NewHiveClient(org)
-				if _, err := h.Remove(limacharlie.HiveArgs{
-					HiveName:     updateRuleHive,
-					PartitionKey: org.GetOID(),
-					Key:          l.ruleName,
-				}); err != nil && !strings.Contains(err.Error(), "RECORD_NOT_FOUND") {
+				if err := removeScheduleRule(org, l.ruleName); err != nil {
 					l.Logger.Error(fmt.Sprintf("failed to remove scheduling D&R rule: %s", err.Error()))
 				}
 
+				h := limacharlie.NewHiveClient(org)
+
 				// For every namespace, remove rules with matching tags.
 				batchUpdate := h.NewBatchOperations()
 				for namespace := range simplifiedRuleNamespaces {
@@ -221,9 +263,14 @@ func (l *RuleExtension) Init() (*core.Extension, error) {
 				if err != nil {
 					l.Logger.Error(fmt.Sprintf("failed to remove rules: %s", err.Error()))
 				}
+				for _, recordName := range l.stateRecordNames() {
+					if err := deleteState(org, recordName); err != nil {
+						l.Logger.Error(fmt.Sprintf("failed to remove rules state: %s", err.Error()))
+					}
+				}
 				for _, op := range ops {
 					if op.Error != "" && !strings.Contains(op.Error, "RECORD_NOT_FOUND") {
-						l.Logger.Error(fmt.Sprintf("failed to remove rule: %s", err.Error()))
+						l.Logger.Error(fmt.Sprintf("failed to remove rule: %s", op.Error))
 					}
 				}
 
@@ -236,6 +283,12 @@ func (l *RuleExtension) Init() (*core.Extension, error) {
 				return common.Response{}
 			},
 			common.EventTypes.Update: func(ctx context.Context, params core.EventCallbackParams) common.Response {
+				// The sync schedule may have changed in the config.
+				if err := l.setScheduleRule(params.Org, params.Conf); err != nil {
+					l.Logger.Error(fmt.Sprintf("failed to update scheduling D&R rule: %s", err.Error()))
+					return common.Response{Error: err.Error()}
+				}
+
 				if h, ok := l.EventHandlers[common.EventTypes.Update]; ok {
 					if resp := h(ctx, params); resp.Error != "" {
 						return resp
@@ -248,6 +301,8 @@ func (l *RuleExtension) Init() (*core.Extension, error) {
 			l.Logger.Error(fmt.Sprintf("error from limacharlie: %s", errMsg.Error))
 		},
 	}
+	l.extension = x
+
 	// Start processing.
 	if err := x.Init(); err != nil {
 		panic(err)
@@ -256,101 +311,235 @@ func (l *RuleExtension) Init() (*core.Extension, error) {
 	return x, nil
 }
 
+func (l *RuleExtension) setScheduleRule(org *limacharlie.Organization, config limacharlie.Dict) error {
+	c := ruleConfig{}
+	if err := config.UnMarshalToStruct(&c); err != nil {
+		return err
+	}
+	return setScheduleRule(org, l.ruleName, l.tag, l.Name, "update_rules", resolveSyncSchedule(l.Schedule, c.SyncSchedule))
+}
+
 func (l *RuleExtension) onUpdate(ctx context.Context, params core.RequestCallbackParams) common.Response {
-	h := limacharlie.NewHiveClient(params.Org)
+	request := params.Request.(*ruleUpdateRequest)
 
 	config := ruleConfig{}
 	if err := params.Config.UnMarshalToStruct(&config); err != nil {
 		return common.Response{Error: err.Error()}
 	}
 
-	rulesData, err := l.GetRules(ctx)
+	state, err := l.loadRulePackState(params.Org)
+	if err != nil {
+		return common.Response{Error: err.Error()}
+	}
+
+	plan, err := l.planUpdate(ctx, params.Org, config, state, l.targetVersion(config, state))
 	if err != nil {
+		if !request.DryRun {
+			l.recordSyncStatus(params.Org, nil, []string{err.Error()})
+		}
 		return common.Response{Error: err.Error()}
 	}
 
-	suppTime := l.shimSuppressionTime(config.GlobalSuppressionTime)
+	// In dry-run mode we only report what would change.
+	if request.DryRun {
+		return common.Response{Data: plan}
+	}
 
-	// Apply the suppression time to all rules.
-	batchUpdate := h.NewBatchOperations()
+	opErrors, err := l.applyPlan(ctx, params.Org, plan)
+	if err != nil {
+		l.recordSyncStatus(params.Org, nil, []string{err.Error()})
+		return common.Response{Error: err.Error()}
+	}
+	if err := l.recordApplied(params.Org, state, plan); err != nil {
+		l.Logger.Error(fmt.Sprintf("failed to record rules state: %s", err.Error()))
+	}
+	l.recordSyncStatus(params.Org, plan, opErrors)
+
+	l.Logger.Info("done updating rules")
+
+	return common.Response{Data: plan}
+}
+
+// PlanUpdate computes the changes an update of the rules would make
+// to the Org given its config, without writing anything to Hive.
+func (l *RuleExtension) PlanUpdate(ctx context.Context, org *limacharlie.Organization, config limacharlie.Dict) (*RuleUpdatePlan, error) {
+	c := ruleConfig{}
+	if err := config.UnMarshalToStruct(&c); err != nil {
+		return nil, err
+	}
+	state, err := l.loadRulePackState(org)
+	if err != nil {
+		return nil, err
+	}
+	return l.planUpdate(ctx, org, c, state, l.targetVersion(c, state))
+}
+
+func (l *RuleExtension) planUpdate(ctx context.Context, org *limacharlie.Organization, config ruleConfig, state RulePackState, version RulePackVersion) (*RuleUpdatePlan, error) {
+	h := limacharlie.NewHiveClient(org)
+
+	pack, err := l.getRulePack(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	rulesData := pack.Rules
+
+	plan := newRuleUpdatePlan()
+	plan.Version = pack.Version
+	plan.ContentHash = hashRuleData(rulesData)
+
+	// The staged rollout only applies to the latest rules,
+	// pinned versions and rollbacks are deployed right away.
+	rollout := l.RolloutPolicy
+	if version != "" {
+		rollout = nil
+	}
+	isInitialRollout := state.Rollout == nil
+	plan.baselines = map[string]ruleBaseline{}
+	for k, base := range state.Baselines {
+		plan.baselines[k] = base
+	}
+	if rollout != nil {
+		plan.rollout = map[string]ruleRolloutEntry{}
+		plan.rolloutUpdates = map[string]ruleRolloutUpdate{}
+		for k, entry := range state.Rollout {
+			plan.rollout[k] = entry
+		}
+	}
+	now := time.Now()
 	for namespace, rules := range rulesData {
+		if _, ok := simplifiedRuleNamespaces[namespace]; !ok {
+			// We can't manage rules outside of these namespaces.
+			nsPlan := plan.namespace(namespace)
+			for ruleName, ruleData := range rules {
+				nsPlan.Invalid = append(nsPlan.Invalid, RuleChange{
+					Name:   ruleName,
+					Errors: ValidateRule(namespace, ruleData),
+				})
+			}
+			continue
+		}
+
+		// Excluded namespaces get no rules, which also
+		// removes the ones we may have created before.
+		if config.isNamespaceExcluded(namespace) {
+			rules = map[RuleName]RuleInfo{}
+		}
+
 		// Fetch all the rules in Hive for the given namespace.
 		hiveName := fmt.Sprintf("dr-%s", namespace)
 		existing, err := h.List(limacharlie.HiveArgs{
 			HiveName:     hiveName,
-			PartitionKey: params.Org.GetOID(),
+			PartitionKey: org.GetOID(),
 		})
 		if err != nil {
 			l.Logger.Error(fmt.Sprintf("failed to list rules: %s", err.Error()))
 			continue
 		}
+		nsPlan := plan.namespace(namespace)
 
 		// Diff the rule contents with the rules in Hive.
 		for ruleName, ruleData := range rules {
-			// Add in our suppression.
-			ruleToSet := ruleData.Data
-			if suppTime != "" {
-				ruleToSet = limacharlie.Dict{}
-				if _, err := ruleToSet.ImportFromStruct(ruleData.Data); err != nil {
+			// Invalid rules are skipped, leaving the
+			// version currently in Hive, if any, in place.
+			problems, warnings := lintRule(namespace, ruleData)
+			if len(problems) != 0 {
+				nsPlan.Invalid = append(nsPlan.Invalid, RuleChange{
+					Name:   ruleName,
+					Errors: problems,
+				})
+				continue
+			}
+
+			var existingRule *limacharlie.HiveData
+			if r, ok := existing[ruleName]; ok {
+				existingRule = &r
+			}
+
+			stage, wasStaged := rolloutStages.Live, false
+			if rollout != nil {
+				if stage, wasStaged, err = rollout.ruleStage(ctx, org, namespace, ruleName, ruleData, plan.rollout, plan.rolloutUpdates, isInitialRollout, now); err != nil {
+					l.Logger.Error(fmt.Sprintf("failed to check rollout of rule %s: %s", ruleName, err.Error()))
+				}
+			}
+
+			ruleToSet := l.prepareRule(namespace, ruleName, ruleData, config)
+			if stage == rolloutStages.Held {
+				// The rule stays as it is until it is promoted.
+				if existingRule == nil || !areEqual(ruleToSet, existingRule.Data) {
+					nsPlan.Held = append(nsPlan.Held, RuleChange{
+						Name: ruleName,
+						Diff: diffRules(existingRuleData(existingRule), ruleToSet),
+					})
+				}
+				continue
+			}
+			if stage == rolloutStages.Staged && rollout.Mode == RolloutModes.Test {
+				testRule := limacharlie.Dict{}
+				if _, err := testRule.ImportFromStruct(ruleToSet); err != nil {
 					l.Logger.Error(fmt.Sprintf("failed to duplicate data: %s", err.Error()))
-					ruleToSet = ruleData.Data
 				} else {
-					if ruleToSet = addSuppression(ruleToSet, suppTime); ruleToSet == nil {
-						ruleToSet = ruleData.Data
-					}
+					ruleToSet = toTestRule(testRule, rollout.testReportPrefix())
 				}
 			}
+			var base *ruleBaseline
+			if b, ok := plan.baselines[ruleKey(namespace, ruleName)]; ok {
+				base = &b
+			}
+			if stage == rolloutStages.Live && wasStaged && rollout.Mode == RolloutModes.Disabled && existingRule != nil && base != nil {
+				// The rule was disabled while staged, so its current
+				// state is not one set by a user.
+				existingRule.UsrMtd.Enabled = base.Enabled
+			}
+
+			state := l.resolveRuleState(ruleName, ruleData, config, existingRule, base)
+			plan.baselines[ruleKey(namespace, ruleName)] = state.baseline
+			if stage == rolloutStages.Staged && rollout.Mode == RolloutModes.Disabled {
+				state.enabled = false
+			}
+
+			mutation := limacharlie.ConfigRecordMutation{
+				Data: ruleToSet,
+				UsrMtd: &limacharlie.UsrMtd{
+					Enabled: state.enabled,
+					Tags:    state.tags,
+				},
+			}
+			change := RuleChange{
+				Name:      ruleName,
+				Enabled:   &state.enabled,
+				Tags:      state.tags,
+				Conflicts: state.conflicts,
+				Warnings:  warnings,
+				IsStaged:  stage == rolloutStages.Staged,
+				mutation:  mutation,
+			}
 
 			// Do we have that rule name in hive already?
 			// If not, we'll add it.
 			// If we do, diff it and update it if needed.
-			if existingRule, ok := existing[ruleName]; !ok {
-				batchUpdate.SetRecord(limacharlie.RecordID{
-					Hive: limacharlie.HiveID{
-						Name:      limacharlie.HiveName(hiveName),
-						Partition: limacharlie.PartitionID(params.Org.GetOID()),
-					},
-					Name: limacharlie.RecordName(ruleName),
-				}, limacharlie.ConfigRecordMutation{
-					Data: ruleToSet,
-					UsrMtd: &limacharlie.UsrMtd{
-						Enabled: !config.DisableByDefault,
-						Tags:    l.mergeTags(ruleData.Tags, []string{}),
-					},
-				})
-				if isDebugLogRules {
-					l.Logger.Info(fmt.Sprintf("adding rule %s: %s", ruleName, ruleToSet))
-				}
-			} else if !areEqual(ruleToSet, existingRule.Data) {
+			if existingRule == nil {
+				change.Diff = diffRules(nil, ruleToSet)
+				nsPlan.Adds = append(nsPlan.Adds, change)
+			} else if !areEqual(ruleToSet, existingRule.Data) || state.enabled != existingRule.UsrMtd.Enabled || !areTagsEqual(state.tags, existingRule.UsrMtd.Tags) {
 				// The rule is there but has changed.
-				if isDebugLogRules {
-					l.Logger.Info(fmt.Sprintf("updating rule %s: %s", ruleName, ruleToSet))
-				}
-				batchUpdate.SetRecord(limacharlie.RecordID{
-					Hive: limacharlie.HiveID{
-						Name:      limacharlie.HiveName(hiveName),
-						Partition: limacharlie.PartitionID(params.Org.GetOID()),
-					},
-					Name: limacharlie.RecordName(ruleName),
-				}, limacharlie.ConfigRecordMutation{
-					Data: ruleToSet,
-					UsrMtd: &limacharlie.UsrMtd{
-						Enabled: !config.DisableByDefault,
-						Tags:    l.mergeTags(ruleData.Tags, []string{}),
-					},
-				})
+				change.Diff = diffRules(existingRule.Data, ruleToSet)
+				nsPlan.Updates = append(nsPlan.Updates, change)
 			}
 		}
 
 		// Now check for rules that exist in Hive but not in our list.
-		for ruleName := range existing {
+		for ruleName, existingRule := range existing {
 			if _, ok := rules[ruleName]; ok {
 				continue
 			}
+			// Never delete the D&R rule scheduling our updates.
+			if hiveName == updateRuleHive && ruleName == l.ruleName {
+				continue
+			}
 			// Only delete rules with our tag, this avoids
 			// mistakes where the extension is not Segmented.
 			isRemove := false
-			for _, t := range existing[ruleName].UsrMtd.Tags {
+			for _, t := range existingRule.UsrMtd.Tags {
 				if t == l.tag {
 					isRemove = true
 					break
@@ -359,31 +548,132 @@ func (l *RuleExtension) onUpdate(ctx context.Context, params core.RequestCallbac
 			if !isRemove {
 				continue
 			}
-			batchUpdate.DelRecord(limacharlie.RecordID{
-				Hive: limacharlie.HiveID{
-					Name:      limacharlie.HiveName(hiveName),
-					Partition: limacharlie.PartitionID(params.Org.GetOID()),
-				},
-				Name: limacharlie.RecordName(ruleName),
+			nsPlan.Deletes = append(nsPlan.Deletes, RuleChange{
+				Name: ruleName,
+				Diff: diffRules(existingRule.Data, nil),
 			})
 		}
 	}
+	// Forget the rollout and baseline of rules we no longer have.
+	for k := range plan.rollout {
+		if !isRuleKept(rulesData, config, k) {
+			delete(plan.rollout, k)
+		}
+	}
+	for k := range plan.baselines {
+		if !isRuleKept(rulesData, config, k) {
+			delete(plan.baselines, k)
+		}
+	}
+	plan.sort()
+
+	return plan, nil
+}
+
+// applyPlan writes the changes of a plan to Hive and records the
+// rollout of the rules, returning the errors of the individual
+// changes that failed.
+func (l *RuleExtension) applyPlan(ctx context.Context, org *limacharlie.Organization, plan *RuleUpdatePlan) ([]string, error) {
+	h := limacharlie.NewHiveClient(org)
+
+	batchUpdate := h.NewBatchOperations()
+	for namespace, nsPlan := range plan.Namespaces {
+		for _, c := range nsPlan.Adds {
+			if isDebugLogRules {
+				l.Logger.Info(fmt.Sprintf("adding rule %s: %s", c.Name, c.mutation.Data))
+			}
+			batchUpdate.SetRecord(ruleRecordID(org, namespace, c.Name), c.mutation)
+		}
+		for _, c := range nsPlan.Updates {
+			if isDebugLogRules {
+				l.Logger.Info(fmt.Sprintf("updating rule %s: %s", c.Name, c.mutation.Data))
+			}
+			batchUpdate.SetRecord(ruleRecordID(org, namespace, c.Name), c.mutation)
+		}
+		for _, c := range nsPlan.Deletes {
+			batchUpdate.DelRecord(ruleRecordID(org, namespace, c.Name))
+		}
+	}
 
 	// Apply the changes.
 	ops, err := batchUpdate.Execute()
 	if err != nil {
 		l.Logger.Error(fmt.Sprintf("failed to update rules: %s", err.Error()))
-		return common.Response{Error: err.Error()}
+		return nil, err
 	}
+	opErrors := []string{}
 	for _, op := range ops {
 		if op.Error != "" {
 			l.Logger.Error(fmt.Sprintf("failed to update rule: %s", op.Error))
+			opErrors = append(opErrors, op.Error)
+		}
+	}
+	if l.RolloutPolicy != nil && len(plan.rolloutUpdates) != 0 {
+		errs := l.RolloutPolicy.recordRollouts(ctx, plan.rolloutUpdates)
+		for _, e := range errs {
+			l.Logger.Error(e)
 		}
+		opErrors = append(opErrors, errs...)
 	}
+	return opErrors, nil
+}
 
-	l.Logger.Info("done updating rules")
+// prepareRule returns the rule content to set with the suppression
+// and exceptions from the config applied.
+func (l *RuleExtension) prepareRule(namespace RuleNamespace, ruleName RuleName, ruleData RuleInfo, config ruleConfig) limacharlie.Dict {
+	policy := config.suppressionPolicy(namespace, ruleData.Tags)
+	exceptions := []limacharlie.Dict{}
+	if o := config.override(ruleName); o != nil {
+		if o.SuppressionTime != "" {
+			policy.Period = o.SuppressionTime
+		}
+		var err error
+		if exceptions, err = o.exceptionDetections(); err != nil {
+			l.Logger.Error(err.Error())
+			exceptions = nil
+		}
+	}
+	policy.Period = l.shimSuppressionTime(policy.Period)
+	if policy.Period == "" && len(exceptions) == 0 {
+		return ruleData.Data
+	}
+
+	ruleToSet := limacharlie.Dict{}
+	if _, err := ruleToSet.ImportFromStruct(ruleData.Data); err != nil {
+		l.Logger.Error(fmt.Sprintf("failed to duplicate data: %s", err.Error()))
+		return ruleData.Data
+	}
+	if policy.Period != "" {
+		if withSupp := addSuppressionPolicy(ruleToSet, policy); withSupp != nil {
+			ruleToSet = withSupp
+		}
+	}
+	return addExceptions(ruleToSet, exceptions)
+}
+
+// isRuleKept returns true if the rule of a rollout or baseline
+// key is still deployed to the Org.
+func isRuleKept(rulesData RuleData, config ruleConfig, key string) bool {
+	namespace, ruleName, _ := strings.Cut(key, "/")
+	_, ok := rulesData[namespace][ruleName]
+	return ok && !config.isNamespaceExcluded(namespace)
+}
+
+func existingRuleData(existingRule *limacharlie.HiveData) limacharlie.Dict {
+	if existingRule == nil {
+		return nil
+	}
+	return existingRule.Data
+}
 
-	return common.Response{}
+func ruleRecordID(org *limacharlie.Organization, namespace RuleNamespace, ruleName RuleName) limacharlie.RecordID {
+	return limacharlie.RecordID{
+		Hive: limacharlie.HiveID{
+			Name:      limacharlie.HiveName(fmt.Sprintf("dr-%s", namespace)),
+			Partition: limacharlie.PartitionID(org.GetOID()),
+		},
+		Name: limacharlie.RecordName(ruleName),
+	}
 }
 
 func (l *RuleExtension) mergeTags(t1 []string, t2 []string) []string {
@@ -400,6 +690,7 @@ func (l *RuleExtension) mergeTags(t1 []string, t2 []string) []string {
 	for t := range tags {
 		res = append(res, t)
 	}
+	slices.Sort(res)
 	return res
 }
 
@@ -426,12 +717,19 @@ func (l *RuleExtension) shimSuppressionTime(st string) string {
 }
 
 func addSuppression(rule limacharlie.Dict, suppressionTime string) limacharlie.Dict {
+	return addSuppressionPolicy(rule, defaultSuppressionPolicy(suppressionTime))
+}
+
+// addSuppressionPolicy sets the suppression on all the report actions
+// of the rule. The keys are always prefixed with the report name so
+// that each report is suppressed independently.
+func addSuppressionPolicy(rule limacharlie.Dict, policy suppressionPolicy) limacharlie.Dict {
 	rrs := rule["respond"]
 	if rrs == nil {
 		return nil
 	}
-	rs := rrs.([]interface{})
-	if len(rs) == 0 {
+	rs, ok := rrs.([]interface{})
+	if !ok || len(rs) == 0 {
 		return nil
 	}
 	for _, r := range rs {
@@ -442,12 +740,25 @@ func addSuppression(rule limacharlie.Dict, suppressionTime string) limacharlie.D
 		if r["action"] != "report" {
 			continue
 		}
-		r["suppression"] = limacharlie.Dict{
-			"max_count": 1,
-			"period":    suppressionTime,
-			"is_global": false,
-			"keys":      []string{r["name"].(string)},
+		reportName, _ := r["name"].(string)
+		keys := []string{reportName}
+		for _, k := range policy.Keys {
+			if k = expandSuppressionKey(k); k != "" && k != reportName {
+				keys = append(keys, k)
+			}
+		}
+		supp := limacharlie.Dict{
+			"period":    policy.Period,
+			"is_global": policy.IsGlobal,
+			"keys":      keys,
+		}
+		if policy.MaxCount != 0 {
+			supp["max_count"] = policy.MaxCount
+		}
+		if policy.MinCount != 0 {
+			supp["min_count"] = policy.MinCount
 		}
+		r["suppression"] = supp
 	}
 	return rule
 }
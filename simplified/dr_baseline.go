@@ -0,0 +1,110 @@
+package simplified
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+// ruleBaseline is what the extension last set on a rule, kept in the
+// state of the extension by rule. Comparing it with the current state
+// of the rule tells us which fields were modified by a user since the
+// last update.
+type ruleBaseline struct {
+	Enabled bool `json:"enabled"`
+	// Hash of the tags set on the rule, including the ones of users kept.
+	TagsHash string `json:"tags_hash"`
+	// Tags of the rule coming from the extension, the others are from users.
+	ExtTags []string `json:"ext_tags"`
+}
+
+// ruleState is the user metadata to set on a rule along with
+// the conflicts found with changes made by users.
+type ruleState struct {
+	enabled   bool
+	tags      []string
+	conflicts []string
+	// What to record as set by the extension.
+	baseline ruleBaseline
+}
+
+// resolveRuleState decides the enabled state and tags of a rule.
+// The existing rule is nil if the rule is new and the baseline
+// is nil if we don't know what we last set on it.
+func (l *RuleExtension) resolveRuleState(ruleName RuleName, ruleData RuleInfo, config ruleConfig, existingRule *limacharlie.HiveData, base *ruleBaseline) ruleState {
+	extTags := l.mergeTags(ruleData.Tags, []string{})
+	enabled, isSelected := config.selectedState(ruleName, ruleData.Tags)
+	if existingRule == nil {
+		if !isSelected {
+			enabled = !config.DisableByDefault
+		}
+		return ruleState{
+			enabled:   enabled,
+			tags:      extTags,
+			conflicts: []string{},
+			baseline:  ruleBaseline{Enabled: enabled, TagsHash: hashTags(extTags), ExtTags: extTags},
+		}
+	}
+
+	state := ruleState{
+		conflicts: []string{},
+	}
+
+	// Rules explicitly selected in the config always get that state,
+	// otherwise the current state is kept.
+	baseEnabled := enabled
+	isUserEnabled := base != nil && base.Enabled != existingRule.UsrMtd.Enabled
+	if !isSelected {
+		enabled = existingRule.UsrMtd.Enabled
+		baseEnabled = enabled
+		if base != nil {
+			baseEnabled = base.Enabled
+		}
+	} else if isUserEnabled && enabled != existingRule.UsrMtd.Enabled {
+		state.conflicts = append(state.conflicts, fmt.Sprintf("enabled state set to %t by a user is overridden by the config", existingRule.UsrMtd.Enabled))
+	}
+	state.enabled = enabled
+
+	// The tags of users are the ones on the rule we did not set, they
+	// are kept while the ones we no longer set are removed. Without a
+	// baseline we don't know which are which so all of them are kept.
+	tags := l.mergeTags(ruleData.Tags, existingRule.UsrMtd.Tags)
+	if base != nil {
+		userTags := []string{}
+		for _, t := range existingRule.UsrMtd.Tags {
+			if !slices.Contains(base.ExtTags, t) && !slices.Contains(extTags, t) {
+				userTags = append(userTags, t)
+			}
+		}
+		tags = l.mergeTags(ruleData.Tags, userTags)
+		// Only report the tags of users when they were modified since our last update.
+		if len(userTags) != 0 && base.TagsHash != hashTags(existingRule.UsrMtd.Tags) {
+			state.conflicts = append(state.conflicts, fmt.Sprintf("tags not set by the extension are kept: %s", strings.Join(userTags, ", ")))
+		}
+	}
+	state.tags = tags
+	state.baseline = ruleBaseline{Enabled: baseEnabled, TagsHash: hashTags(tags), ExtTags: extTags}
+
+	return state
+}
+
+// hashTags returns a short hash of a set of tags independent of their order.
+func hashTags(tags []string) string {
+	sorted := append([]string{}, tags...)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+	h := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return fmt.Sprintf("%x", h[:8])
+}
+
+// areTagsEqual compares two sets of tags independent of their order.
+func areTagsEqual(t1 []string, t2 []string) bool {
+	s1 := append([]string{}, t1...)
+	s2 := append([]string{}, t2...)
+	slices.Sort(s1)
+	slices.Sort(s2)
+	return slices.Equal(slices.Compact(s1), slices.Compact(s2))
+}
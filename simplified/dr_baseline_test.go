@@ -0,0 +1,94 @@
+package simplified
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+func TestResolveRuleState(t *testing.T) {
+	l := &RuleExtension{tag: "ext:test"}
+	ruleData := RuleInfo{Tags: []string{"t1"}}
+
+	// New rules follow the default.
+	state := l.resolveRuleState("r1", ruleData, ruleConfig{DisableByDefault: true}, nil, nil)
+	if state.enabled {
+		t.Errorf("expected new rule to be disabled")
+	}
+	extTags := []string{"ext:test", "t1"}
+	if !areTagsEqual(state.tags, extTags) {
+		t.Errorf("unexpected tags: %v != %v", state.tags, extTags)
+	}
+	if state.baseline.Enabled || state.baseline.TagsHash != hashTags(extTags) || !areTagsEqual(state.baseline.ExtTags, extTags) {
+		t.Errorf("unexpected baseline: %+v", state.baseline)
+	}
+
+	// A rule disabled and tagged by a user keeps its state and tags.
+	base := &ruleBaseline{Enabled: true, TagsHash: hashTags(extTags), ExtTags: extTags}
+	existing := &limacharlie.HiveData{
+		UsrMtd: limacharlie.UsrMtd{
+			Enabled: false,
+			Tags:    []string{"ext:test", "t1", "user-tag"},
+		},
+	}
+	state = l.resolveRuleState("r1", RuleInfo{Tags: []string{"t2"}}, ruleConfig{}, existing, base)
+	if state.enabled {
+		t.Errorf("expected user disabled rule to remain disabled")
+	}
+	if !areTagsEqual(state.tags, []string{"ext:test", "t2", "user-tag"}) {
+		t.Errorf("expected the user tags to be kept and the ones of the extension updated: %v", state.tags)
+	}
+	for _, tag := range state.tags {
+		if strings.HasPrefix(tag, "ext:test:") {
+			t.Errorf("unexpected marker tag %s", tag)
+		}
+	}
+	if len(state.conflicts) != 1 || !strings.Contains(state.conflicts[0], "user-tag") {
+		t.Errorf("expected a conflict for the user tags: %v", state.conflicts)
+	}
+	if !state.baseline.Enabled || state.baseline.TagsHash != hashTags(state.tags) || !areTagsEqual(state.baseline.ExtTags, []string{"ext:test", "t2"}) {
+		t.Errorf("expected the baseline to keep what the extension set: %+v", state.baseline)
+	}
+
+	// The tags of users already kept are not reported again.
+	kept := &limacharlie.HiveData{
+		UsrMtd: limacharlie.UsrMtd{
+			Enabled: false,
+			Tags:    state.tags,
+		},
+	}
+	next := l.resolveRuleState("r1", RuleInfo{}, ruleConfig{}, kept, &state.baseline)
+	if len(next.conflicts) != 0 || !areTagsEqual(next.tags, []string{"ext:test", "user-tag"}) || next.baseline.TagsHash != hashTags(next.tags) {
+		t.Errorf("expected the removed tag to be dropped without conflicts: %+v", next)
+	}
+
+	// The config takes precedence over the user, reporting the conflict.
+	state = l.resolveRuleState("r1", ruleData, ruleConfig{EnabledRules: []RuleName{"r1"}}, existing, base)
+	if !state.enabled {
+		t.Errorf("expected rule selected in config to be enabled")
+	}
+	if len(state.conflicts) != 2 {
+		t.Errorf("expected two conflicts: %v", state.conflicts)
+	}
+
+	// Without a baseline, the tags on the rule are kept without conflicts.
+	state = l.resolveRuleState("r1", ruleData, ruleConfig{}, existing, nil)
+	if state.enabled || !slices.Contains(state.tags, "user-tag") || len(state.conflicts) != 0 {
+		t.Errorf("unexpected state: %+v", state)
+	}
+
+	// Unmodified rules get the new tags from the extension.
+	existing = &limacharlie.HiveData{
+		UsrMtd: limacharlie.UsrMtd{
+			Enabled: true,
+			Tags:    []string{"ext:test", "t1"},
+		},
+	}
+	state = l.resolveRuleState("r1", RuleInfo{Tags: []string{"t2"}}, ruleConfig{}, existing, base)
+	newExtTags := []string{"ext:test", "t2"}
+	if !state.enabled || !areTagsEqual(state.tags, newExtTags) || len(state.conflicts) != 0 {
+		t.Errorf("unexpected state: %+v", state)
+	}
+}
@@ -0,0 +1,425 @@
+package simplified
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/common"
+)
+
+type ruleConfig struct {
+	DisableByDefault      bool            `json:"disable_by_default"`
+	GlobalSuppressionTime string          `json:"global_suppression_time"`
+	EnabledRules          []RuleName      `json:"enabled_rules"`
+	DisabledRules         []RuleName      `json:"disabled_rules"`
+	EnabledTags           []string        `json:"enabled_tags"`
+	DisabledTags          []string        `json:"disabled_tags"`
+	ExcludedNamespaces    []RuleNamespace `json:"excluded_namespaces"`
+	RuleOverrides         []ruleOverride  `json:"rule_overrides"`
+	// Suppression policies, the first one matching a rule applies.
+	SuppressionPolicies []suppressionPolicy `json:"suppression_policies"`
+	// Version of the rules to stay on instead of the latest.
+	PinnedVersion RulePackVersion `json:"pinned_version"`
+	// How often to update the rules instead of the extension's default.
+	SyncSchedule SyncSchedule `json:"sync_schedule"`
+}
+
+// Per-rule settings taking precedence over the global ones.
+type ruleOverride struct {
+	RuleName        RuleName `json:"rule_name"`
+	SuppressionTime string   `json:"suppression_time"`
+	// Detections, as JSON objects or strings, matching
+	// events that should not trigger the rule.
+	Exceptions []interface{} `json:"exceptions"`
+}
+
+// How detections from a rule are suppressed.
+type suppressionPolicy struct {
+	Period   string `json:"period"`
+	MinCount int    `json:"min_count"`
+	MaxCount int    `json:"max_count"`
+	// Suppress across all sensors instead of per sensor.
+	IsGlobal bool `json:"is_global"`
+	// Additional keys to suppress on, like "sensor", "hostname",
+	// an event path like "event/FILE_PATH" or a template.
+	Keys []string `json:"keys"`
+
+	// The policy applies to rules in any of these namespaces
+	// and with any of these tags, or all rules if not set.
+	Namespaces []RuleNamespace `json:"namespaces"`
+	Tags       []string        `json:"tags"`
+}
+
+// Shortcuts for common suppression keys.
+var suppressionKeyShortcuts = map[string]string{
+	"sensor":   "{{ .routing.sid }}",
+	"hostname": "{{ .routing.hostname }}",
+}
+
+func defaultSuppressionPolicy(period string) suppressionPolicy {
+	return suppressionPolicy{
+		Period:   period,
+		MaxCount: 1,
+		IsGlobal: false,
+	}
+}
+
+func ruleConfigSchema() common.SchemaObject {
+	namespaces := []interface{}{}
+	for namespace := range simplifiedRuleNamespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	return common.SchemaObject{
+		Fields: map[common.SchemaKey]common.SchemaElement{
+			"disable_by_default": {
+				DataType:     common.SchemaDataTypes.Boolean,
+				Description:  "disable new rules by default after the initial subscription",
+				DefaultValue: false,
+				Label:        "Disable new rules by default",
+			},
+			"global_suppression_time": {
+				DataType:     common.SchemaDataTypes.String,
+				Description:  "global suppression period for all detections for rules created by this extension like \"30m\" or \"1h\", with a max of \"24h\".",
+				DefaultValue: "",
+				Label:        "Global suppression time",
+				PlaceHolder:  "24h",
+			},
+			"enabled_rules": {
+				DataType:    common.SchemaDataTypes.String,
+				IsList:      true,
+				Description: "names of rules to always enable",
+				Label:       "Enabled rules",
+			},
+			"disabled_rules": {
+				DataType:    common.SchemaDataTypes.String,
+				IsList:      true,
+				Description: "names of rules to always disable, takes precedence over enabled rules",
+				Label:       "Disabled rules",
+			},
+			"enabled_tags": {
+				DataType:    common.SchemaDataTypes.Tag,
+				IsList:      true,
+				Description: "enable rules with any of these tags unless the rule is disabled by name",
+				Label:       "Enabled tags",
+			},
+			"disabled_tags": {
+				DataType:    common.SchemaDataTypes.Tag,
+				IsList:      true,
+				Description: "disable rules with any of these tags unless the rule is enabled by name, takes precedence over enabled tags",
+				Label:       "Disabled tags",
+			},
+			"excluded_namespaces": {
+				DataType:    common.SchemaDataTypes.Enum,
+				IsList:      true,
+				EnumValues:  namespaces,
+				Description: "namespaces where no rules should be created, existing rules from this extension in them are removed",
+				Label:       "Excluded namespaces",
+			},
+			"rule_overrides": {
+				DataType:    common.SchemaDataTypes.Object,
+				IsList:      true,
+				Description: "per-rule settings taking precedence over the global ones",
+				Label:       "Rule overrides",
+				Object: &common.SchemaObject{
+					ElementName:        "override",
+					ElementDescription: "settings for a single rule",
+					Fields: map[common.SchemaKey]common.SchemaElement{
+						"rule_name": {
+							DataType:    common.SchemaDataTypes.String,
+							Description: "name of the rule to override",
+							Label:       "Rule name",
+						},
+						"suppression_time": {
+							DataType:    common.SchemaDataTypes.String,
+							Description: "suppression period for detections of this rule like \"30m\" or \"1h\", with a max of \"24h\".",
+							Label:       "Suppression time",
+							PlaceHolder: "1h",
+						},
+						"exceptions": {
+							DataType:    common.SchemaDataTypes.JSON,
+							IsList:      true,
+							Description: "detections matching false positives, events matching any of them will not trigger the rule",
+							Label:       "False positive exceptions",
+						},
+					},
+					Requirements: [][]common.SchemaKey{{"rule_name"}},
+				},
+			},
+			"pinned_version": {
+				DataType:    common.SchemaDataTypes.String,
+				Description: "version of the rules to stay on instead of getting the latest rules",
+				Label:       "Pinned version",
+			},
+			"sync_schedule": {
+				DataType:    common.SchemaDataTypes.Enum,
+				EnumValues:  syncScheduleValues(),
+				Description: "how often to update the rules, \"disabled\" to only update them on request",
+				Label:       "Sync schedule",
+			},
+			"suppression_policies": {
+				DataType:    common.SchemaDataTypes.Object,
+				IsList:      true,
+				Description: "suppression policies for rules in specific namespaces or with specific tags, the first matching policy applies and takes precedence over the global suppression time",
+				Label:       "Suppression policies",
+				Object: &common.SchemaObject{
+					ElementName:        "policy",
+					ElementDescription: "a suppression policy",
+					Fields: map[common.SchemaKey]common.SchemaElement{
+						"period": {
+							DataType:    common.SchemaDataTypes.String,
+							Description: "suppression period like \"30m\" or \"1h\", with a max of \"24h\".",
+							Label:       "Period",
+							PlaceHolder: "1h",
+						},
+						"min_count": {
+							DataType:    common.SchemaDataTypes.Integer,
+							Description: "only report once the rule matched this many times within the period",
+							Label:       "Minimum count",
+						},
+						"max_count": {
+							DataType:    common.SchemaDataTypes.Integer,
+							Description: "report at most this many times within the period",
+							Label:       "Maximum count",
+						},
+						"is_global": {
+							DataType:    common.SchemaDataTypes.Boolean,
+							Description: "suppress across all sensors instead of per sensor",
+							Label:       "Global",
+						},
+						"keys": {
+							DataType:    common.SchemaDataTypes.String,
+							IsList:      true,
+							Description: "additional keys to suppress on: \"sensor\", \"hostname\", an event path like \"event/FILE_PATH\" or a template like \"{{ .event.FILE_PATH }}\"",
+							Label:       "Keys",
+						},
+						"namespaces": {
+							DataType:    common.SchemaDataTypes.Enum,
+							IsList:      true,
+							EnumValues:  namespaces,
+							Description: "apply to rules in these namespaces, all namespaces if empty",
+							Label:       "Namespaces",
+						},
+						"tags": {
+							DataType:    common.SchemaDataTypes.Tag,
+							IsList:      true,
+							Description: "apply to rules with any of these tags, all rules if empty",
+							Label:       "Tags",
+						},
+					},
+					Requirements: [][]common.SchemaKey{{"period"}},
+				},
+			},
+		},
+		Requirements: [][]common.SchemaKey{},
+	}
+}
+
+func (c ruleConfig) validate() error {
+	if err := validateSyncSchedule(c.SyncSchedule); err != nil {
+		return err
+	}
+	if err := validateSuppressionTime("global suppression time", c.GlobalSuppressionTime); err != nil {
+		return err
+	}
+	for _, namespace := range c.ExcludedNamespaces {
+		if _, ok := simplifiedRuleNamespaces[namespace]; !ok {
+			return fmt.Errorf("unknown namespace: %s", namespace)
+		}
+	}
+	for _, o := range c.RuleOverrides {
+		if o.RuleName == "" {
+			return errors.New("rule override is missing a rule name")
+		}
+		if err := validateSuppressionTime(fmt.Sprintf("suppression time for rule %s", o.RuleName), o.SuppressionTime); err != nil {
+			return err
+		}
+		if _, err := o.exceptionDetections(); err != nil {
+			return err
+		}
+	}
+	for i, p := range c.SuppressionPolicies {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("invalid suppression policy %d: %s", i, err.Error())
+		}
+	}
+	return nil
+}
+
+func (p suppressionPolicy) validate() error {
+	if p.Period == "" {
+		return errors.New("missing period")
+	}
+	if err := validateSuppressionTime("period", p.Period); err != nil {
+		return err
+	}
+	if p.MinCount < 0 || p.MaxCount < 0 {
+		return errors.New("counts cannot be negative")
+	}
+	if p.MinCount == 0 && p.MaxCount == 0 {
+		return errors.New("one of min_count or max_count is required")
+	}
+	if p.MaxCount != 0 && p.MinCount > p.MaxCount {
+		return errors.New("min_count cannot be more than max_count")
+	}
+	for _, namespace := range p.Namespaces {
+		if _, ok := simplifiedRuleNamespaces[namespace]; !ok {
+			return fmt.Errorf("unknown namespace: %s", namespace)
+		}
+	}
+	for _, k := range p.Keys {
+		if _, err := template.New("key").Parse(expandSuppressionKey(k)); err != nil {
+			return fmt.Errorf("invalid key %q: %s", k, err.Error())
+		}
+	}
+	return nil
+}
+
+func (p suppressionPolicy) matches(namespace RuleNamespace, tags []string) bool {
+	if len(p.Namespaces) != 0 && !slices.Contains(p.Namespaces, namespace) {
+		return false
+	}
+	if len(p.Tags) == 0 {
+		return true
+	}
+	for _, t := range tags {
+		if slices.Contains(p.Tags, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// suppressionPolicy returns the suppression policy for a rule. If no
+// policy matches, the global suppression time is used, which may be empty.
+func (c ruleConfig) suppressionPolicy(namespace RuleNamespace, tags []string) suppressionPolicy {
+	for _, p := range c.SuppressionPolicies {
+		if p.matches(namespace, tags) {
+			return p
+		}
+	}
+	return defaultSuppressionPolicy(c.GlobalSuppressionTime)
+}
+
+// expandSuppressionKey converts shortcuts and paths into templates.
+func expandSuppressionKey(k string) string {
+	if t, ok := suppressionKeyShortcuts[k]; ok {
+		return t
+	}
+	for _, prefix := range []string{"event/", "routing/"} {
+		if strings.HasPrefix(k, prefix) {
+			return fmt.Sprintf("{{ .%s }}", strings.ReplaceAll(k, "/", "."))
+		}
+	}
+	return k
+}
+
+func validateSuppressionTime(name string, st string) error {
+	if st == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(st)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", name, err.Error())
+	}
+	if d > 24*time.Hour {
+		return fmt.Errorf("%s cannot be more than 24h", name)
+	}
+	if d < 1*time.Second {
+		return fmt.Errorf("%s cannot be less than 1s", name)
+	}
+	return nil
+}
+
+func (c ruleConfig) isNamespaceExcluded(namespace RuleNamespace) bool {
+	return slices.Contains(c.ExcludedNamespaces, namespace)
+}
+
+// selectedState returns the enabled state the config explicitly
+// selects for a rule and whether there is such a selection.
+// Rule names take precedence over tags and disabling takes
+// precedence over enabling.
+func (c ruleConfig) selectedState(ruleName RuleName, tags []string) (bool, bool) {
+	if slices.Contains(c.DisabledRules, ruleName) {
+		return false, true
+	}
+	if slices.Contains(c.EnabledRules, ruleName) {
+		return true, true
+	}
+	for _, t := range tags {
+		if slices.Contains(c.DisabledTags, t) {
+			return false, true
+		}
+	}
+	for _, t := range tags {
+		if slices.Contains(c.EnabledTags, t) {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+func (c ruleConfig) override(ruleName RuleName) *ruleOverride {
+	for i := range c.RuleOverrides {
+		if c.RuleOverrides[i].RuleName == ruleName {
+			return &c.RuleOverrides[i]
+		}
+	}
+	return nil
+}
+
+func (o ruleOverride) exceptionDetections() ([]limacharlie.Dict, error) {
+	detections := []limacharlie.Dict{}
+	for _, e := range o.Exceptions {
+		d := limacharlie.Dict{}
+		switch v := e.(type) {
+		case string:
+			if err := json.Unmarshal([]byte(v), &d); err != nil {
+				return nil, fmt.Errorf("invalid exception for rule %s: %s", o.RuleName, err.Error())
+			}
+		case map[string]interface{}:
+			if _, err := d.ImportFromStruct(v); err != nil {
+				return nil, fmt.Errorf("invalid exception for rule %s: %s", o.RuleName, err.Error())
+			}
+		default:
+			return nil, fmt.Errorf("invalid exception for rule %s: expected a detection object", o.RuleName)
+		}
+		if _, ok := d["op"]; !ok {
+			return nil, fmt.Errorf("invalid exception for rule %s: missing op", o.RuleName)
+		}
+		detections = append(detections, d)
+	}
+	return detections, nil
+}
+
+// addExceptions wraps the detection of the rule so that events
+// matching any of the exceptions do not trigger it.
+func addExceptions(rule limacharlie.Dict, exceptions []limacharlie.Dict) limacharlie.Dict {
+	detect, ok := rule["detect"].(map[string]interface{})
+	if !ok || len(exceptions) == 0 {
+		return rule
+	}
+	wrapper := limacharlie.Dict{
+		"op": "and",
+	}
+	// The event selection needs to remain at the top level.
+	for _, k := range []string{"target", "event", "events"} {
+		if v, ok := detect[k]; ok {
+			wrapper[k] = v
+			delete(detect, k)
+		}
+	}
+	rules := []interface{}{detect}
+	for _, e := range exceptions {
+		e["not"] = true
+		rules = append(rules, e)
+	}
+	wrapper["rules"] = rules
+	rule["detect"] = wrapper
+	return rule
+}
@@ -0,0 +1,116 @@
+package simplified
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+func TestRuleConfigSelectedState(t *testing.T) {
+	c := ruleConfig{
+		EnabledRules:  []RuleName{"r1", "r2"},
+		DisabledRules: []RuleName{"r2", "r3"},
+		EnabledTags:   []string{"t1", "t2"},
+		DisabledTags:  []string{"t2"},
+	}
+
+	tests := []struct {
+		name       string
+		tags       []string
+		enabled    bool
+		isSelected bool
+	}{
+		{"r1", nil, true, true},
+		{"r2", nil, false, true},
+		{"r3", []string{"t1"}, false, true},
+		{"r1", []string{"t2"}, true, true},
+		{"r4", []string{"t1"}, true, true},
+		{"r4", []string{"t1", "t2"}, false, true},
+		{"r4", []string{"t3"}, false, false},
+	}
+	for _, tt := range tests {
+		enabled, isSelected := c.selectedState(tt.name, tt.tags)
+		if enabled != tt.enabled || isSelected != tt.isSelected {
+			t.Errorf("selectedState(%s, %v) = %v, %v; want %v, %v", tt.name, tt.tags, enabled, isSelected, tt.enabled, tt.isSelected)
+		}
+	}
+}
+
+func TestRuleConfigValidate(t *testing.T) {
+	tests := []struct {
+		config  string
+		isValid bool
+	}{
+		{`{}`, true},
+		{`{"global_suppression_time":"1h"}`, true},
+		{`{"global_suppression_time":"48h"}`, false},
+		{`{"excluded_namespaces":["general"]}`, true},
+		{`{"excluded_namespaces":["other"]}`, false},
+		{`{"rule_overrides":[{"rule_name":"r1","suppression_time":"30m"}]}`, true},
+		{`{"rule_overrides":[{"suppression_time":"30m"}]}`, false},
+		{`{"rule_overrides":[{"rule_name":"r1","suppression_time":"10ms"}]}`, false},
+		{`{"rule_overrides":[{"rule_name":"r1","exceptions":[{"op":"is","path":"event/FILE_PATH","value":"a.exe"}]}]}`, true},
+		{`{"rule_overrides":[{"rule_name":"r1","exceptions":["{\"op\":\"is\",\"path\":\"event/FILE_PATH\",\"value\":\"a.exe\"}"]}]}`, true},
+		{`{"rule_overrides":[{"rule_name":"r1","exceptions":[{"path":"event/FILE_PATH"}]}]}`, false},
+		{`{"rule_overrides":[{"rule_name":"r1","exceptions":["not json"]}]}`, false},
+		{`{"suppression_policies":[{"period":"1h","max_count":1,"keys":["sensor","event/FILE_PATH"]}]}`, true},
+		{`{"suppression_policies":[{"period":"1h","min_count":3,"namespaces":["general"],"tags":["t1"]}]}`, true},
+		{`{"suppression_policies":[{"max_count":1}]}`, false},
+		{`{"suppression_policies":[{"period":"1h"}]}`, false},
+		{`{"suppression_policies":[{"period":"1h","min_count":5,"max_count":2}]}`, false},
+		{`{"suppression_policies":[{"period":"1h","max_count":1,"keys":["{{ .event"]}]}`, false},
+		{`{"suppression_policies":[{"period":"1h","max_count":1,"namespaces":["other"]}]}`, false},
+	}
+	for _, tt := range tests {
+		d := limacharlie.Dict{}
+		if err := json.Unmarshal([]byte(tt.config), &d); err != nil {
+			panic(err)
+		}
+		c := ruleConfig{}
+		if err := d.UnMarshalToStruct(&c); err != nil {
+			t.Fatalf("failed to parse config %s: %v", tt.config, err)
+		}
+		if err := c.validate(); (err == nil) != tt.isValid {
+			t.Errorf("validate(%s) = %v; want valid %v", tt.config, err, tt.isValid)
+		}
+	}
+}
+
+func TestAddExceptions(t *testing.T) {
+	d := limacharlie.Dict{}
+	if err := json.Unmarshal([]byte(`{"detect":{"event":"NEW_PROCESS","op":"is","path":"event/FILE_PATH","value":"a.exe"}}`), &d); err != nil {
+		panic(err)
+	}
+
+	final := fmt.Sprintf("%v", addExceptions(d, []limacharlie.Dict{{"op": "is", "path": "routing/hostname", "value": "h1"}}))
+	expected := `map[detect:map[event:NEW_PROCESS op:and rules:[map[op:is path:event/FILE_PATH value:a.exe] map[not:true op:is path:routing/hostname value:h1]]]]`
+	if final != expected {
+		t.Errorf("unexpected exceptions: %s\n!=\n%s", final, expected)
+	}
+}
+
+func TestRuleConfigSuppressionPolicy(t *testing.T) {
+	c := ruleConfig{
+		GlobalSuppressionTime: "2h",
+		SuppressionPolicies: []suppressionPolicy{
+			{Period: "10m", MaxCount: 1, Namespaces: []RuleNamespace{"managed"}},
+			{Period: "20m", MaxCount: 1, Tags: []string{"noisy"}},
+		},
+	}
+	tests := []struct {
+		namespace RuleNamespace
+		tags      []string
+		period    string
+	}{
+		{"managed", []string{"noisy"}, "10m"},
+		{"general", []string{"noisy"}, "20m"},
+		{"general", []string{"quiet"}, "2h"},
+	}
+	for _, tt := range tests {
+		if p := c.suppressionPolicy(tt.namespace, tt.tags); p.Period != tt.period {
+			t.Errorf("suppressionPolicy(%s, %v) = %s; want %s", tt.namespace, tt.tags, p.Period, tt.period)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package simplified
+
+import (
+	"fmt"
+	"time"
+)
+
+var knownDetectionOperators = map[string]struct{}{
+	"and":                {},
+	"or":                 {},
+	"is":                 {},
+	"exists":             {},
+	"contains":           {},
+	"starts with":        {},
+	"ends with":          {},
+	"is greater than":    {},
+	"is lower than":      {},
+	"is older than":      {},
+	"matches":            {},
+	"string distance":    {},
+	"cidr":               {},
+	"is public address":  {},
+	"is private address": {},
+	"sub domain":         {},
+	"lookup":             {},
+	"scope":              {},
+	"external":           {},
+	"is tagged":          {},
+	"is platform":        {},
+	"is windows":         {},
+	"is linux":           {},
+	"is mac":             {},
+	"is chrome":          {},
+	"is text":            {},
+	"is net":             {},
+	"is 32 bit":          {},
+	"is 64 bit":          {},
+	"is arm":             {},
+}
+
+// Operators evaluating a value at a path in the event.
+var pathDetectionOperators = map[string]struct{}{
+	"is":                 {},
+	"exists":             {},
+	"contains":           {},
+	"starts with":        {},
+	"ends with":          {},
+	"is greater than":    {},
+	"is lower than":      {},
+	"is older than":      {},
+	"matches":            {},
+	"string distance":    {},
+	"cidr":               {},
+	"is public address":  {},
+	"is private address": {},
+	"sub domain":         {},
+	"lookup":             {},
+	"scope":              {},
+}
+
+var knownResponseActions = map[string]struct{}{
+	"report":            {},
+	"task":              {},
+	"add tag":           {},
+	"remove tag":        {},
+	"add var":           {},
+	"del var":           {},
+	"isolate network":   {},
+	"rejoin network":    {},
+	"seal":              {},
+	"unseal":            {},
+	"output":            {},
+	"wait":              {},
+	"service request":   {},
+	"extension request": {},
+	"delete sensor":     {},
+	"undelete sensor":   {},
+	"playbook":          {},
+}
+
+// ValidateRule checks the structure of a rule locally and
+// returns the problems found, if any.
+func ValidateRule(namespace RuleNamespace, rule RuleInfo) []string {
+	problems, _ := lintRule(namespace, rule)
+	return problems
+}
+
+// lintRule checks the structure of a rule locally and returns the
+// problems making it invalid along with warnings. Ops and actions
+// we don't know are only warnings, they may be newer than this list.
+func lintRule(namespace RuleNamespace, rule RuleInfo) ([]string, []string) {
+	l := &ruleLint{problems: []string{}, warnings: []string{}}
+	if _, ok := simplifiedRuleNamespaces[namespace]; !ok {
+		l.problems = append(l.problems, fmt.Sprintf("namespace %q is not allowed", namespace))
+	}
+
+	// Validate a normalized copy so the checks don't
+	// depend on the Go types used to build the rule.
+	d, ok := normalizeRule(rule.Data).(map[string]interface{})
+	if !ok || len(d) == 0 {
+		return append(l.problems, "rule is empty"), l.warnings
+	}
+
+	detect, ok := d["detect"].(map[string]interface{})
+	if !ok {
+		l.problems = append(l.problems, "missing detect")
+	} else {
+		l.validateDetection("detect", detect)
+	}
+
+	respond, ok := d["respond"].([]interface{})
+	if !ok || len(respond) == 0 {
+		l.problems = append(l.problems, "missing respond")
+	} else {
+		for i, r := range respond {
+			l.validateResponse(fmt.Sprintf("respond[%d]", i), r)
+		}
+	}
+	return l.problems, l.warnings
+}
+
+// ruleLint collects the problems and warnings of a rule.
+type ruleLint struct {
+	problems []string
+	warnings []string
+}
+
+func (l *ruleLint) validateDetection(path string, detect map[string]interface{}) {
+	op, _ := detect["op"].(string)
+	if op == "" {
+		l.problems = append(l.problems, fmt.Sprintf("%s: missing op", path))
+		return
+	}
+	if _, ok := knownDetectionOperators[op]; !ok {
+		l.warnings = append(l.warnings, fmt.Sprintf("%s: unknown op %q", path, op))
+		return
+	}
+
+	if _, ok := pathDetectionOperators[op]; ok {
+		if p, _ := detect["path"].(string); p == "" {
+			l.problems = append(l.problems, fmt.Sprintf("%s: op %q requires a path", path, op))
+		}
+	}
+	switch op {
+	case "and", "or":
+		rules, ok := detect["rules"].([]interface{})
+		if !ok || len(rules) == 0 {
+			l.problems = append(l.problems, fmt.Sprintf("%s: op %q requires rules", path, op))
+			break
+		}
+		for i, r := range rules {
+			subPath := fmt.Sprintf("%s.rules[%d]", path, i)
+			sub, ok := r.(map[string]interface{})
+			if !ok {
+				l.problems = append(l.problems, fmt.Sprintf("%s: expected a detection", subPath))
+				continue
+			}
+			l.validateDetection(subPath, sub)
+		}
+	case "scope":
+		sub, ok := detect["rule"].(map[string]interface{})
+		if !ok {
+			l.problems = append(l.problems, fmt.Sprintf("%s: op %q requires a rule", path, op))
+			break
+		}
+		l.validateDetection(path+".rule", sub)
+	case "matches":
+		if re, _ := detect["re"].(string); re == "" {
+			l.problems = append(l.problems, fmt.Sprintf("%s: op %q requires a re", path, op))
+		}
+	case "lookup":
+		if resource, _ := detect["resource"].(string); resource == "" {
+			l.problems = append(l.problems, fmt.Sprintf("%s: op %q requires a resource", path, op))
+		}
+	case "is tagged":
+		if tag, _ := detect["tag"].(string); tag == "" {
+			l.problems = append(l.problems, fmt.Sprintf("%s: op %q requires a tag", path, op))
+		}
+	}
+}
+
+func (l *ruleLint) validateResponse(path string, r interface{}) {
+	response, ok := r.(map[string]interface{})
+	if !ok {
+		l.problems = append(l.problems, fmt.Sprintf("%s: expected a response", path))
+		return
+	}
+	action, _ := response["action"].(string)
+	if action == "" {
+		l.problems = append(l.problems, fmt.Sprintf("%s: missing action", path))
+		return
+	}
+	if _, ok := knownResponseActions[action]; !ok {
+		l.warnings = append(l.warnings, fmt.Sprintf("%s: unknown action %q", path, action))
+		return
+	}
+	if action != "report" {
+		return
+	}
+
+	if name, _ := response["name"].(string); name == "" {
+		l.problems = append(l.problems, fmt.Sprintf("%s: report requires a name", path))
+	}
+	if supp, ok := response["suppression"]; ok {
+		l.problems = append(l.problems, validateSuppressionShape(path+".suppression", supp)...)
+	}
+}
+
+func validateSuppressionShape(path string, s interface{}) []string {
+	supp, ok := s.(map[string]interface{})
+	if !ok {
+		return []string{fmt.Sprintf("%s: expected an object", path)}
+	}
+	problems := []string{}
+	if period, _ := supp["period"].(string); period == "" {
+		problems = append(problems, fmt.Sprintf("%s: missing period", path))
+	} else if _, err := time.ParseDuration(period); err != nil {
+		problems = append(problems, fmt.Sprintf("%s: invalid period: %s", path, err.Error()))
+	}
+	for _, k := range []string{"min_count", "max_count"} {
+		v, ok := supp[k]
+		if !ok {
+			continue
+		}
+		if n, ok := v.(float64); !ok || n < 1 || n != float64(int64(n)) {
+			problems = append(problems, fmt.Sprintf("%s: %s must be a positive integer", path, k))
+		}
+	}
+	if keys, ok := supp["keys"]; ok {
+		l, ok := keys.([]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: keys must be a list", path))
+		}
+		for _, k := range l {
+			if _, ok := k.(string); !ok {
+				problems = append(problems, fmt.Sprintf("%s: keys must be strings", path))
+				break
+			}
+		}
+	}
+	if isGlobal, ok := supp["is_global"]; ok {
+		if _, ok := isGlobal.(bool); !ok {
+			problems = append(problems, fmt.Sprintf("%s: is_global must be a boolean", path))
+		}
+	}
+	return problems
+}
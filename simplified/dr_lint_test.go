@@ -0,0 +1,87 @@
+package simplified
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+func TestValidateRule(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		namespace RuleNamespace
+		rule      string
+		errors    []string
+		warnings  []string
+	}{
+		{
+			name:      "valid",
+			namespace: "general",
+			rule:      `{"detect":{"op":"and","rules":[{"op":"is","path":"event/FILE_PATH","value":"a"},{"op":"matches","path":"event/COMMAND_LINE","re":".*"}]},"respond":[{"action":"report","name":"r1","suppression":{"period":"1h","max_count":1,"keys":["r1"]}},{"action":"add tag","tag":"t"}]}`,
+		},
+		{
+			name:      "bad namespace",
+			namespace: "other",
+			rule:      `{"detect":{"op":"exists","path":"event"},"respond":[{"action":"report","name":"r1"}]}`,
+			errors:    []string{`namespace "other" is not allowed`},
+		},
+		{
+			name:      "missing sections",
+			namespace: "general",
+			rule:      `{"detect":{"op":"exists","path":"event"}}`,
+			errors:    []string{"missing respond"},
+		},
+		{
+			name:      "unknown op",
+			namespace: "general",
+			rule:      `{"detect":{"op":"or","rules":[{"op":"is","path":"event/A"},{"op":"is almost"}]},"respond":[{"action":"report","name":"r1"}]}`,
+			warnings:  []string{`detect.rules[1]: unknown op "is almost"`},
+		},
+		{
+			name:      "missing path",
+			namespace: "general",
+			rule:      `{"detect":{"op":"scope","rule":{"op":"contains","value":"a"}},"respond":[{"action":"report","name":"r1"}]}`,
+			errors:    []string{`detect: op "scope" requires a path`, `detect.rule: op "contains" requires a path`},
+		},
+		{
+			name:      "bad responses",
+			namespace: "general",
+			rule:      `{"detect":{"op":"exists","path":"event"},"respond":[{"action":"report"},{"action":"reboot"},{"action":"report","name":"r1","suppression":{"period":"soon","max_count":-1,"keys":[1]}}]}`,
+			errors: []string{
+				"respond[0]: report requires a name",
+				"respond[2].suppression: invalid period",
+				"respond[2].suppression: max_count must be a positive integer",
+				"respond[2].suppression: keys must be strings",
+			},
+			warnings: []string{`respond[1]: unknown action "reboot"`},
+		},
+		{
+			name:      "zero count",
+			namespace: "general",
+			rule:      `{"detect":{"op":"exists","path":"event"},"respond":[{"action":"report","name":"r1","suppression":{"period":"1h","min_count":0}}]}`,
+			errors:    []string{"respond[0].suppression: min_count must be a positive integer"},
+		},
+	} {
+		d := limacharlie.Dict{}
+		if err := json.Unmarshal([]byte(test.rule), &d); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		problems, warnings := lintRule(test.namespace, RuleInfo{Data: d})
+		if len(problems) != len(test.errors) || len(warnings) != len(test.warnings) {
+			t.Errorf("%s: unexpected problems: %v, warnings: %v", test.name, problems, warnings)
+			continue
+		}
+		for i, p := range problems {
+			if !strings.HasPrefix(p, test.errors[i]) {
+				t.Errorf("%s: expected %q, got %q", test.name, test.errors[i], p)
+			}
+		}
+		for i, w := range warnings {
+			if w != test.warnings[i] {
+				t.Errorf("%s: expected warning %q, got %q", test.name, test.warnings[i], w)
+			}
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package simplified
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/common"
+)
+
+// RuleUpdatePlan describes the changes an update of the rules
+// would make to an Org, grouped by namespace.
+type RuleUpdatePlan struct {
+	Version     RulePackVersion                      `json:"version,omitempty"`
+	ContentHash string                               `json:"content_hash"`
+	Namespaces  map[RuleNamespace]*RuleNamespacePlan `json:"namespaces"`
+
+	// The rollout progress once the plan is applied.
+	rollout map[string]ruleRolloutEntry
+	// The changes to the rollout across the Orgs once the plan is applied.
+	rolloutUpdates map[string]ruleRolloutUpdate
+	// What the extension set on the rules once the plan is applied.
+	baselines map[string]ruleBaseline
+}
+
+var ruleUpdatePlanSchema = common.SchemaObject{
+	Fields: map[common.SchemaKey]common.SchemaElement{
+		"version": {
+			DataType:    common.SchemaDataTypes.String,
+			Description: "the version of the rules",
+			Label:       "Version",
+		},
+		"content_hash": {
+			DataType:    common.SchemaDataTypes.String,
+			Description: "the hash of the content of the rules",
+			Label:       "Content hash",
+		},
+		"namespaces": {
+			DataType:    common.SchemaDataTypes.Object,
+			Description: "the rules added, updated and deleted per namespace with the diff of their content, along with the invalid rules skipped",
+			Label:       "Changes",
+		},
+	},
+}
+
+// RuleNamespacePlan lists the rules to add, update and delete
+// within a single namespace.
+type RuleNamespacePlan struct {
+	Adds    []RuleChange `json:"adds"`
+	Updates []RuleChange `json:"updates"`
+	Deletes []RuleChange `json:"deletes"`
+	// Rules with changes held until they are promoted by the rollout.
+	Held []RuleChange `json:"held"`
+	// Rules skipped because they failed validation.
+	Invalid []RuleChange `json:"invalid"`
+}
+
+// RuleChange is a single planned change to a rule along with
+// the differences in its content.
+type RuleChange struct {
+	Name RuleName   `json:"name"`
+	Diff []RuleDiff `json:"diff,omitempty"`
+	// The resulting enabled state and tags for adds and updates.
+	Enabled *bool    `json:"enabled,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	// Changes made by users that conflict with the update.
+	Conflicts []string `json:"conflicts,omitempty"`
+	// The rule is deployed in the rollout mode until it is promoted.
+	IsStaged bool `json:"is_staged,omitempty"`
+	// The validation errors of invalid rules.
+	Errors []string `json:"errors,omitempty"`
+	// Possible problems of the rule which don't prevent its update,
+	// like ops or actions unknown to the extension.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// The mutation to apply for adds and updates.
+	mutation limacharlie.ConfigRecordMutation
+}
+
+// RuleDiff is a difference at a given path in a rule's content.
+// Old is not set for added values and New is not set for removed ones.
+type RuleDiff struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+func newRuleUpdatePlan() *RuleUpdatePlan {
+	return &RuleUpdatePlan{
+		Namespaces: map[RuleNamespace]*RuleNamespacePlan{},
+	}
+}
+
+func (p *RuleUpdatePlan) namespace(namespace RuleNamespace) *RuleNamespacePlan {
+	nsPlan, ok := p.Namespaces[namespace]
+	if !ok {
+		nsPlan = &RuleNamespacePlan{
+			Adds:    []RuleChange{},
+			Updates: []RuleChange{},
+			Deletes: []RuleChange{},
+			Held:    []RuleChange{},
+			Invalid: []RuleChange{},
+		}
+		p.Namespaces[namespace] = nsPlan
+	}
+	return nsPlan
+}
+
+// sort orders the changes by rule name so plans are stable.
+func (p *RuleUpdatePlan) sort() {
+	for _, nsPlan := range p.Namespaces {
+		for _, changes := range [][]RuleChange{nsPlan.Adds, nsPlan.Updates, nsPlan.Deletes, nsPlan.Held, nsPlan.Invalid} {
+			sort.Slice(changes, func(i, j int) bool {
+				return changes[i].Name < changes[j].Name
+			})
+		}
+	}
+}
+
+// IsEmpty returns true if the plan does not change anything.
+func (p *RuleUpdatePlan) IsEmpty() bool {
+	for _, nsPlan := range p.Namespaces {
+		if len(nsPlan.Adds) != 0 || len(nsPlan.Updates) != 0 || len(nsPlan.Deletes) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *RuleUpdatePlan) counts() syncCounts {
+	c := syncCounts{}
+	for _, nsPlan := range p.Namespaces {
+		c.adds += len(nsPlan.Adds)
+		c.updates += len(nsPlan.Updates)
+		c.deletes += len(nsPlan.Deletes)
+	}
+	c.invalid = p.invalidRuleErrors()
+	return c
+}
+
+// invalidRuleErrors describes the rules skipped because they are invalid.
+func (p *RuleUpdatePlan) invalidRuleErrors() []string {
+	errs := []string{}
+	for namespace, nsPlan := range p.Namespaces {
+		for _, c := range nsPlan.Invalid {
+			errs = append(errs, fmt.Sprintf("skipped invalid rule %s in %s: %s", c.Name, namespace, strings.Join(c.Errors, ", ")))
+		}
+	}
+	sort.Strings(errs)
+	return errs
+}
+
+// diffRules returns the list of differences between two rules.
+// Either rule can be nil, in which case all values of the other
+// one are reported as added or removed.
+func diffRules(oldRule limacharlie.Dict, newRule limacharlie.Dict) []RuleDiff {
+	diffs := []RuleDiff{}
+	diffValues("", normalizeRule(oldRule), normalizeRule(newRule), &diffs)
+	return diffs
+}
+
+// Round trip a rule through JSON so that values of different
+// Go types but with the same content compare as equal.
+func normalizeRule(rule limacharlie.Dict) interface{} {
+	norm := map[string]interface{}{}
+	if rule == nil {
+		return norm
+	}
+	b, err := json.Marshal(rule)
+	if err != nil {
+		return norm
+	}
+	if err := json.Unmarshal(b, &norm); err != nil {
+		return map[string]interface{}{}
+	}
+	return norm
+}
+
+func diffValues(path string, oldValue interface{}, newValue interface{}, diffs *[]RuleDiff) {
+	if reflect.DeepEqual(oldValue, newValue) {
+		return
+	}
+	oldMap, isOldMap := oldValue.(map[string]interface{})
+	newMap, isNewMap := newValue.(map[string]interface{})
+	if isOldMap && isNewMap {
+		keys := []string{}
+		for k := range oldMap {
+			keys = append(keys, k)
+		}
+		for k := range newMap {
+			if _, ok := oldMap[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			subPath := k
+			if path != "" {
+				subPath = fmt.Sprintf("%s.%s", path, k)
+			}
+			diffValues(subPath, oldMap[k], newMap[k], diffs)
+		}
+		return
+	}
+	oldList, isOldList := oldValue.([]interface{})
+	newList, isNewList := newValue.([]interface{})
+	if isOldList && isNewList {
+		for i := 0; i < len(oldList) || i < len(newList); i++ {
+			var o, n interface{}
+			if i < len(oldList) {
+				o = oldList[i]
+			}
+			if i < len(newList) {
+				n = newList[i]
+			}
+			diffValues(fmt.Sprintf("%s[%d]", path, i), o, n, diffs)
+		}
+		return
+	}
+	*diffs = append(*diffs, RuleDiff{
+		Path: path,
+		Old:  oldValue,
+		New:  newValue,
+	})
+}
@@ -0,0 +1,287 @@
+package simplified
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+type (
+	// CountDetectionsCallback returns the number of detections
+	// a rule generated in an Org since a given time.
+	CountDetectionsCallback = func(ctx context.Context, org *limacharlie.Organization, namespace RuleNamespace, ruleName RuleName, since time.Time) (int, error)
+	RolloutMode             = string
+)
+
+// How new and changed rules are deployed to canary Orgs before being promoted.
+var RolloutModes = struct {
+	Disabled RolloutMode
+	Test     RolloutMode
+}{
+	Disabled: "disabled", // The rules are deployed disabled.
+	// The rules only report, with a prefixed report name. Detections
+	// still go to the regular detection stream of the Org, outputs can
+	// filter them on the prefix of their category.
+	Test: "test",
+}
+
+const defaultTestReportPrefix = "test-"
+
+// RolloutPolicy stages the deployment of new and changed rules.
+// Canary Orgs get them right away in a staged mode and other Orgs
+// only get them once they are promoted.
+type RolloutPolicy struct {
+	CanaryOIDs       []string
+	Mode             RolloutMode
+	TestReportPrefix string // Optional, defaults to "test-".
+
+	// Rules are promoted once the soak period has passed since
+	// they were first staged in one of the canary Orgs.
+	SoakPeriod time.Duration
+	// Optional, rules are also promoted once they generated this
+	// many detections while staged in one of the canary Orgs.
+	PromoteAfterDetections int
+	CountDetections        CountDetectionsCallback
+
+	// Where the promotion of the rules is shared across Orgs.
+	Store RolloutStore
+}
+
+// RolloutStore keeps the rollout of each version of the rules across
+// all the Orgs, so that the promotion in the canary Orgs gates the
+// other Orgs. It must be shared by all the instances of the extension.
+type RolloutStore interface {
+	// GetRuleRollout returns the rollout of the version of a rule
+	// with the content hash, ok is false if it was never seen.
+	GetRuleRollout(ctx context.Context, namespace RuleNamespace, ruleName RuleName, contentHash string) (rollout RuleRollout, ok bool, err error)
+	// SetRuleRollout records the rollout of the version of a rule
+	// with the content hash, replacing the ones of other versions.
+	SetRuleRollout(ctx context.Context, namespace RuleNamespace, ruleName RuleName, contentHash string, rollout RuleRollout) error
+}
+
+// RuleRollout is the rollout of a version of a rule across all the Orgs.
+type RuleRollout struct {
+	FirstSeen  time.Time `json:"first_seen"`
+	IsPromoted bool      `json:"is_promoted"`
+}
+
+type rolloutStage = string
+
+var rolloutStages = struct {
+	Live   rolloutStage
+	Staged rolloutStage
+	Held   rolloutStage
+}{
+	Live:   "live",   // Deployed normally.
+	Staged: "staged", // Deployed in the rollout mode.
+	Held:   "held",   // Not deployed yet.
+}
+
+// Rollout progress of the latest version of a rule in an Org.
+type ruleRolloutEntry struct {
+	ContentHash string `json:"content_hash"`
+	// When the Org first got this version.
+	FirstSeen  int64 `json:"first_seen"`
+	IsPromoted bool  `json:"is_promoted"`
+	IsStaged   bool  `json:"is_staged"`
+}
+
+// ruleKey identifies a rule in the state of the extension.
+func ruleKey(namespace RuleNamespace, ruleName RuleName) string {
+	return fmt.Sprintf("%s/%s", namespace, ruleName)
+}
+
+func (p *RolloutPolicy) isCanary(oid string) bool {
+	return slices.Contains(p.CanaryOIDs, oid)
+}
+
+func (p *RolloutPolicy) validate() error {
+	if p.Store == nil {
+		return errors.New("a rollout policy requires a store")
+	}
+	return nil
+}
+
+// ruleRolloutUpdate is a change to the rollout of a version of a rule
+// across all the Orgs, only recorded in the store once the plan is applied.
+type ruleRolloutUpdate struct {
+	namespace   RuleNamespace
+	ruleName    RuleName
+	contentHash string
+	rollout     RuleRollout
+}
+
+// ruleStage returns the stage of a rule in an Org and updates its
+// rollout entry. It also returns whether the rule was staged before.
+// An Org without rollout entries yet gets all the rules live.
+// The store is only read, the changes to make to it are added
+// to the updates.
+func (p *RolloutPolicy) ruleStage(ctx context.Context, org *limacharlie.Organization, namespace RuleNamespace, ruleName RuleName, ruleData RuleInfo, entries map[string]ruleRolloutEntry, updates map[string]ruleRolloutUpdate, isInitial bool, now time.Time) (rolloutStage, bool, error) {
+	key := ruleKey(namespace, ruleName)
+	ruleHash := hashRuleInfo(ruleData)
+	entry, ok := entries[key]
+	if !ok || entry.ContentHash != ruleHash {
+		entry = ruleRolloutEntry{
+			ContentHash: ruleHash,
+			FirstSeen:   now.UnixMilli(),
+			IsPromoted:  isInitial,
+			IsStaged:    entry.IsStaged,
+		}
+	}
+	wasStaged := entry.IsStaged
+	isCanary := p.isCanary(org.GetOID())
+
+	var err error
+	if !entry.IsPromoted {
+		var update *RuleRollout
+		entry.IsPromoted, update, err = p.isPromoted(ctx, org, namespace, ruleName, entry, isCanary, now)
+		if update != nil {
+			updates[key] = ruleRolloutUpdate{
+				namespace:   namespace,
+				ruleName:    ruleName,
+				contentHash: entry.ContentHash,
+				rollout:     *update,
+			}
+		}
+	}
+
+	stage := rolloutStages.Live
+	if !entry.IsPromoted {
+		stage = rolloutStages.Held
+		if isCanary {
+			stage = rolloutStages.Staged
+		}
+	}
+	entry.IsStaged = stage == rolloutStages.Staged
+	entries[key] = entry
+	return stage, wasStaged, err
+}
+
+// isPromoted returns true if the version of a rule is promoted across
+// all the Orgs, along with the rollout to record if it changed. Only
+// the canary Orgs start the rollout, when they first stage the rule,
+// and promote it, the other Orgs are held until then.
+func (p *RolloutPolicy) isPromoted(ctx context.Context, org *limacharlie.Organization, namespace RuleNamespace, ruleName RuleName, entry ruleRolloutEntry, isCanary bool, now time.Time) (bool, *RuleRollout, error) {
+	rollout, ok, err := p.Store.GetRuleRollout(ctx, namespace, ruleName, entry.ContentHash)
+	if err != nil {
+		return false, nil, err
+	}
+	if ok && rollout.IsPromoted {
+		return true, nil, nil
+	}
+	if !isCanary {
+		return false, nil, nil
+	}
+	var update *RuleRollout
+	if !ok {
+		rollout = RuleRollout{FirstSeen: now}
+		update = &rollout
+	}
+	isPromoted := now.Sub(rollout.FirstSeen) >= p.SoakPeriod
+	if !isPromoted && p.PromoteAfterDetections > 0 && p.CountDetections != nil && entry.IsStaged {
+		n, err := p.CountDetections(ctx, org, namespace, ruleName, time.UnixMilli(entry.FirstSeen))
+		if err != nil {
+			return false, update, err
+		}
+		isPromoted = n >= p.PromoteAfterDetections
+	}
+	if isPromoted {
+		rollout.IsPromoted = true
+		update = &rollout
+	}
+	return isPromoted, update, nil
+}
+
+// recordRollouts records the changes to the rollout of the rules in the store.
+func (p *RolloutPolicy) recordRollouts(ctx context.Context, updates map[string]ruleRolloutUpdate) []string {
+	errs := []string{}
+	for _, u := range updates {
+		if err := p.Store.SetRuleRollout(ctx, u.namespace, u.ruleName, u.contentHash, u.rollout); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to record rollout of rule %s: %s", u.ruleName, err.Error()))
+		}
+	}
+	return errs
+}
+
+// NewMemoryRolloutStore returns a RolloutStore kept in memory, which
+// is only suitable when a single instance serves all the Orgs.
+func NewMemoryRolloutStore() RolloutStore {
+	return &memoryRolloutStore{
+		rollouts: map[string]memoryRuleRollout{},
+	}
+}
+
+type memoryRolloutStore struct {
+	sync.Mutex
+	rollouts map[string]memoryRuleRollout
+}
+
+type memoryRuleRollout struct {
+	contentHash string
+	rollout     RuleRollout
+}
+
+func (s *memoryRolloutStore) GetRuleRollout(ctx context.Context, namespace RuleNamespace, ruleName RuleName, contentHash string) (RuleRollout, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	r, ok := s.rollouts[ruleKey(namespace, ruleName)]
+	if !ok || r.contentHash != contentHash {
+		return RuleRollout{}, false, nil
+	}
+	return r.rollout, true, nil
+}
+
+func (s *memoryRolloutStore) SetRuleRollout(ctx context.Context, namespace RuleNamespace, ruleName RuleName, contentHash string, rollout RuleRollout) error {
+	s.Lock()
+	defer s.Unlock()
+	s.rollouts[ruleKey(namespace, ruleName)] = memoryRuleRollout{
+		contentHash: contentHash,
+		rollout:     rollout,
+	}
+	return nil
+}
+
+func (p *RolloutPolicy) testReportPrefix() string {
+	if p.TestReportPrefix == "" {
+		return defaultTestReportPrefix
+	}
+	return p.TestReportPrefix
+}
+
+// toTestRule only keeps the report actions of a rule,
+// prefixing the report names.
+func toTestRule(rule limacharlie.Dict, prefix string) limacharlie.Dict {
+	rs, ok := rule["respond"].([]interface{})
+	if !ok {
+		return rule
+	}
+	reports := []interface{}{}
+	for _, r := range rs {
+		r, ok := r.(map[string]interface{})
+		if !ok || r["action"] != "report" {
+			continue
+		}
+		if name, ok := r["name"].(string); ok {
+			r["name"] = prefix + name
+		}
+		reports = append(reports, r)
+	}
+	rule["respond"] = reports
+	return rule
+}
+
+// hashRuleInfo returns a hash of the content of a rule.
+func hashRuleInfo(ruleData RuleInfo) string {
+	b, err := json.Marshal(ruleData)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
@@ -0,0 +1,140 @@
+package simplified
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+func TestRolloutRuleStage(t *testing.T) {
+	canary, err := limacharlie.NewOrganizationFromClientOptions(limacharlie.ClientOptions{OID: "572d1b12-158c-4b86-87cd-554850b346cd"}, dummyLogger{})
+	if err != nil {
+		t.Fatalf("failed to create organization: %v", err)
+	}
+	other, err := limacharlie.NewOrganizationFromClientOptions(limacharlie.ClientOptions{OID: "7e41e07b-c44c-43a3-b78d-41f34204789d"}, dummyLogger{})
+	if err != nil {
+		t.Fatalf("failed to create organization: %v", err)
+	}
+	detections := 0
+	p := &RolloutPolicy{
+		CanaryOIDs:             []string{canary.GetOID()},
+		Mode:                   RolloutModes.Test,
+		SoakPeriod:             24 * time.Hour,
+		PromoteAfterDetections: 5,
+		CountDetections: func(ctx context.Context, org *limacharlie.Organization, namespace RuleNamespace, ruleName RuleName, since time.Time) (int, error) {
+			return detections, nil
+		},
+		Store: NewMemoryRolloutStore(),
+	}
+	ctx := context.Background()
+	now := time.Now()
+	v1 := RuleInfo{Data: limacharlie.Dict{"detect": limacharlie.Dict{"op": "exists"}}}
+	v2 := RuleInfo{Data: limacharlie.Dict{"detect": limacharlie.Dict{"op": "is"}}}
+	v3 := RuleInfo{Data: limacharlie.Dict{"detect": limacharlie.Dict{"op": "contains"}}}
+
+	// stage plans the rule in an Org, applying the plan unless it is a dry run.
+	stage := func(org *limacharlie.Organization, ruleData RuleInfo, entries map[string]ruleRolloutEntry, isInitial bool, at time.Time, isDryRun bool) (rolloutStage, bool) {
+		updates := map[string]ruleRolloutUpdate{}
+		stage, wasStaged, err := p.ruleStage(ctx, org, "general", "r1", ruleData, entries, updates, isInitial, at)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !isDryRun {
+			if errs := p.recordRollouts(ctx, updates); len(errs) != 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+		}
+		return stage, wasStaged
+	}
+
+	// Initial deployments are live right away.
+	entries := map[string]ruleRolloutEntry{}
+	if stage, _ := stage(canary, v1, entries, true, now, false); stage != rolloutStages.Live {
+		t.Errorf("expected initial rule to be live, got %s", stage)
+	}
+
+	canaryEntries := map[string]ruleRolloutEntry{}
+	otherEntries := map[string]ruleRolloutEntry{}
+	for k, v := range entries {
+		canaryEntries[k] = v
+		otherEntries[k] = v
+	}
+
+	// Other Orgs don't start the soak period, whichever way the
+	// time passed since they first got the rule.
+	if stage, _ := stage(other, v2, otherEntries, false, now.Add(-48*time.Hour), false); stage != rolloutStages.Held {
+		t.Errorf("expected new version to be held, got %s", stage)
+	}
+	if _, ok, _ := p.Store.GetRuleRollout(ctx, "general", "r1", hashRuleInfo(v2)); ok {
+		t.Errorf("other Orgs should not record the rollout")
+	}
+
+	// Dry runs of the canaries do not record anything either.
+	dryRunEntries := map[string]ruleRolloutEntry{}
+	for k, v := range canaryEntries {
+		dryRunEntries[k] = v
+	}
+	if stage, _ := stage(canary, v2, dryRunEntries, false, now.Add(-48*time.Hour), true); stage != rolloutStages.Staged {
+		t.Errorf("expected new version to be staged in the dry run, got %s", stage)
+	}
+	if _, ok, _ := p.Store.GetRuleRollout(ctx, "general", "r1", hashRuleInfo(v2)); ok {
+		t.Errorf("dry runs should not record the rollout")
+	}
+
+	// New versions are staged in canaries and held elsewhere.
+	if stage, _ := stage(canary, v2, canaryEntries, false, now, false); stage != rolloutStages.Staged {
+		t.Errorf("expected new version to be staged in canary, got %s", stage)
+	}
+	if stage, _ := stage(other, v2, otherEntries, false, now.Add(time.Hour), false); stage != rolloutStages.Held {
+		t.Errorf("expected new version to still be held, got %s", stage)
+	}
+
+	// Canaries promote once enough detections were seen,
+	// which promotes the rule everywhere.
+	detections = 5
+	if stage, wasStaged := stage(canary, v2, canaryEntries, false, now.Add(time.Hour), false); stage != rolloutStages.Live || !wasStaged {
+		t.Errorf("expected staged version to be promoted, got %s, %v", stage, wasStaged)
+	}
+	if stage, _ := stage(other, v2, otherEntries, false, now.Add(time.Hour), false); stage != rolloutStages.Live {
+		t.Errorf("expected new version to be live once promoted by a canary, got %s", stage)
+	}
+
+	// The soak period counts from when a canary first staged the version.
+	detections = 0
+	if stage, _ := stage(other, v3, otherEntries, false, now, false); stage != rolloutStages.Held {
+		t.Errorf("expected new version to be held, got %s", stage)
+	}
+	if stage, _ := stage(canary, v3, canaryEntries, false, now.Add(25*time.Hour), false); stage != rolloutStages.Staged {
+		t.Errorf("expected new version to be staged from its first sync in a canary, got %s", stage)
+	}
+	if stage, _ := stage(other, v3, otherEntries, false, now.Add(26*time.Hour), false); stage != rolloutStages.Held {
+		t.Errorf("expected new version to be held until a canary promotes it, got %s", stage)
+	}
+	if stage, _ := stage(canary, v3, canaryEntries, false, now.Add(49*time.Hour), false); stage != rolloutStages.Live {
+		t.Errorf("expected new version to be promoted after the soak period, got %s", stage)
+	}
+	if stage, _ := stage(other, v3, otherEntries, false, now.Add(49*time.Hour), false); stage != rolloutStages.Live {
+		t.Errorf("expected new version to be live once promoted, got %s", stage)
+	}
+
+	if err := (&RolloutPolicy{}).validate(); err == nil {
+		t.Errorf("expected an error without a store")
+	}
+}
+
+func TestToTestRule(t *testing.T) {
+	d := limacharlie.Dict{}
+	if err := json.Unmarshal([]byte(`{"respond":[{"action":"report","name":"XXX"},{"action":"isolate network"}]}`), &d); err != nil {
+		panic(err)
+	}
+
+	final := fmt.Sprintf("%v", toTestRule(d, "test-"))
+	expected := `map[respond:[map[action:report name:test-XXX]]]`
+	if final != expected {
+		t.Errorf("unexpected test rule: %s\n!=\n%s", final, expected)
+	}
+}
@@ -21,3 +21,66 @@ func TestSuppression(t *testing.T) {
 		t.Errorf("unexpected suppression: %s\n!=\n%s", final, expected)
 	}
 }
+
+func TestDiffRules(t *testing.T) {
+	oldRule := limacharlie.Dict{}
+	newRule := limacharlie.Dict{}
+	if err := json.Unmarshal([]byte(`{"detect":{"op":"is","path":"event/FILE_PATH","value":"a.exe"},"respond":[{"action":"report","name":"XXX"}]}`), &oldRule); err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal([]byte(`{"detect":{"op":"is","path":"event/FILE_PATH","value":"b.exe"},"respond":[{"action":"report","name":"XXX"},{"action":"add tag","tag":"yyy"}]}`), &newRule); err != nil {
+		panic(err)
+	}
+
+	final := fmt.Sprintf("%v", diffRules(oldRule, newRule))
+	expected := `[{detect.value a.exe b.exe} {respond[1] <nil> map[action:add tag tag:yyy]}]`
+	if final != expected {
+		t.Errorf("unexpected diff: %s\n!=\n%s", final, expected)
+	}
+
+	if d := diffRules(oldRule, oldRule); len(d) != 0 {
+		t.Errorf("unexpected diff for identical rules: %v", d)
+	}
+
+	final = fmt.Sprintf("%v", diffRules(nil, limacharlie.Dict{"detect": limacharlie.Dict{"op": "exists"}}))
+	expected = `[{detect <nil> map[op:exists]}]`
+	if final != expected {
+		t.Errorf("unexpected diff for new rule: %s\n!=\n%s", final, expected)
+	}
+}
+
+func TestSuppressionPolicy(t *testing.T) {
+	a := []byte(`{"respond":[{"action":"report", "name": "XXX"},{"action":"add tag", "tag": "YYY"}]}`)
+	d := limacharlie.Dict{}
+	if err := json.Unmarshal(a, &d); err != nil {
+		panic(err)
+	}
+
+	final := fmt.Sprintf("%#v", addSuppressionPolicy(d, suppressionPolicy{
+		Period:   "30m",
+		MinCount: 3,
+		MaxCount: 5,
+		IsGlobal: true,
+		Keys:     []string{"sensor", "event/FILE_PATH", "{{ .event.USER_NAME }}"},
+	}))
+	expected := `limacharlie.Dict{"respond":[]interface {}{map[string]interface {}{"action":"report", "name":"XXX", "suppression":limacharlie.Dict{"is_global":true, "keys":[]string{"XXX", "{{ .routing.sid }}", "{{ .event.FILE_PATH }}", "{{ .event.USER_NAME }}"}, "max_count":5, "min_count":3, "period":"30m"}}, map[string]interface {}{"action":"add tag", "tag":"YYY"}}}`
+	if final != expected {
+		t.Errorf("unexpected suppression: %s\n!=\n%s", final, expected)
+	}
+}
+
+func TestRuleUpdatePlanCounts(t *testing.T) {
+	p := newRuleUpdatePlan()
+	p.namespace("general").Adds = []RuleChange{{Name: "r1"}, {Name: "r2"}}
+	p.namespace("managed").Updates = []RuleChange{{Name: "r3"}}
+	p.namespace("managed").Deletes = []RuleChange{{Name: "r4"}}
+	p.namespace("general").Invalid = []RuleChange{{Name: "r5", Errors: []string{"missing detect", "missing respond"}}}
+
+	if c := p.counts(); c.adds != 2 || c.updates != 1 || c.deletes != 1 || len(c.invalid) != 1 {
+		t.Errorf("unexpected counts: %+v", c)
+	}
+	errs := p.invalidRuleErrors()
+	if len(errs) != 1 || errs[0] != "skipped invalid rule r5 in general: missing detect, missing respond" {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
@@ -0,0 +1,326 @@
+package simplified
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/common"
+	"github.com/refractionPOINT/lc-extension/core"
+)
+
+type (
+	// GetRulePackCallback returns the rule pack at a given
+	// version, or the latest one if the version is empty.
+	GetRulePackCallback = func(ctx context.Context, version RulePackVersion) (RulePack, error)
+	RulePackVersion     = string
+	RulePack            struct {
+		Version RulePackVersion
+		Rules   RuleData
+	}
+)
+
+// Version to roll back to in order to resume getting the latest rules.
+const latestRulePackVersion = "latest"
+
+// Number of previously applied rule packs kept per Org.
+const maxRulePackHistory = 10
+
+// RulePackState is the rule pack applied to an Org.
+type RulePackState struct {
+	AppliedVersion RulePackVersion `json:"applied_version"`
+	ContentHash    string          `json:"content_hash"`
+	AppliedAt      int64           `json:"applied_at"`
+	// Version the Org is held at following a rollback.
+	HeldVersion RulePackVersion `json:"held_version,omitempty"`
+	// Previously applied rule packs, most recent first.
+	History []RulePackHistoryEntry `json:"history"`
+	// Rollout progress of the latest version of the rules, by rule.
+	Rollout map[string]ruleRolloutEntry `json:"-"`
+	// Enabled state and tags last set on each rule, by rule.
+	Baselines map[string]ruleBaseline `json:"-"`
+}
+
+// ruleNamespaceState is the state of the rules of a namespace, kept
+// in a record of its own so that a record only grows with the rules
+// of its namespace.
+type ruleNamespaceState struct {
+	Rollout   map[RuleName]ruleRolloutEntry `json:"rollout"`
+	Baselines map[RuleName]ruleBaseline     `json:"baselines"`
+}
+
+type RulePackHistoryEntry struct {
+	Version     RulePackVersion `json:"version"`
+	ContentHash string          `json:"content_hash"`
+	AppliedAt   int64           `json:"applied_at"`
+}
+
+type ruleRollbackRequest struct {
+	Version RulePackVersion `json:"version"`
+	DryRun  bool            `json:"dry_run"`
+}
+
+type ruleStatusRequest struct{}
+
+type ruleStatusResponse struct {
+	RulePack      RulePackState   `json:"rule_pack"`
+	PinnedVersion RulePackVersion `json:"pinned_version,omitempty"`
+	Sync          SyncStatus      `json:"sync"`
+}
+
+func (l *RuleExtension) stateRecordName() string {
+	return stateRecordName(l.Name, "rules-state")
+}
+
+func (l *RuleExtension) namespaceStateRecordName(namespace RuleNamespace) string {
+	return stateRecordName(l.Name, "rules-state-"+namespace)
+}
+
+// stateRecordNames returns the names of all the state records of the rules.
+func (l *RuleExtension) stateRecordNames() []string {
+	names := []string{l.stateRecordName(), l.syncStatusRecordName()}
+	for namespace := range simplifiedRuleNamespaces {
+		names = append(names, l.namespaceStateRecordName(namespace))
+	}
+	return names
+}
+
+func (l *RuleExtension) syncStatusRecordName() string {
+	return stateRecordName(l.Name, "sync-status")
+}
+
+// recordSyncStatus records the outcome of an update, the plan
+// being nil if the update failed before applying it.
+func (l *RuleExtension) recordSyncStatus(org *limacharlie.Organization, plan *RuleUpdatePlan, errs []string) {
+	counts := syncCounts{}
+	if plan != nil {
+		counts = plan.counts()
+	}
+	if _, err := recordSyncStatus(org, l.syncStatusRecordName(), l.tag, counts, errs); err != nil {
+		l.Logger.Error(fmt.Sprintf("failed to record sync status: %s", err.Error()))
+	}
+}
+
+// getRulePack returns the rules at a given version, or the latest
+// rules if the version is empty.
+func (l *RuleExtension) getRulePack(ctx context.Context, version RulePackVersion) (RulePack, error) {
+	if l.GetRulePack != nil {
+		return l.GetRulePack(ctx, version)
+	}
+	if version != "" {
+		return RulePack{}, fmt.Errorf("cannot get version %s of the rules, versions are not supported", version)
+	}
+	rules, err := l.GetRules(ctx)
+	if err != nil {
+		return RulePack{}, err
+	}
+	return RulePack{Rules: rules}, nil
+}
+
+// targetVersion is the version of the rules an Org should be on,
+// an empty version meaning the latest.
+func (l *RuleExtension) targetVersion(config ruleConfig, state RulePackState) RulePackVersion {
+	if config.PinnedVersion != "" {
+		return config.PinnedVersion
+	}
+	return state.HeldVersion
+}
+
+func (l *RuleExtension) loadRulePackState(org *limacharlie.Organization) (RulePackState, error) {
+	state := RulePackState{
+		History: []RulePackHistoryEntry{},
+	}
+	if err := loadState(org, l.stateRecordName(), &state); err != nil {
+		return state, err
+	}
+	for namespace := range simplifiedRuleNamespaces {
+		nsState := ruleNamespaceState{}
+		if err := loadState(org, l.namespaceStateRecordName(namespace), &nsState); err != nil {
+			return state, err
+		}
+		state.addNamespaceState(namespace, nsState)
+	}
+	return state, nil
+}
+
+// namespaceState returns the state of the rules of a namespace.
+func (s RulePackState) namespaceState(namespace RuleNamespace) ruleNamespaceState {
+	nsState := ruleNamespaceState{}
+	if s.Rollout != nil {
+		nsState.Rollout = map[RuleName]ruleRolloutEntry{}
+	}
+	for k, entry := range s.Rollout {
+		if ns, ruleName, _ := strings.Cut(k, "/"); ns == namespace {
+			nsState.Rollout[ruleName] = entry
+		}
+	}
+	if s.Baselines != nil {
+		nsState.Baselines = map[RuleName]ruleBaseline{}
+	}
+	for k, base := range s.Baselines {
+		if ns, ruleName, _ := strings.Cut(k, "/"); ns == namespace {
+			nsState.Baselines[ruleName] = base
+		}
+	}
+	return nsState
+}
+
+// addNamespaceState adds the state of the rules of a namespace. Without
+// any rollout entry in any namespace, the Rollout stays nil.
+func (s *RulePackState) addNamespaceState(namespace RuleNamespace, nsState ruleNamespaceState) {
+	if nsState.Rollout != nil && s.Rollout == nil {
+		s.Rollout = map[string]ruleRolloutEntry{}
+	}
+	for ruleName, entry := range nsState.Rollout {
+		s.Rollout[ruleKey(namespace, ruleName)] = entry
+	}
+	if nsState.Baselines != nil && s.Baselines == nil {
+		s.Baselines = map[string]ruleBaseline{}
+	}
+	for ruleName, base := range nsState.Baselines {
+		s.Baselines[ruleKey(namespace, ruleName)] = base
+	}
+}
+
+// saveRulePackState persists the state, the rollout and
+// baselines of the rules being split by namespace.
+func (l *RuleExtension) saveRulePackState(org *limacharlie.Organization, state RulePackState) error {
+	for namespace := range simplifiedRuleNamespaces {
+		if err := saveState(org, l.namespaceStateRecordName(namespace), l.tag, state.namespaceState(namespace)); err != nil {
+			return err
+		}
+	}
+	return saveState(org, l.stateRecordName(), l.tag, state)
+}
+
+// recordApplied updates and persists the state once a plan is applied.
+func (l *RuleExtension) recordApplied(org *limacharlie.Organization, state RulePackState, plan *RuleUpdatePlan) error {
+	now := time.Now().UnixMilli()
+	if plan.Version != state.AppliedVersion || plan.ContentHash != state.ContentHash || len(state.History) == 0 {
+		state.History = append([]RulePackHistoryEntry{{
+			Version:     plan.Version,
+			ContentHash: plan.ContentHash,
+			AppliedAt:   now,
+		}}, state.History...)
+		if len(state.History) > maxRulePackHistory {
+			state.History = state.History[:maxRulePackHistory]
+		}
+	}
+	state.AppliedVersion = plan.Version
+	state.ContentHash = plan.ContentHash
+	if plan.rollout != nil {
+		state.Rollout = plan.rollout
+	}
+	if plan.baselines != nil {
+		state.Baselines = plan.baselines
+	}
+	state.AppliedAt = now
+	return l.saveRulePackState(org, state)
+}
+
+func (l *RuleExtension) onGetStatus(ctx context.Context, params core.RequestCallbackParams) common.Response {
+	config := ruleConfig{}
+	if err := params.Config.UnMarshalToStruct(&config); err != nil {
+		return common.Response{Error: err.Error()}
+	}
+	state, err := l.loadRulePackState(params.Org)
+	if err != nil {
+		return common.Response{Error: err.Error()}
+	}
+	status, err := loadSyncStatus(params.Org, l.syncStatusRecordName())
+	if err != nil {
+		return common.Response{Error: err.Error()}
+	}
+	return common.Response{Data: ruleStatusResponse{
+		RulePack:      state,
+		PinnedVersion: config.PinnedVersion,
+		Sync:          status,
+	}}
+}
+
+func (l *RuleExtension) onRollback(ctx context.Context, params core.RequestCallbackParams) common.Response {
+	request := params.Request.(*ruleRollbackRequest)
+
+	if l.GetRulePack == nil {
+		return common.Response{Error: "rollback is not supported, the rules are not versioned", Retriable: Bool(false)}
+	}
+
+	config := ruleConfig{}
+	if err := params.Config.UnMarshalToStruct(&config); err != nil {
+		return common.Response{Error: err.Error()}
+	}
+	if config.PinnedVersion != "" {
+		return common.Response{Error: fmt.Sprintf("the rules are pinned to version %s in the config", config.PinnedVersion), Retriable: Bool(false)}
+	}
+
+	state, err := l.loadRulePackState(params.Org)
+	if err != nil {
+		return common.Response{Error: err.Error()}
+	}
+
+	version, err := rollbackVersion(state, request.Version)
+	if err != nil {
+		return common.Response{Error: err.Error(), Retriable: Bool(false)}
+	}
+
+	plan, err := l.planUpdate(ctx, params.Org, config, state, version)
+	if err != nil {
+		if !request.DryRun {
+			l.recordSyncStatus(params.Org, nil, []string{err.Error()})
+		}
+		return common.Response{Error: err.Error()}
+	}
+	if request.DryRun {
+		return common.Response{Data: plan}
+	}
+	opErrors, err := l.applyPlan(ctx, params.Org, plan)
+	if err != nil {
+		l.recordSyncStatus(params.Org, nil, []string{err.Error()})
+		return common.Response{Error: err.Error()}
+	}
+	l.recordSyncStatus(params.Org, plan, opErrors)
+
+	// Hold the Org at this version so the recurring
+	// updates don't bring back the latest rules.
+	state.HeldVersion = version
+	if err := l.recordApplied(params.Org, state, plan); err != nil {
+		l.Logger.Error(fmt.Sprintf("failed to record rules state: %s", err.Error()))
+		return common.Response{Error: err.Error()}
+	}
+
+	l.Logger.Info(fmt.Sprintf("rolled back rules of %s to version %q", params.Org.GetOID(), version))
+
+	return common.Response{Data: plan}
+}
+
+// rollbackVersion returns the version to roll back to given the one
+// requested, defaulting to the version applied before the current one.
+func rollbackVersion(state RulePackState, requested RulePackVersion) (RulePackVersion, error) {
+	if requested == latestRulePackVersion {
+		return "", nil
+	}
+	if requested != "" {
+		return requested, nil
+	}
+	for _, h := range state.History {
+		if h.Version != state.AppliedVersion && h.Version != "" {
+			return h.Version, nil
+		}
+	}
+	return "", errors.New("no previous version to roll back to")
+}
+
+// hashRuleData returns a hash of the content of the rules.
+func hashRuleData(rules RuleData) string {
+	// Map keys are sorted when serialized so the hash is stable.
+	b, err := json.Marshal(rules)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
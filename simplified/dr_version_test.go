@@ -0,0 +1,98 @@
+package simplified
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+func TestRollbackVersion(t *testing.T) {
+	state := RulePackState{
+		AppliedVersion: "v3",
+		History: []RulePackHistoryEntry{
+			{Version: "v3", ContentHash: "c"},
+			{Version: "v3", ContentHash: "b"},
+			{Version: "v2", ContentHash: "a"},
+		},
+	}
+
+	tests := []struct {
+		requested RulePackVersion
+		expected  RulePackVersion
+	}{
+		{"", "v2"},
+		{"v1", "v1"},
+		{latestRulePackVersion, ""},
+	}
+	for _, tt := range tests {
+		v, err := rollbackVersion(state, tt.requested)
+		if err != nil {
+			t.Errorf("rollbackVersion(%q) failed: %v", tt.requested, err)
+		}
+		if v != tt.expected {
+			t.Errorf("rollbackVersion(%q) = %q; want %q", tt.requested, v, tt.expected)
+		}
+	}
+
+	if _, err := rollbackVersion(RulePackState{AppliedVersion: "v1", History: []RulePackHistoryEntry{{Version: "v1"}}}, ""); err == nil {
+		t.Errorf("expected an error without a previous version")
+	}
+}
+
+func TestHashRuleData(t *testing.T) {
+	r1 := RuleData{"general": {
+		"r1": {Tags: []string{"t1"}, Data: limacharlie.Dict{"detect": limacharlie.Dict{"op": "exists", "path": "event"}}},
+		"r2": {Data: limacharlie.Dict{"detect": limacharlie.Dict{"op": "is", "value": 1}}},
+	}}
+	r2 := RuleData{"general": {
+		"r2": {Data: limacharlie.Dict{"detect": limacharlie.Dict{"value": 1, "op": "is"}}},
+		"r1": {Tags: []string{"t1"}, Data: limacharlie.Dict{"detect": limacharlie.Dict{"path": "event", "op": "exists"}}},
+	}}
+	if hashRuleData(r1) != hashRuleData(r2) {
+		t.Errorf("expected identical rules to have the same hash")
+	}
+	r2["general"]["r2"].Data["detect"].(limacharlie.Dict)["value"] = 2
+	if hashRuleData(r1) == hashRuleData(r2) {
+		t.Errorf("expected different rules to have different hashes")
+	}
+}
+
+func TestRulePackNamespaceState(t *testing.T) {
+	state := RulePackState{
+		Rollout: map[string]ruleRolloutEntry{
+			"general/r1": {ContentHash: "a"},
+			"managed/r2": {ContentHash: "b"},
+		},
+		Baselines: map[string]ruleBaseline{
+			"general/r1": {Enabled: true},
+		},
+	}
+	general := state.namespaceState("general")
+	if len(general.Rollout) != 1 || general.Rollout["r1"].ContentHash != "a" || !general.Baselines["r1"].Enabled {
+		t.Errorf("unexpected state of the namespace: %+v", general)
+	}
+	service := state.namespaceState("service")
+	if service.Rollout == nil || len(service.Rollout) != 0 || len(service.Baselines) != 0 {
+		t.Errorf("expected an empty state for the namespace: %+v", service)
+	}
+
+	loaded := RulePackState{}
+	for namespace := range simplifiedRuleNamespaces {
+		loaded.addNamespaceState(namespace, state.namespaceState(namespace))
+	}
+	if len(loaded.Rollout) != 2 || loaded.Rollout["managed/r2"].ContentHash != "b" || len(loaded.Baselines) != 1 {
+		t.Errorf("unexpected state: %+v", loaded)
+	}
+
+	// Orgs without rollout entries yet stay without them.
+	loaded = RulePackState{}
+	loaded.addNamespaceState("general", RulePackState{}.namespaceState("general"))
+	if loaded.Rollout != nil || loaded.Baselines != nil {
+		t.Errorf("expected no rollout entries: %+v", loaded)
+	}
+
+	if _, err := marshalState("big", map[string]string{"data": strings.Repeat("a", maxStateSize)}); err == nil {
+		t.Errorf("expected an error for a state too large")
+	}
+}
@@ -0,0 +1,300 @@
+package simplified
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ParsePlainTextFeed parses a feed with one indicator per line,
+// ignoring empty lines and comments starting with "#".
+func ParsePlainTextFeed(r io.Reader) ([]Indicator, error) {
+	indicators := []Indicator{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if ind, ok := newIndicator("", line, nil); ok {
+			indicators = append(indicators, ind)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return indicators, nil
+}
+
+// CSVFeedOptions describes the columns of a CSV feed with a header row.
+type CSVFeedOptions struct {
+	ValueColumn string
+	TypeColumn  string // Optional, the type is detected from the value if not set.
+	// Optional, columns kept as metadata, all the other columns if not set.
+	MetadataColumns []string
+	Comma           rune // Optional, defaults to ",".
+}
+
+// NewCSVFeedParser returns a parser for CSV feeds.
+func NewCSVFeedParser(opts CSVFeedOptions) FeedParser {
+	return func(r io.Reader) ([]Indicator, error) {
+		cr := csv.NewReader(r)
+		cr.Comment = '#'
+		cr.FieldsPerRecord = -1
+		cr.TrimLeadingSpace = true
+		if opts.Comma != 0 {
+			cr.Comma = opts.Comma
+		}
+		header, err := cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read header: %s", err.Error())
+		}
+		for i, h := range header {
+			header[i] = strings.TrimSpace(h)
+		}
+		valueIndex := slices.Index(header, opts.ValueColumn)
+		if valueIndex == -1 {
+			return nil, fmt.Errorf("missing value column %q", opts.ValueColumn)
+		}
+		typeIndex := -1
+		if opts.TypeColumn != "" {
+			if typeIndex = slices.Index(header, opts.TypeColumn); typeIndex == -1 {
+				return nil, fmt.Errorf("missing type column %q", opts.TypeColumn)
+			}
+		}
+
+		indicators := []Indicator{}
+		for {
+			row, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if valueIndex >= len(row) {
+				continue
+			}
+			indicatorType := ""
+			if typeIndex != -1 && typeIndex < len(row) {
+				indicatorType = normalizeIndicatorType(row[typeIndex])
+			}
+			mtd := map[string]interface{}{}
+			for i, h := range header {
+				if i == valueIndex || i == typeIndex || i >= len(row) || row[i] == "" {
+					continue
+				}
+				if len(opts.MetadataColumns) != 0 && !slices.Contains(opts.MetadataColumns, h) {
+					continue
+				}
+				mtd[h] = row[i]
+			}
+			if ind, ok := newIndicator(indicatorType, row[valueIndex], mtd); ok {
+				indicators = append(indicators, ind)
+			}
+		}
+		return indicators, nil
+	}
+}
+
+// normalizeIndicatorType maps common names of indicator types to
+// ours, defaulting to an empty type to detect it from the value.
+func normalizeIndicatorType(t string) IndicatorType {
+	switch strings.ToLower(strings.TrimSpace(t)) {
+	case "ip", "ipv4", "ipv6", "ip-src", "ip-dst", "ipv4-addr", "ipv6-addr":
+		return IndicatorTypes.IP
+	case "cidr", "subnet", "network":
+		return IndicatorTypes.CIDR
+	case "domain", "hostname", "fqdn", "domain-name":
+		return IndicatorTypes.Domain
+	case "hash", "md5", "sha1", "sha256", "sha512", "sha-1", "sha-256", "sha-512", "filehash":
+		return IndicatorTypes.Hash
+	case "url", "uri", "link":
+		return IndicatorTypes.URL
+	}
+	return ""
+}
+
+// Comparisons of a STIX pattern like "[ipv4-addr:value = '1.2.3.4']".
+var stixComparisonRegex = regexp.MustCompile(`([a-z0-9-]+):([A-Za-z0-9_.'-]+)\s*=\s*'((?:[^'\\]|\\.)*)'`)
+
+var stixObjectTypes = map[string]IndicatorType{
+	"ipv4-addr":   IndicatorTypes.IP,
+	"ipv6-addr":   IndicatorTypes.IP,
+	"domain-name": IndicatorTypes.Domain,
+	"url":         IndicatorTypes.URL,
+	"file":        IndicatorTypes.Hash,
+}
+
+// ParseSTIXFeed parses a STIX 2.1 bundle, extracting the indicators
+// from the equality comparisons in the patterns of its indicator objects.
+func ParseSTIXFeed(r io.Reader) ([]Indicator, error) {
+	bundle := struct {
+		Type    string                   `json:"type"`
+		Objects []map[string]interface{} `json:"objects"`
+	}{}
+	if err := json.NewDecoder(r).Decode(&bundle); err != nil {
+		return nil, err
+	}
+	if bundle.Type != "bundle" {
+		return nil, errors.New("not a STIX bundle")
+	}
+
+	indicators := []Indicator{}
+	for _, o := range bundle.Objects {
+		if o["type"] != "indicator" {
+			continue
+		}
+		if t, _ := o["pattern_type"].(string); t != "" && t != "stix" {
+			continue
+		}
+		pattern, _ := o["pattern"].(string)
+		mtd := map[string]interface{}{}
+		for _, k := range []string{"id", "name", "description", "confidence", "labels", "indicator_types", "valid_from", "valid_until"} {
+			if v, ok := o[k]; ok {
+				mtd[k] = v
+			}
+		}
+		// Stop matching the indicator once it is no longer valid.
+		if v, ok := o["valid_until"]; ok {
+			mtd[LookupEntryExpiresAt] = v
+		}
+		for _, m := range stixComparisonRegex.FindAllStringSubmatch(pattern, -1) {
+			indicatorType, ok := stixObjectTypes[m[1]]
+			if !ok {
+				continue
+			}
+			// Only hashes are supported for files.
+			if m[1] == "file" && !strings.HasPrefix(m[2], "hashes.") {
+				continue
+			}
+			value := strings.ReplaceAll(m[3], `\'`, `'`)
+			if ind, ok := newIndicator(indicatorType, value, copyMetadata(mtd)); ok {
+				indicators = append(indicators, ind)
+			}
+		}
+	}
+	return indicators, nil
+}
+
+type mispAttribute struct {
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	Category string `json:"category"`
+	Comment  string `json:"comment"`
+	ToIDS    bool   `json:"to_ids"`
+}
+
+type mispEvent struct {
+	UUID      string          `json:"uuid"`
+	Info      string          `json:"info"`
+	Attribute []mispAttribute `json:"Attribute"`
+	Object    []struct {
+		Attribute []mispAttribute `json:"Attribute"`
+	} `json:"Object"`
+}
+
+// ParseMISPFeed parses a MISP JSON export, either a single event,
+// a list of events or the response of a search, only keeping
+// the attributes flagged for detection.
+func ParseMISPFeed(r io.Reader) ([]Indicator, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	type wrapper struct {
+		Event mispEvent `json:"Event"`
+	}
+	wrappers := []wrapper{}
+	if b = bytes.TrimSpace(b); len(b) != 0 && b[0] == '[' {
+		if err := json.Unmarshal(b, &wrappers); err != nil {
+			return nil, err
+		}
+	} else {
+		export := struct {
+			Response []wrapper  `json:"response"`
+			Event    *mispEvent `json:"Event"`
+		}{}
+		if err := json.Unmarshal(b, &export); err != nil {
+			return nil, err
+		}
+		wrappers = export.Response
+		if export.Event != nil {
+			wrappers = append(wrappers, wrapper{Event: *export.Event})
+		}
+	}
+
+	indicators := []Indicator{}
+	for _, w := range wrappers {
+		attributes := append([]mispAttribute{}, w.Event.Attribute...)
+		for _, o := range w.Event.Object {
+			attributes = append(attributes, o.Attribute...)
+		}
+		for _, a := range attributes {
+			if !a.ToIDS {
+				continue
+			}
+			indicatorType, value := mispIndicator(a.Type, a.Value)
+			if indicatorType == "" {
+				continue
+			}
+			mtd := map[string]interface{}{
+				"event":    w.Event.Info,
+				"event_id": w.Event.UUID,
+				"category": a.Category,
+			}
+			if a.Comment != "" {
+				mtd["comment"] = a.Comment
+			}
+			if ind, ok := newIndicator(indicatorType, value, mtd); ok {
+				indicators = append(indicators, ind)
+			}
+		}
+	}
+	return indicators, nil
+}
+
+// mispIndicator returns the indicator type and value of a MISP attribute,
+// or an empty type if it is not supported.
+func mispIndicator(attributeType string, value string) (IndicatorType, string) {
+	// Composite attributes like "ip-dst|port" or "filename|sha256".
+	if base, second, ok := strings.Cut(attributeType, "|"); ok {
+		v1, v2, _ := strings.Cut(value, "|")
+		switch {
+		case base == "ip-src" || base == "ip-dst":
+			return IndicatorTypes.IP, v1
+		case base == "domain" || base == "hostname":
+			return IndicatorTypes.Domain, v1
+		case base == "filename" && normalizeIndicatorType(second) == IndicatorTypes.Hash:
+			return IndicatorTypes.Hash, v2
+		}
+		return "", ""
+	}
+	switch attributeType {
+	case "ip-src", "ip-dst":
+		return IndicatorTypes.IP, value
+	case "domain", "hostname":
+		return IndicatorTypes.Domain, value
+	case "url", "uri", "link":
+		return IndicatorTypes.URL, value
+	case "md5", "sha1", "sha256", "sha512":
+		return IndicatorTypes.Hash, value
+	}
+	return "", ""
+}
+
+func copyMetadata(mtd map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(mtd))
+	for k, v := range mtd {
+		res[k] = v
+	}
+	return res
+}
@@ -0,0 +1,221 @@
+package simplified
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type IndicatorType = string
+
+// Types of indicators, each going to its own lookup.
+var IndicatorTypes = struct {
+	IP     IndicatorType
+	CIDR   IndicatorType
+	Domain IndicatorType
+	Hash   IndicatorType
+	URL    IndicatorType
+}{
+	IP:     "ip",
+	CIDR:   "cidr",
+	Domain: "domain",
+	Hash:   "hash",
+	URL:    "url",
+}
+
+// Indicator is a single entry of a threat intel feed.
+type Indicator struct {
+	Type     IndicatorType
+	Value    string
+	Metadata map[string]interface{}
+}
+
+// FeedParser turns the content of a feed into indicators.
+type FeedParser = func(r io.Reader) ([]Indicator, error)
+
+// Feed is a threat intel feed to fetch over HTTP.
+type Feed struct {
+	Name    string // Prefix of the lookup names, like "<name>-ip".
+	URL     string
+	Headers map[string]string // Optional, like an API key.
+	Parser  FeedParser
+	MaxSize int64 // Optional, maximum size of the feed in bytes, defaults to 64MB.
+}
+
+const (
+	feedFetchTimeout   = 2 * time.Minute
+	defaultMaxFeedSize = 64 * 1024 * 1024
+)
+
+var (
+	hashRegex   = regexp.MustCompile(`^([a-fA-F0-9]{32}|[a-fA-F0-9]{40}|[a-fA-F0-9]{64}|[a-fA-F0-9]{128})$`)
+	domainRegex = regexp.MustCompile(`^([a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9_])?\.)+[a-zA-Z][a-zA-Z0-9-]{0,62}$`)
+)
+
+// DetectIndicatorType returns the type of an indicator value,
+// or an empty type if it is not recognized.
+func DetectIndicatorType(value string) IndicatorType {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "://") {
+		return IndicatorTypes.URL
+	}
+	if net.ParseIP(value) != nil {
+		return IndicatorTypes.IP
+	}
+	if _, _, err := net.ParseCIDR(value); err == nil {
+		return IndicatorTypes.CIDR
+	}
+	if hashRegex.MatchString(value) {
+		return IndicatorTypes.Hash
+	}
+	if domainRegex.MatchString(strings.TrimSuffix(value, ".")) {
+		return IndicatorTypes.Domain
+	}
+	return ""
+}
+
+// normalizeIndicator returns the value of an indicator in the
+// form it is looked up in, or an empty string if it is invalid.
+func normalizeIndicator(indicatorType IndicatorType, value string) string {
+	value = strings.TrimSpace(value)
+	switch indicatorType {
+	case IndicatorTypes.IP:
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return ""
+		}
+		return ip.String()
+	case IndicatorTypes.CIDR:
+		_, n, err := net.ParseCIDR(value)
+		if err != nil {
+			return ""
+		}
+		return n.String()
+	case IndicatorTypes.Domain:
+		value = strings.ToLower(strings.TrimSuffix(value, "."))
+		if !domainRegex.MatchString(value) {
+			return ""
+		}
+		return value
+	case IndicatorTypes.Hash:
+		if !hashRegex.MatchString(value) {
+			return ""
+		}
+		return strings.ToLower(value)
+	case IndicatorTypes.URL:
+		return value
+	}
+	return ""
+}
+
+// newIndicator returns the indicator for a value, detecting its
+// type if not provided. It returns false if the value is invalid.
+func newIndicator(indicatorType IndicatorType, value string, metadata map[string]interface{}) (Indicator, bool) {
+	if indicatorType == "" {
+		indicatorType = DetectIndicatorType(value)
+	}
+	if indicatorType == IndicatorTypes.IP && strings.Contains(value, "/") {
+		indicatorType = IndicatorTypes.CIDR
+	}
+	value = normalizeIndicator(indicatorType, value)
+	if value == "" {
+		return Indicator{}, false
+	}
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	return Indicator{
+		Type:     indicatorType,
+		Value:    value,
+		Metadata: metadata,
+	}, true
+}
+
+// IndicatorsToLookupData groups the indicators by type into lookups
+// named "<name>-<type>", with the metadata of each indicator as the
+// value of its entry. Metadata of duplicate indicators are merged.
+func IndicatorsToLookupData(name string, indicators []Indicator) LookupData {
+	data := LookupData{}
+	for _, ind := range indicators {
+		luName := fmt.Sprintf("%s-%s", name, ind.Type)
+		lu, ok := data[luName].(map[string]interface{})
+		if !ok {
+			lu = map[string]interface{}{}
+			data[luName] = lu
+		}
+		mtd, ok := lu[ind.Value].(map[string]interface{})
+		if !ok {
+			mtd = map[string]interface{}{}
+			lu[ind.Value] = mtd
+		}
+		for k, v := range ind.Metadata {
+			mtd[k] = v
+		}
+	}
+	return data
+}
+
+func (f Feed) maxSize() int64 {
+	if f.MaxSize <= 0 {
+		return defaultMaxFeedSize
+	}
+	return f.MaxSize
+}
+
+// FetchFeed gets and parses a feed, failing if it is larger than its maximum size.
+func FetchFeed(ctx context.Context, feed Feed) ([]Indicator, error) {
+	ctx, cancel := context.WithTimeout(ctx, feedFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feed.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range feed.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch feed %s: %s", feed.Name, resp.Status)
+	}
+	maxSize := feed.maxSize()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch feed %s: %s", feed.Name, err.Error())
+	}
+	if int64(len(body)) > maxSize {
+		return nil, fmt.Errorf("feed %s is larger than %d bytes", feed.Name, maxSize)
+	}
+	indicators, err := feed.Parser(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse feed %s: %s", feed.Name, err.Error())
+	}
+	return indicators, nil
+}
+
+// NewFeedLookupCallback returns a GetLookupCallback generating
+// the lookups from the indicators of the feeds.
+func NewFeedLookupCallback(feeds ...Feed) GetLookupCallback {
+	return func(ctx context.Context) (LookupData, error) {
+		data := LookupData{}
+		for _, feed := range feeds {
+			indicators, err := FetchFeed(ctx, feed)
+			if err != nil {
+				return nil, err
+			}
+			for k, v := range IndicatorsToLookupData(feed.Name, indicators) {
+				data[k] = v
+			}
+		}
+		return data, nil
+	}
+}
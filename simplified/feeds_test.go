@@ -0,0 +1,149 @@
+package simplified
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func parseFixture(t *testing.T, name string, parser FeedParser) []Indicator {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "feeds", name))
+	if err != nil {
+		t.Fatalf("failed to open fixture: %v", err)
+	}
+	defer f.Close()
+	indicators, err := parser(f)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", name, err)
+	}
+	return indicators
+}
+
+// indicatorValues returns the values of the indicators by type.
+func indicatorValues(indicators []Indicator) map[IndicatorType][]string {
+	res := map[IndicatorType][]string{}
+	for _, ind := range indicators {
+		res[ind.Type] = append(res[ind.Type], ind.Value)
+	}
+	return res
+}
+
+func TestParsePlainTextFeed(t *testing.T) {
+	indicators := parseFixture(t, "list.txt", ParsePlainTextFeed)
+	expected := map[IndicatorType][]string{
+		IndicatorTypes.IP:     {"1.2.3.4"},
+		IndicatorTypes.CIDR:   {"10.0.0.0/8"},
+		IndicatorTypes.Domain: {"evil.example.com"},
+		IndicatorTypes.Hash:   {"44d88612fea8a8f36de82e1278abb02f"},
+		IndicatorTypes.URL:    {"http://evil.example.com/payload.exe"},
+	}
+	if v := indicatorValues(indicators); !reflect.DeepEqual(v, expected) {
+		t.Errorf("unexpected indicators: %v", v)
+	}
+}
+
+func TestParseCSVFeed(t *testing.T) {
+	indicators := parseFixture(t, "indicators.csv", NewCSVFeedParser(CSVFeedOptions{
+		ValueColumn: "indicator",
+		TypeColumn:  "type",
+	}))
+	expected := map[IndicatorType][]string{
+		IndicatorTypes.IP:     {"1.2.3.4"},
+		IndicatorTypes.Domain: {"evil.example.com"},
+		IndicatorTypes.Hash:   {"275a021bbfb6489e54d471899f7db9d1663fc695ec2fe2a2c4538aabf651fd0f"},
+	}
+	if v := indicatorValues(indicators); !reflect.DeepEqual(v, expected) {
+		t.Errorf("unexpected indicators: %v", v)
+	}
+	if mtd := indicators[0].Metadata; !reflect.DeepEqual(mtd, map[string]interface{}{"confidence": "high", "source": "feed-a"}) {
+		t.Errorf("unexpected metadata: %v", mtd)
+	}
+	if mtd := indicators[2].Metadata; !reflect.DeepEqual(mtd, map[string]interface{}{"confidence": "high"}) {
+		t.Errorf("unexpected metadata: %v", mtd)
+	}
+
+	onlySource := parseFixture(t, "indicators.csv", NewCSVFeedParser(CSVFeedOptions{
+		ValueColumn:     "indicator",
+		MetadataColumns: []string{"source"},
+	}))
+	if mtd := onlySource[0].Metadata; !reflect.DeepEqual(mtd, map[string]interface{}{"source": "feed-a"}) {
+		t.Errorf("unexpected metadata: %v", mtd)
+	}
+}
+
+func TestParseSTIXFeed(t *testing.T) {
+	indicators := parseFixture(t, "bundle.json", ParseSTIXFeed)
+	expected := map[IndicatorType][]string{
+		IndicatorTypes.IP:     {"198.51.100.1"},
+		IndicatorTypes.Domain: {"c2.example.net"},
+		IndicatorTypes.Hash:   {"aec070645fe53ee3b3763059376134f058cc337247c978add178b6ccdfb0019f"},
+	}
+	if v := indicatorValues(indicators); !reflect.DeepEqual(v, expected) {
+		t.Errorf("unexpected indicators: %v", v)
+	}
+	if name := indicators[0].Metadata["name"]; name != "Malicious C2" {
+		t.Errorf("unexpected name: %v", name)
+	}
+}
+
+func TestParseMISPFeed(t *testing.T) {
+	indicators := parseFixture(t, "misp.json", ParseMISPFeed)
+	expected := map[IndicatorType][]string{
+		IndicatorTypes.IP:     {"203.0.113.7"},
+		IndicatorTypes.Domain: {"login.example.org"},
+		IndicatorTypes.Hash:   {"b1946ac92492d2347c6235b4d2611184"},
+	}
+	if v := indicatorValues(indicators); !reflect.DeepEqual(v, expected) {
+		t.Errorf("unexpected indicators: %v", v)
+	}
+	if c := indicators[1].Metadata["comment"]; c != "phishing page" {
+		t.Errorf("unexpected comment: %v", c)
+	}
+}
+
+func TestIndicatorsToLookupData(t *testing.T) {
+	data := IndicatorsToLookupData("intel", []Indicator{
+		{Type: IndicatorTypes.IP, Value: "1.2.3.4", Metadata: map[string]interface{}{"source": "a"}},
+		{Type: IndicatorTypes.IP, Value: "1.2.3.4", Metadata: map[string]interface{}{"confidence": 80}},
+		{Type: IndicatorTypes.Domain, Value: "evil.example.com", Metadata: map[string]interface{}{}},
+	})
+	expected := LookupData{
+		"intel-ip": map[string]interface{}{
+			"1.2.3.4": map[string]interface{}{"source": "a", "confidence": 80},
+		},
+		"intel-domain": map[string]interface{}{
+			"evil.example.com": map[string]interface{}{},
+		},
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("unexpected lookup data: %v", data)
+	}
+}
+
+func TestFetchFeedMaxSize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "1.2.3.4\nevil.example.com\n")
+	}))
+	defer srv.Close()
+
+	feed := Feed{Name: "intel", URL: srv.URL, Parser: ParsePlainTextFeed}
+	indicators, err := FetchFeed(context.Background(), feed)
+	if err != nil {
+		t.Fatalf("FetchFeed(): %v", err)
+	}
+	if len(indicators) != 2 {
+		t.Errorf("unexpected indicators: %v", indicators)
+	}
+
+	feed.MaxSize = 10
+	if _, err := FetchFeed(context.Background(), feed); err == nil || !strings.Contains(err.Error(), "larger than 10 bytes") {
+		t.Errorf("expected the feed to be too large: %v", err)
+	}
+}
@@ -2,20 +2,29 @@ package simplified
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"sync"
+	"sort"
+	"time"
 
 	"github.com/refractionPOINT/go-limacharlie/limacharlie"
 	"github.com/refractionPOINT/lc-extension/common"
 	"github.com/refractionPOINT/lc-extension/core"
 )
 
-const updateRuleHive = "dr-managed"
+const (
+	updateRuleHive = "dr-managed"
+	lookupHive     = "lookup"
+)
 
 type (
 	GetLookupCallback = func(ctx context.Context) (LookupData, error)
-	LookupName        = string
-	LookupData        = map[LookupName]interface{}
+	// GetOrgLookupCallback returns the lookups for a
+	// specific Org given its config of the extension.
+	GetOrgLookupCallback         = func(ctx context.Context, org *limacharlie.Organization, config limacharlie.Dict) (LookupData, error)
+	ValidateLookupConfigCallback = func(ctx context.Context, org *limacharlie.Organization, config limacharlie.Dict) error
+	LookupName                   = string
+	LookupData                   = map[LookupName]interface{}
 )
 
 type LookupExtension struct {
@@ -24,17 +33,67 @@ type LookupExtension struct {
 	Logger    limacharlie.LCLogger
 
 	GetLookup     GetLookupCallback
+	GetOrgLookup  GetOrgLookupCallback                    // Optional, used instead of GetLookup to get lookups specific to each Org.
+	Schedule      SyncSchedule                            // Optional, defaults to every 12h, can be overridden per Org in the config.
 	EventHandlers map[common.EventName]core.EventCallback // Optional
 
+	// Optional, additional fields of the config of the extension,
+	// like feed categories or API keys, passed to GetOrgLookup.
+	ConfigSchema   common.SchemaObject
+	ValidateConfig ValidateLookupConfigCallback // Optional
+
+	MaxConcurrency int           // Optional, number of batches of lookups pushed at once, defaults to 4.
+	MaxRetries     int           // Optional, number of retries of lookups that failed, defaults to 3.
+	RetryBackoff   time.Duration // Optional, delay before the first retry, doubled every retry, defaults to 1s.
+
+	// Optional, entries with a "last_seen" but no "ttl" expire this long after they were last seen.
+	DefaultEntryTTL time.Duration
+	// Optional, also set the expiry of the lookups in Hive to when their last entry expires.
+	SetHiveExpiry bool
+	// Optional, serialized size in bytes over which lookups are split into
+	// records named "<name>-0" to "<name>-N", defaults to 2MB.
+	MaxLookupSize int
+
 	tag      string
 	ruleName string
 }
 
-type lookupUpdateRequest struct{}
+type lookupUpdateRequest struct {
+	// Only sync these lookups, when retrying the ones that failed.
+	Lookups []LookupName `json:"lookups"`
+	Attempt int          `json:"attempt"`
+}
+
+type lookupStatusRequest struct{}
+
+type lookupStatusResponse struct {
+	Sync SyncStatus `json:"sync"`
+}
+
+var lookupStatusResponseSchema = common.SchemaObject{
+	Fields: map[common.SchemaKey]common.SchemaElement{
+		"sync": syncStatusSchema,
+	},
+}
+
+type lookupConfig struct {
+	// How often to update the lookups instead of the extension's default.
+	SyncSchedule SyncSchedule `json:"sync_schedule"`
+}
 
 func (l *LookupExtension) Init() (*core.Extension, error) {
 	l.tag = fmt.Sprintf("ext:%s", l.Name)
 	l.ruleName = fmt.Sprintf("ext-%s-update", l.Name)
+	if err := validateSyncSchedule(l.Schedule); err != nil {
+		return nil, err
+	}
+	if l.GetLookup == nil && l.GetOrgLookup == nil {
+		return nil, errors.New("one of GetLookup or GetOrgLookup is required")
+	}
+	configSchema, err := l.configSchema()
+	if err != nil {
+		return nil, err
+	}
 
 	x := &core.Extension{
 		ExtensionName: l.Name,
@@ -45,24 +104,67 @@ func (l *LookupExtension) Init() (*core.Extension, error) {
 			common.EventTypes.Update,
 		},
 		// The schema defining what the configuration for this Extension should look like.
-		ConfigSchema: common.SchemaObject{
-			Fields:       map[common.SchemaKey]common.SchemaElement{},
-			Requirements: [][]common.SchemaKey{},
-		},
+		ConfigSchema: configSchema,
+		ViewsSchema:  syncStatusViews,
 		// The schema defining what requests to this Extension should look like.
 		RequestSchema: map[string]common.RequestSchema{
 			"update_lookup": {
-				IsUserFacing:         false,
-				ShortDescription:     "update the lookup",
+				IsUserFacing:     false,
+				ShortDescription: "update the lookup",
+				IsImpersonated:   false,
+				ParameterDefinitions: common.SchemaObject{
+					Fields: map[common.SchemaKey]common.SchemaElement{
+						"lookups": {
+							DataType:    common.SchemaDataTypes.String,
+							IsList:      true,
+							Description: "only update these lookups, all lookups if empty",
+							Label:       "Lookups",
+						},
+						"attempt": {
+							DataType:    common.SchemaDataTypes.Integer,
+							Description: "number of times the lookups were already retried",
+							Label:       "Attempt",
+						},
+					},
+				},
+				ResponseDefinition: &lookupStatusResponseSchema,
+			},
+			"sync_now": {
+				IsUserFacing:         true,
+				Label:                "Sync now",
+				ShortDescription:     "update the lookups now",
+				LongDescription:      "update the lookups right away instead of waiting for the next scheduled update",
 				IsImpersonated:       false,
 				ParameterDefinitions: common.SchemaObject{},
-				ResponseDefinition:   &common.SchemaObject{},
+				ResponseDefinition:   &lookupStatusResponseSchema,
+			},
+			"get_status": {
+				IsDefaultRequest:     true,
+				IsUserFacing:         true,
+				Label:                "Get status",
+				ShortDescription:     "get the sync status of the lookups",
+				LongDescription:      "get when the lookups were last updated, what changed and the errors encountered",
+				IsImpersonated:       false,
+				ParameterDefinitions: common.SchemaObject{},
+				ResponseDefinition:   &lookupStatusResponseSchema,
 			},
 		},
 	}
 
 	x.Callbacks = core.ExtensionCallbacks{
 		ValidateConfig: func(ctx context.Context, org *limacharlie.Organization, config limacharlie.Dict) common.Response {
+			c := lookupConfig{}
+			if err := config.UnMarshalToStruct(&c); err != nil {
+				return common.Response{Error: err.Error()}
+			}
+			if err := validateSyncSchedule(c.SyncSchedule); err != nil {
+				return common.Response{Error: err.Error()}
+			}
+			if l.ValidateConfig != nil {
+				if err := l.ValidateConfig(ctx, org, config); err != nil {
+					return common.Response{Error: err.Error()}
+				}
+			}
 			return common.Response{}
 		},
 		RequestHandlers: map[common.ActionName]core.RequestCallback{
@@ -70,6 +172,14 @@ func (l *LookupExtension) Init() (*core.Extension, error) {
 				RequestStruct: &lookupUpdateRequest{},
 				Callback:      l.onUpdate,
 			},
+			"sync_now": {
+				RequestStruct: &lookupUpdateRequest{},
+				Callback:      l.onUpdate,
+			},
+			"get_status": {
+				RequestStruct: &lookupStatusRequest{},
+				Callback:      l.onGetStatus,
+			},
 		},
 		EventHandlers: map[common.EventName]core.EventCallback{
 			common.EventTypes.Subscribe: func(ctx context.Context, params core.EventCallbackParams) common.Response {
@@ -77,29 +187,7 @@ func (l *LookupExtension) Init() (*core.Extension, error) {
 				l.Logger.Info(fmt.Sprintf("subscribe to %s", org.GetOID()))
 
 				// We set up a D&R rule for recurring update.
-				h := limacharlie.NewHiveClient(org)
-				trueValue := true
-				if _, err := h.Add(limacharlie.HiveArgs{
-					HiveName:     updateRuleHive,
-					PartitionKey: org.GetOID(),
-					Key:          l.ruleName,
-					Data: limacharlie.Dict{
-						"detect": limacharlie.Dict{
-							"target": "schedule",
-							"event":  "12h_per_org",
-							"op":     "exists",
-							"path":   "event",
-						},
-						"respond": []limacharlie.Dict{{
-							"action":            "extension request",
-							"extension name":    l.Name,
-							"extension action":  "update_lookup",
-							"extension request": limacharlie.Dict{},
-						}},
-					},
-					Tags:    []string{l.tag},
-					Enabled: &trueValue,
-				}); err != nil {
+				if err := l.setScheduleRule(org, params.Conf); err != nil {
 					l.Logger.Error(fmt.Sprintf("failed to add D&R rule: %s", err.Error()))
 					return common.Response{Error: err.Error()}
 				}
@@ -123,19 +211,15 @@ func (l *LookupExtension) Init() (*core.Extension, error) {
 				l.Logger.Info(fmt.Sprintf("unsubscribe from %s", org.GetOID()))
 
 				// Remove the D&R rule we set up.
-				h := limacharlie.NewHiveClient(org)
-				if _, err := h.Remove(limacharlie.HiveArgs{
-					HiveName:     updateRuleHive,
-					PartitionKey: org.GetOID(),
-					Key:          l.ruleName,
-				}); err != nil {
+				if err := removeScheduleRule(org, l.ruleName); err != nil {
 					l.Logger.Error(fmt.Sprintf("failed to remove D&R rule: %s", err.Error()))
 					return common.Response{Error: err.Error()}
 				}
 
 				// We also remove the lookups.
+				h := limacharlie.NewHiveClient(org)
 				lookups, err := h.ListMtd(limacharlie.HiveArgs{
-					HiveName:     "lookup",
+					HiveName:     lookupHive,
 					PartitionKey: org.GetOID(),
 				})
 				if err != nil {
@@ -154,7 +238,7 @@ func (l *LookupExtension) Init() (*core.Extension, error) {
 						continue
 					}
 					if _, err := h.Remove(limacharlie.HiveArgs{
-						HiveName:     "lookup",
+						HiveName:     lookupHive,
 						PartitionKey: org.GetOID(),
 						Key:          luName,
 					}); err != nil {
@@ -162,6 +246,11 @@ func (l *LookupExtension) Init() (*core.Extension, error) {
 						return common.Response{Error: err.Error()}
 					}
 				}
+				for _, recordName := range []string{l.syncStatusRecordName(), l.stateRecordName()} {
+					if err := deleteState(org, recordName); err != nil {
+						l.Logger.Error(fmt.Sprintf("failed to remove lookups state: %s", err.Error()))
+					}
+				}
 
 				if h, ok := l.EventHandlers[common.EventTypes.Unsubscribe]; ok {
 					if resp := h(ctx, params); resp.Error != "" {
@@ -172,11 +261,26 @@ func (l *LookupExtension) Init() (*core.Extension, error) {
 				return common.Response{}
 			},
 			common.EventTypes.Update: func(ctx context.Context, params core.EventCallbackParams) common.Response {
+				// The sync schedule may have changed in the config.
+				if err := l.setScheduleRule(params.Org, params.Conf); err != nil {
+					l.Logger.Error(fmt.Sprintf("failed to update D&R rule: %s", err.Error()))
+					return common.Response{Error: err.Error()}
+				}
+
 				if h, ok := l.EventHandlers[common.EventTypes.Update]; ok {
 					if resp := h(ctx, params); resp.Error != "" {
 						return resp
 					}
 				}
+
+				// The lookups of the Org may depend on its config.
+				if l.GetOrgLookup != nil {
+					return common.Response{Continuations: []common.ContinuationRequest{{
+						InDelaySeconds: 1,
+						Action:         "update_lookup",
+						State:          limacharlie.Dict{},
+					}}}
+				}
 				return common.Response{}
 			},
 		},
@@ -192,48 +296,248 @@ func (l *LookupExtension) Init() (*core.Extension, error) {
 	return x, nil
 }
 
+func (l *LookupExtension) setScheduleRule(org *limacharlie.Organization, config limacharlie.Dict) error {
+	c := lookupConfig{}
+	if err := config.UnMarshalToStruct(&c); err != nil {
+		return err
+	}
+	return setScheduleRule(org, l.ruleName, l.tag, l.Name, "update_lookup", resolveSyncSchedule(l.Schedule, c.SyncSchedule))
+}
+
 func (l *LookupExtension) onUpdate(ctx context.Context, params core.RequestCallbackParams) common.Response {
+	request := params.Request.(*lookupUpdateRequest)
 	h := limacharlie.NewHiveClient(params.Org)
 
-	wg := sync.WaitGroup{}
-	lookups, err := l.GetLookup(ctx)
+	lookups, err := l.getLookups(ctx, params.Org, params.Config)
 	if err != nil {
+		l.recordSyncStatus(params.Org, syncCounts{}, []string{err.Error()})
 		return common.Response{Error: err.Error()}
 	}
-	for luName, luData := range lookups {
-		luName, luData := luName, luData
-		l.Logger.Info(fmt.Sprintf("updating lookup %s", luName))
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			// Convert the interface to a Dict.
-			d := limacharlie.Dict{}
-			if _, err := d.ImportFromStruct(luData); err != nil {
-				l.Logger.Error(fmt.Sprintf("failed to unmarshal lookup %s: %s", luName, err.Error()))
-				return
-			}
 
-			// Push the update.
-			isTrue := true
-			if _, err := h.Add(limacharlie.HiveArgs{
-				HiveName:     "lookup",
-				PartitionKey: params.Org.GetOID(),
-				Key:          luName,
-				Data: limacharlie.Dict{
-					"lookup_data": d,
+	// Without the lookups in Hive we can't know what changed.
+	existing, err := h.ListMtd(limacharlie.HiveArgs{
+		HiveName:     lookupHive,
+		PartitionKey: params.Org.GetOID(),
+	})
+	if err != nil {
+		l.Logger.Error(fmt.Sprintf("failed to list lookups: %s", err.Error()))
+		l.recordSyncStatus(params.Org, syncCounts{}, []string{err.Error()})
+		return common.Response{Error: err.Error()}
+	}
+
+	// The last sync tells which records are shards of the lookups.
+	previous, err := loadSyncStatus(params.Org, l.syncStatusRecordName())
+	if err != nil {
+		l.Logger.Error(fmt.Sprintf("failed to load sync status: %s", err.Error()))
+		l.recordSyncStatus(params.Org, syncCounts{}, []string{err.Error()})
+		return common.Response{Error: err.Error()}
+	}
+
+	state := lookupState{}
+	if err := loadState(params.Org, l.stateRecordName(), &state); err != nil {
+		l.Logger.Error(fmt.Sprintf("failed to load lookups state: %s", err.Error()))
+		l.recordSyncStatus(params.Org, syncCounts{}, []string{err.Error()})
+		return common.Response{Error: err.Error()}
+	}
+
+	plan := l.planLookupSync(lookups, existing, previous.Lookups, state, time.Now())
+	if len(request.Lookups) != 0 {
+		plan = plan.only(request.Lookups)
+	}
+
+	// Push the changes in batches, retrying the lookups that fail.
+	records := map[LookupName]lookupRecord{}
+	tasks := []syncTask{}
+	for _, chunk := range chunkLookupRecords(plan.sets, maxLookupBatchBytes, maxLookupBatchCount) {
+		names := []LookupName{}
+		for _, r := range chunk {
+			records[r.name] = r
+			names = append(names, r.name)
+		}
+		tasks = append(tasks, syncTask{
+			names: names,
+			run: func(names []LookupName) map[LookupName]string {
+				chunk := []lookupRecord{}
+				for _, name := range names {
+					chunk = append(chunk, records[name])
+				}
+				return l.pushLookups(params.Org, chunk)
+			},
+		})
+	}
+	for start := 0; start < len(plan.deletes); start += maxLookupBatchCount {
+		tasks = append(tasks, syncTask{
+			names: plan.deletes[start:min(start+maxLookupBatchCount, len(plan.deletes))],
+			run: func(names []LookupName) map[LookupName]string {
+				return l.deleteLookups(params.Org, names)
+			},
+		})
+	}
+	failed := runSyncTasks(ctx, tasks, l.concurrency(), l.retries(), l.retryBackoff())
+
+	errs := append([]string{}, plan.errors...)
+	counts := syncCounts{
+		lookups: plan.sizes,
+	}
+	for _, r := range plan.sets {
+		if e, ok := failed[r.name]; ok {
+			l.Logger.Error(fmt.Sprintf("failed to update lookup %s: %s", r.name, e))
+			errs = append(errs, fmt.Sprintf("failed to update lookup %s: %s", r.name, e))
+		} else if r.isUpdate {
+			counts.updates++
+		} else {
+			counts.adds++
+		}
+	}
+	for _, name := range plan.deletes {
+		if e, ok := failed[name]; ok {
+			l.Logger.Error(fmt.Sprintf("failed to delete lookup %s: %s", name, e))
+			errs = append(errs, fmt.Sprintf("failed to delete lookup %s: %s", name, e))
+		} else {
+			counts.deletes++
+		}
+	}
+
+	if len(plan.sets) != 0 || len(plan.deletes) != 0 {
+		l.recordLookupState(params.Org, state, plan, failed)
+	}
+	status := l.recordSyncStatus(params.Org, counts, errs)
+
+	l.Logger.Info(fmt.Sprintf("done updating lookups: %d added, %d updated, %d deleted, %d unchanged, %d expired entries dropped", counts.adds, counts.updates, counts.deletes, len(plan.unchanged), plan.expired))
+
+	return lookupSyncResponse(status, errs, failed, request.Attempt)
+}
+
+// lookupSyncResponse returns the response to a sync given its errors
+// and the lookups that failed to be pushed or deleted.
+func lookupSyncResponse(status SyncStatus, errs []string, failed map[LookupName]string, attempt int) common.Response {
+	if len(errs) == 0 {
+		return common.Response{Data: lookupStatusResponse{Sync: status}}
+	}
+
+	// Retrying the whole sync would not help, the lookups that failed
+	// are retried later in a continuation. The continuation is only
+	// scheduled for successful responses, the errors are then reported
+	// in the sync status.
+	attempt = max(attempt, 0)
+	if len(failed) != 0 && attempt < maxLookupSyncContinuations {
+		names := []LookupName{}
+		for name := range failed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return common.Response{
+			Data: lookupStatusResponse{Sync: status},
+			Continuations: []common.ContinuationRequest{{
+				InDelaySeconds: lookupSyncContinuationDelay << attempt,
+				Action:         "update_lookup",
+				State: limacharlie.Dict{
+					"lookups": names,
+					"attempt": attempt + 1,
 				},
-				Tags:    []string{l.tag},
-				Enabled: &isTrue,
-			}); err != nil {
-				l.Logger.Error(fmt.Sprintf("failed to update lookup %s: %s", luName, err.Error()))
-				return
-			}
-		}()
+			}},
+		}
+	}
+	return common.Response{
+		Error:     aggregateErrors(errs, maxReportedErrors),
+		Retriable: Bool(false),
+		Data:      lookupStatusResponse{Sync: status},
+	}
+}
+
+func (l *LookupExtension) getLookups(ctx context.Context, org *limacharlie.Organization, config limacharlie.Dict) (LookupData, error) {
+	if l.GetOrgLookup != nil {
+		return l.GetOrgLookup(ctx, org, config)
+	}
+	return l.GetLookup(ctx)
+}
+
+// configSchema returns the schema of the config of the extension,
+// made of the fields we support along with the ones of the extension.
+func (l *LookupExtension) configSchema() (common.SchemaObject, error) {
+	schema := common.SchemaObject{
+		Fields: map[common.SchemaKey]common.SchemaElement{
+			"sync_schedule": {
+				DataType:    common.SchemaDataTypes.Enum,
+				EnumValues:  syncScheduleValues(),
+				Description: "how often to update the lookups, \"disabled\" to only update them on request",
+				Label:       "Sync schedule",
+			},
+		},
+		Requirements: [][]common.SchemaKey{},
 	}
+	for k, v := range l.ConfigSchema.Fields {
+		if _, ok := schema.Fields[k]; ok {
+			return schema, fmt.Errorf("config field %s is reserved", k)
+		}
+		schema.Fields[k] = v
+	}
+	schema.Requirements = append(schema.Requirements, l.ConfigSchema.Requirements...)
+	return schema, nil
+}
 
-	wg.Wait()
+func (l *LookupExtension) concurrency() int {
+	if l.MaxConcurrency <= 0 {
+		return defaultLookupConcurrency
+	}
+	return l.MaxConcurrency
+}
 
-	l.Logger.Info("done updating lookups")
+func (l *LookupExtension) retries() int {
+	if l.MaxRetries <= 0 {
+		return defaultLookupRetries
+	}
+	return l.MaxRetries
+}
+
+func (l *LookupExtension) retryBackoff() time.Duration {
+	if l.RetryBackoff <= 0 {
+		return defaultLookupRetryBackoff
+	}
+	return l.RetryBackoff
+}
+
+func (l *LookupExtension) stateRecordName() string {
+	return stateRecordName(l.Name, "lookups-state")
+}
 
-	return common.Response{}
+// recordLookupState records what was pushed to the records, along
+// with their etags as listed once the plan is applied.
+func (l *LookupExtension) recordLookupState(org *limacharlie.Organization, state lookupState, plan *lookupSyncPlan, failed map[LookupName]string) {
+	h := limacharlie.NewHiveClient(org)
+	listed, err := h.ListMtd(limacharlie.HiveArgs{
+		HiveName:     lookupHive,
+		PartitionKey: org.GetOID(),
+	})
+	if err != nil {
+		// The etags of the records pushed changed, so they
+		// are pushed again on the next sync.
+		l.Logger.Error(fmt.Sprintf("failed to list lookups: %s", err.Error()))
+		return
+	}
+	if err := saveState(org, l.stateRecordName(), l.tag, state.update(plan, failed, listed)); err != nil {
+		l.Logger.Error(fmt.Sprintf("failed to record lookups state: %s", err.Error()))
+	}
+}
+
+func (l *LookupExtension) syncStatusRecordName() string {
+	return stateRecordName(l.Name, "sync-status")
+}
+
+func (l *LookupExtension) recordSyncStatus(org *limacharlie.Organization, counts syncCounts, errs []string) SyncStatus {
+	status, err := recordSyncStatus(org, l.syncStatusRecordName(), l.tag, counts, errs)
+	if err != nil {
+		l.Logger.Error(fmt.Sprintf("failed to record sync status: %s", err.Error()))
+	}
+	return status
+}
+
+func (l *LookupExtension) onGetStatus(ctx context.Context, params core.RequestCallbackParams) common.Response {
+	status, err := loadSyncStatus(params.Org, l.syncStatusRecordName())
+	if err != nil {
+		return common.Response{Error: err.Error()}
+	}
+	return common.Response{Data: lookupStatusResponse{
+		Sync: status,
+	}}
 }
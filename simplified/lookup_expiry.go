@@ -0,0 +1,99 @@
+package simplified
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+// Metadata of lookup entries controlling when they expire.
+// Expired entries are dropped from the lookups on every sync.
+const (
+	// When the entry expires, as epoch seconds or RFC 3339.
+	LookupEntryExpiresAt = "expires_at"
+	// When the indicator was last seen, as epoch seconds or RFC 3339.
+	LookupEntryLastSeen = "last_seen"
+	// Seconds after it was last seen the entry expires.
+	LookupEntryTTL = "ttl"
+)
+
+// entryExpiry returns when a lookup entry expires, if ever.
+func entryExpiry(entry interface{}, defaultTTL time.Duration) (time.Time, bool) {
+	mtd, ok := entry.(map[string]interface{})
+	if !ok {
+		return time.Time{}, false
+	}
+	if t, ok := parseEntryTime(mtd[LookupEntryExpiresAt]); ok {
+		return t, true
+	}
+	lastSeen, ok := parseEntryTime(mtd[LookupEntryLastSeen])
+	if !ok {
+		return time.Time{}, false
+	}
+	ttl := defaultTTL
+	if n, ok := parseEntryNumber(mtd[LookupEntryTTL]); ok {
+		ttl = time.Duration(n * float64(time.Second))
+	}
+	if ttl <= 0 {
+		return time.Time{}, false
+	}
+	return lastSeen.Add(ttl), true
+}
+
+func parseEntryTime(v interface{}) (time.Time, bool) {
+	if s, ok := v.(string); ok {
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t, true
+		}
+	}
+	n, ok := parseEntryNumber(v)
+	if !ok || n <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(n), 0), true
+}
+
+func parseEntryNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// pruneExpiredEntries removes the expired entries from a lookup.
+// It returns the number of entries removed and when the lookup
+// expires in epoch milliseconds, which is when its last entry
+// expires, or 0 if some entries never expire.
+func pruneExpiredEntries(lookup limacharlie.Dict, now time.Time, defaultTTL time.Duration) (int, int64) {
+	pruned := 0
+	var expiry time.Time
+	isExpiring := true
+	for k, entry := range lookup {
+		t, ok := entryExpiry(entry, defaultTTL)
+		if !ok {
+			isExpiring = false
+			continue
+		}
+		if !t.After(now) {
+			delete(lookup, k)
+			pruned++
+			continue
+		}
+		if t.After(expiry) {
+			expiry = t
+		}
+	}
+	if !isExpiring || len(lookup) == 0 {
+		return pruned, 0
+	}
+	return pruned, expiry.UnixMilli()
+}
@@ -0,0 +1,73 @@
+package simplified
+
+import (
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+func TestPruneExpiredEntries(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	lookup := limacharlie.Dict{
+		"expired":         map[string]interface{}{LookupEntryExpiresAt: "2024-05-01T00:00:00Z"},
+		"valid":           map[string]interface{}{LookupEntryExpiresAt: float64(now.Add(time.Hour).Unix())},
+		"old":             map[string]interface{}{LookupEntryLastSeen: float64(now.Add(-48 * time.Hour).Unix())},
+		"old-with-ttl":    map[string]interface{}{LookupEntryLastSeen: float64(now.Add(-48 * time.Hour).Unix()), LookupEntryTTL: float64(72 * 3600)},
+		"recent":          map[string]interface{}{LookupEntryLastSeen: now.Add(-time.Hour).Format(time.RFC3339)},
+		"without-expiry1": map[string]interface{}{"source": "a"},
+	}
+
+	pruned, expiry := pruneExpiredEntries(lookup, now, 24*time.Hour)
+	if pruned != 2 {
+		t.Errorf("expected 2 entries pruned, got %d", pruned)
+	}
+	for _, k := range []string{"expired", "old"} {
+		if _, ok := lookup[k]; ok {
+			t.Errorf("entry %s should be pruned", k)
+		}
+	}
+	if expiry != 0 {
+		t.Errorf("lookup with entries that never expire should not expire, got %d", expiry)
+	}
+
+	delete(lookup, "without-expiry1")
+	if _, expiry = pruneExpiredEntries(lookup, now, 24*time.Hour); expiry != now.Add(24*time.Hour).UnixMilli() {
+		t.Errorf("unexpected expiry: %d", expiry)
+	}
+
+	// Without a default TTL, entries only with a last seen never expire.
+	lookup = limacharlie.Dict{
+		"old": map[string]interface{}{LookupEntryLastSeen: float64(now.Add(-48 * time.Hour).Unix())},
+	}
+	if pruned, _ := pruneExpiredEntries(lookup, now, 0); pruned != 0 {
+		t.Errorf("expected no entries pruned, got %d", pruned)
+	}
+}
+
+func TestPlanLookupSyncExpiry(t *testing.T) {
+	l := &LookupExtension{Name: "test", SetHiveExpiry: true}
+	l.tag = "ext:test"
+	now := time.Now()
+	lookups := LookupData{
+		"all-expired": map[string]interface{}{
+			"a": map[string]interface{}{LookupEntryExpiresAt: float64(now.Add(-time.Hour).Unix())},
+		},
+		"expiring": map[string]interface{}{
+			"b": map[string]interface{}{LookupEntryExpiresAt: float64(now.Add(time.Hour).Unix())},
+		},
+	}
+	existing := map[string]limacharlie.HiveData{
+		"all-expired": {UsrMtd: limacharlie.UsrMtd{Enabled: true, Tags: []string{l.tag}}},
+	}
+	plan := l.planLookupSync(lookups, existing, nil, lookupState{}, now)
+	if len(plan.sets) != 1 || plan.sets[0].name != "expiring" || plan.sets[0].expiry == 0 {
+		t.Errorf("unexpected sets: %+v", plan.sets)
+	}
+	if len(plan.deletes) != 1 || plan.deletes[0] != "all-expired" {
+		t.Errorf("unexpected deletes: %v", plan.deletes)
+	}
+	if plan.expired != 1 {
+		t.Errorf("expected 1 expired entry, got %d", plan.expired)
+	}
+}
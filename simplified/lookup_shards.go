@@ -0,0 +1,169 @@
+package simplified
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+// Lookups larger than this once serialized are split into
+// several records to stay within the size limit of Hive.
+const defaultMaxLookupSize = 2 * 1024 * 1024
+
+// LookupSize is the serialized size of a lookup and
+// the number of records it is split into, if any.
+type LookupSize struct {
+	Size   int `json:"size"`
+	Shards int `json:"shards,omitempty"`
+}
+
+// lookupShard is a record holding all or part of a lookup.
+type lookupShard struct {
+	name    LookupName
+	data    limacharlie.Dict
+	encoded []byte
+}
+
+// LookupShardName returns the name of a shard of a lookup.
+func LookupShardName(name LookupName, shard int) LookupName {
+	return fmt.Sprintf("%s-%d", name, shard)
+}
+
+// LookupDetection returns a D&R detection matching when the value
+// at the path is in the lookup, checking each of its shards if it is
+// split in more than one record. The records are the ones written by
+// the last sync of the Org, so rules using the detection need to be
+// updated when the number of shards of the lookup changes, which is
+// reported in the sync status.
+func (l *LookupExtension) LookupDetection(org *limacharlie.Organization, name LookupName, path string) (limacharlie.Dict, error) {
+	status, err := loadSyncStatus(org, l.syncStatusRecordName())
+	if err != nil {
+		return nil, err
+	}
+	size, ok := status.Lookups[name]
+	if !ok {
+		return nil, fmt.Errorf("lookup %s was not synced", name)
+	}
+	return lookupDetection(name, size.Shards, path), nil
+}
+
+func lookupDetection(name LookupName, shards int, path string) limacharlie.Dict {
+	if shards == 0 {
+		return limacharlie.Dict{
+			"op":       "lookup",
+			"path":     path,
+			"resource": fmt.Sprintf("hive://lookup/%s", name),
+		}
+	}
+	rules := []interface{}{}
+	for i := 0; i < shards; i++ {
+		rules = append(rules, limacharlie.Dict{
+			"op":       "lookup",
+			"path":     path,
+			"resource": fmt.Sprintf("hive://lookup/%s", LookupShardName(name, i)),
+		})
+	}
+	return limacharlie.Dict{
+		"op":    "or",
+		"rules": rules,
+	}
+}
+
+func (l *LookupExtension) maxLookupSize() int {
+	if l.MaxLookupSize <= 0 {
+		return defaultMaxLookupSize
+	}
+	return l.MaxLookupSize
+}
+
+// shardLookup splits a lookup into shards of at most maxSize bytes.
+// Entries are assigned to shards by the hash of their key so changes
+// to an entry only change its shard. Entries too large to fit in a
+// shard are dropped and reported as errors.
+func shardLookup(name LookupName, lookup limacharlie.Dict, maxSize int) ([]lookupShard, []string) {
+	b, err := json.Marshal(lookup)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("failed to marshal lookup %s: %s", name, err.Error())}
+	}
+	if len(b) <= maxSize {
+		return []lookupShard{{name: name, data: lookup, encoded: b}}, nil
+	}
+
+	errs := []string{}
+	sizes := map[string]int{}
+	for k, v := range lookup {
+		entry, err := json.Marshal(map[string]interface{}{k: v})
+		if err != nil || len(entry) > maxSize {
+			errs = append(errs, fmt.Sprintf("entry %q of lookup %s is too large", k, name))
+			continue
+		}
+		sizes[k] = len(entry)
+	}
+
+	if len(sizes) == 0 {
+		return []lookupShard{}, errs
+	}
+
+	// Start with shards filled at 80% to leave room for an uneven
+	// distribution, adding shards until they all fit.
+	n := len(b)/(maxSize*8/10) + 1
+	for ; n <= len(sizes); n++ {
+		shardSizes := make([]int, n)
+		for k, size := range sizes {
+			shardSizes[shardOf(k, n)] += size
+		}
+		isFitting := true
+		for _, size := range shardSizes {
+			if size > maxSize {
+				isFitting = false
+				break
+			}
+		}
+		if isFitting {
+			break
+		}
+	}
+	n = min(n, len(sizes))
+
+	shards := make([]lookupShard, n)
+	for i := range shards {
+		shards[i] = lookupShard{
+			name: LookupShardName(name, i),
+			data: limacharlie.Dict{},
+		}
+	}
+	for k := range sizes {
+		shards[shardOf(k, n)].data[k] = lookup[k]
+	}
+	for i := range shards {
+		if shards[i].encoded, err = json.Marshal(shards[i].data); err != nil {
+			return nil, append(errs, fmt.Sprintf("failed to marshal lookup %s: %s", shards[i].name, err.Error()))
+		}
+		// The entries may still not be spread evenly enough.
+		if len(shards[i].encoded) > maxSize {
+			return nil, append(errs, fmt.Sprintf("lookup %s cannot be split in shards of at most %d bytes", name, maxSize))
+		}
+	}
+	return shards, errs
+}
+
+func shardOf(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// isShardOf returns true if the record is one of the shards
+// of the lookup, given its number of shards.
+func isShardOf(recordName string, name LookupName, shards int) bool {
+	suffix, ok := strings.CutPrefix(recordName, name+"-")
+	if !ok {
+		return false
+	}
+	i, err := strconv.Atoi(suffix)
+	return err == nil && i >= 0 && i < shards && strconv.Itoa(i) == suffix
+}
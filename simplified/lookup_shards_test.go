@@ -0,0 +1,161 @@
+package simplified
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+func TestShardLookup(t *testing.T) {
+	lookup := limacharlie.Dict{}
+	for i := 0; i < 200; i++ {
+		lookup[fmt.Sprintf("10.0.%d.%d", i/256, i%256)] = map[string]interface{}{"source": "feed"}
+	}
+
+	shards, errs := shardLookup("ips", lookup, 1<<20)
+	if len(errs) != 0 || len(shards) != 1 || shards[0].name != "ips" {
+		t.Fatalf("small lookup should not be sharded: %v %v", shards, errs)
+	}
+
+	shards, errs = shardLookup("ips", lookup, 1024)
+	if len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if len(shards) < 2 {
+		t.Fatalf("expected the lookup to be sharded, got %d shards", len(shards))
+	}
+	entries := 0
+	for i, shard := range shards {
+		if shard.name != LookupShardName("ips", i) {
+			t.Errorf("unexpected shard name: %s", shard.name)
+		}
+		if len(shard.encoded) > 1024 {
+			t.Errorf("shard %s is too large: %d", shard.name, len(shard.encoded))
+		}
+		entries += len(shard.data)
+	}
+	if entries != len(lookup) {
+		t.Errorf("expected %d entries across shards, got %d", len(lookup), entries)
+	}
+
+	lookup["huge"] = map[string]interface{}{"comment": strings.Repeat("a", 2048)}
+	_, errs = shardLookup("ips", lookup, 1024)
+	if len(errs) != 1 || !strings.Contains(errs[0], "huge") {
+		t.Errorf("expected an error for the entry too large: %v", errs)
+	}
+
+	// Entries which can't be spread over shards small enough fail the lookup.
+	colliding := []string{}
+	for i := 0; len(colliding) < 2; i++ {
+		if k := fmt.Sprintf("k%d", i); shardOf(k, 2) == 0 {
+			colliding = append(colliding, k)
+		}
+	}
+	lookup = limacharlie.Dict{}
+	for _, k := range colliding {
+		lookup[k] = strings.Repeat("a", 600)
+	}
+	shards, errs = shardLookup("ips", lookup, 1024)
+	if shards != nil || len(errs) != 1 || !strings.Contains(errs[0], "cannot be split") {
+		t.Errorf("expected an error for shards too large: %v %v", shards, errs)
+	}
+}
+
+func TestIsShardOf(t *testing.T) {
+	for recordName, expected := range map[string]bool{
+		"ips-0":     true,
+		"ips-12":    false,
+		"ips-2":     true,
+		"ips":       false,
+		"ips-":      false,
+		"ips-01":    false,
+		"ips--1":    false,
+		"ips-other": false,
+		"ips-v6-0":  false,
+	} {
+		if isShardOf(recordName, "ips", 3) != expected {
+			t.Errorf("unexpected result for %s", recordName)
+		}
+	}
+	if isShardOf("ips-0", "ips", 0) {
+		t.Errorf("an unsharded lookup has no shards")
+	}
+}
+
+func TestLookupDetection(t *testing.T) {
+	d := lookupDetection("ips", 0, "event/IP")
+	if d["op"] != "lookup" || d["resource"] != "hive://lookup/ips" {
+		t.Errorf("unexpected detection: %v", d)
+	}
+	d = lookupDetection("ips", 3, "event/IP")
+	rules, _ := d["rules"].([]interface{})
+	if d["op"] != "or" || len(rules) != 3 {
+		t.Fatalf("unexpected detection: %v", d)
+	}
+	if r := rules[2].(limacharlie.Dict); r["resource"] != "hive://lookup/ips-2" || r["path"] != "event/IP" {
+		t.Errorf("unexpected shard detection: %v", r)
+	}
+}
+
+func TestPlanLookupSyncShards(t *testing.T) {
+	l := &LookupExtension{Name: "test", MaxLookupSize: 1024}
+	l.tag = "ext:test"
+
+	lookup := map[string]interface{}{}
+	for i := 0; i < 200; i++ {
+		lookup[fmt.Sprintf("host-%d.example.com", i)] = map[string]interface{}{}
+	}
+	existing := map[string]limacharlie.HiveData{
+		"domains":    {UsrMtd: limacharlie.UsrMtd{Enabled: true, Tags: []string{l.tag}}},
+		"domains-99": {UsrMtd: limacharlie.UsrMtd{Enabled: true, Tags: []string{l.tag}}},
+	}
+	plan := l.planLookupSync(LookupData{"domains": lookup}, existing, nil, lookupState{}, time.Now())
+
+	size := plan.sizes["domains"]
+	if size.Shards < 2 || size.Shards != len(plan.sets) {
+		t.Fatalf("unexpected size %+v for %d sets", size, len(plan.sets))
+	}
+	total := 0
+	for _, r := range plan.sets {
+		if !isShardOf(r.name, "domains", size.Shards) {
+			t.Errorf("unexpected record: %s", r.name)
+		}
+		total += r.size
+	}
+	if total != size.Size {
+		t.Errorf("expected size %d, got %d", total, size.Size)
+	}
+	// The unsharded record and the stale shard are replaced.
+	if !slices.Equal(plan.deletes, []LookupName{"domains", "domains-99"}) {
+		t.Errorf("unexpected deletes: %v", plan.deletes)
+	}
+}
+
+func TestPlanLookupSyncFailedShards(t *testing.T) {
+	l := &LookupExtension{Name: "test"}
+	l.tag = "ext:test"
+
+	existing := map[string]limacharlie.HiveData{
+		"domains-0": {UsrMtd: limacharlie.UsrMtd{Enabled: true, Tags: []string{l.tag}}},
+		"domains-1": {UsrMtd: limacharlie.UsrMtd{Enabled: true, Tags: []string{l.tag}}},
+		// A lookup we no longer have which is not a shard.
+		"domains-2": {UsrMtd: limacharlie.UsrMtd{Enabled: true, Tags: []string{l.tag}}},
+	}
+	previous := map[LookupName]LookupSize{"domains": {Size: 100, Shards: 2}}
+	// The lookup can't be converted, so it fails.
+	plan := l.planLookupSync(LookupData{"domains": map[string]interface{}{"a": make(chan int)}}, existing, previous, lookupState{}, time.Now())
+
+	if len(plan.errors) != 1 || len(plan.sets) != 0 {
+		t.Errorf("expected the lookup to fail: %v", plan.errors)
+	}
+	if !slices.Equal(plan.deletes, []LookupName{"domains-2"}) {
+		t.Errorf("expected only the stale lookup to be deleted: %v", plan.deletes)
+	}
+	if plan.sizes["domains"] != previous["domains"] {
+		t.Errorf("expected the size of the failed lookup to be kept: %+v", plan.sizes)
+	}
+}
@@ -0,0 +1,391 @@
+package simplified
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+// Changed lookups are pushed to Hive in batches bounded in
+// size and number of records so large feeds are spread over
+// several requests instead of a single huge one.
+const (
+	maxLookupBatchBytes = 4 * 1024 * 1024
+	maxLookupBatchCount = 50
+)
+
+const (
+	defaultLookupConcurrency  = 4
+	defaultLookupRetries      = 3
+	defaultLookupRetryBackoff = 1 * time.Second
+)
+
+// Lookups still failing after the retries are retried in
+// continuations, at most this many times.
+const (
+	maxLookupSyncContinuations  = 3
+	lookupSyncContinuationDelay = 60 // Seconds, doubled every continuation.
+)
+
+// Number of errors included in the error of a response.
+const maxReportedErrors = 10
+
+// lookupRecord is a lookup to push to Hive.
+type lookupRecord struct {
+	name     LookupName
+	data     limacharlie.Dict
+	hash     string
+	size     int
+	isUpdate bool
+	// When the lookup expires in Hive, in epoch milliseconds.
+	expiry int64
+}
+
+// lookupSyncPlan is what a sync changes in Hive.
+type lookupSyncPlan struct {
+	sets      []lookupRecord
+	deletes   []LookupName
+	unchanged []LookupName
+	errors    []string
+	// Number of expired entries dropped.
+	expired int
+	sizes   map[LookupName]LookupSize
+}
+
+// lookupState is the state of the lookups of an Org, kept in the
+// state of the extension instead of on the records themselves.
+type lookupState struct {
+	// What was last pushed to each record, by record.
+	Records map[LookupName]lookupRecordState `json:"records"`
+}
+
+// lookupRecordState is the hash of the content last pushed to a record
+// along with the etag of the record, which changes if a user modifies it.
+type lookupRecordState struct {
+	Hash string `json:"hash"`
+	ETag string `json:"etag"`
+}
+
+// isUnchanged returns true if the record still has the content
+// with the hash as we last pushed it.
+func (s lookupState) isUnchanged(recordName LookupName, rec limacharlie.HiveData, hash string) bool {
+	pushed, ok := s.Records[recordName]
+	return ok && rec.UsrMtd.Enabled && pushed.Hash == hash && pushed.ETag == rec.SysMtd.Etag
+}
+
+// update returns the state once a plan is applied given the lookups
+// that failed and the records in Hive after it.
+func (s lookupState) update(plan *lookupSyncPlan, failed map[LookupName]string, listed map[string]limacharlie.HiveData) lookupState {
+	res := lookupState{Records: map[LookupName]lookupRecordState{}}
+	for name, pushed := range s.Records {
+		if _, ok := listed[name]; ok {
+			res.Records[name] = pushed
+		}
+	}
+	for _, r := range plan.sets {
+		rec, ok := listed[r.name]
+		if _, isFailed := failed[r.name]; isFailed || !ok {
+			// Pushed again on the next sync.
+			delete(res.Records, r.name)
+			continue
+		}
+		res.Records[r.name] = lookupRecordState{Hash: r.hash, ETag: rec.SysMtd.Etag}
+	}
+	return res
+}
+
+// planLookupSync compares the lookups with the ones in Hive to only
+// push the ones that changed and delete the ones we no longer have.
+// The previous sizes are the ones of the last sync, telling which
+// records are the shards of each lookup, and the state tells what
+// was last pushed to the records.
+func (l *LookupExtension) planLookupSync(lookups LookupData, existing map[string]limacharlie.HiveData, previous map[LookupName]LookupSize, state lookupState, now time.Time) *lookupSyncPlan {
+	plan := &lookupSyncPlan{
+		sets:      []lookupRecord{},
+		deletes:   []LookupName{},
+		unchanged: []LookupName{},
+		errors:    []string{},
+		sizes:     map[LookupName]LookupSize{},
+	}
+	// Records holding the lookups, which are kept.
+	records := map[LookupName]struct{}{}
+	// Lookups that failed, whose records are left as they are.
+	failed := map[LookupName]struct{}{}
+	for luName, luData := range lookups {
+		// Convert the interface to a Dict.
+		d := limacharlie.Dict{}
+		if _, err := d.ImportFromStruct(luData); err != nil {
+			plan.errors = append(plan.errors, fmt.Sprintf("failed to unmarshal lookup %s: %s", luName, err.Error()))
+			plan.fail(luName, previous)
+			failed[luName] = struct{}{}
+			continue
+		}
+		// Lookups with all their entries expired are deleted.
+		pruned, expiry := pruneExpiredEntries(d, now, l.DefaultEntryTTL)
+		plan.expired += pruned
+		if len(d) == 0 && pruned != 0 {
+			continue
+		}
+		if !l.SetHiveExpiry {
+			expiry = 0
+		}
+
+		shards, errs := shardLookup(luName, d, l.maxLookupSize())
+		plan.errors = append(plan.errors, errs...)
+		if shards == nil {
+			plan.fail(luName, previous)
+			failed[luName] = struct{}{}
+			continue
+		}
+		size := LookupSize{}
+		if len(shards) != 1 || shards[0].name != luName {
+			size.Shards = len(shards)
+		}
+		for _, shard := range shards {
+			records[shard.name] = struct{}{}
+			size.Size += len(shard.encoded)
+
+			// Map keys are sorted when serialized so the hash is stable.
+			b := append([]byte{}, shard.encoded...)
+			if expiry != 0 {
+				b = append(b, []byte(fmt.Sprintf(":%d", expiry))...)
+			}
+			hash := fmt.Sprintf("%x", sha256.Sum256(b))[:32]
+
+			rec, isExisting := existing[shard.name]
+			if isExisting && state.isUnchanged(shard.name, rec, hash) {
+				plan.unchanged = append(plan.unchanged, shard.name)
+				continue
+			}
+			plan.sets = append(plan.sets, lookupRecord{
+				name:     shard.name,
+				data:     shard.data,
+				hash:     hash,
+				size:     len(shard.encoded),
+				isUpdate: isExisting,
+				expiry:   expiry,
+			})
+		}
+		plan.sizes[luName] = size
+	}
+
+	for recordName, rec := range existing {
+		if _, ok := records[recordName]; ok {
+			continue
+		}
+		if !slices.Contains(rec.UsrMtd.Tags, l.tag) || isFailedRecord(recordName, failed, previous) {
+			continue
+		}
+		plan.deletes = append(plan.deletes, recordName)
+	}
+
+	sort.Slice(plan.sets, func(i, j int) bool { return plan.sets[i].name < plan.sets[j].name })
+	sort.Strings(plan.deletes)
+	sort.Strings(plan.unchanged)
+	sort.Strings(plan.errors)
+	return plan
+}
+
+// fail keeps the size of a lookup that failed as it was, since
+// its records are left as they are.
+func (p *lookupSyncPlan) fail(name LookupName, previous map[LookupName]LookupSize) {
+	if size, ok := previous[name]; ok {
+		p.sizes[name] = size
+	}
+}
+
+// isFailedRecord returns true if the record holds a lookup that failed.
+func isFailedRecord(recordName string, failed map[LookupName]struct{}, previous map[LookupName]LookupSize) bool {
+	for name := range failed {
+		if recordName == name || isShardOf(recordName, name, previous[name].Shards) {
+			return true
+		}
+	}
+	return false
+}
+
+// only restricts the plan to the given lookups.
+func (p *lookupSyncPlan) only(names []LookupName) *lookupSyncPlan {
+	res := &lookupSyncPlan{
+		sets:      []lookupRecord{},
+		deletes:   []LookupName{},
+		unchanged: p.unchanged,
+		errors:    p.errors,
+		expired:   p.expired,
+		sizes:     p.sizes,
+	}
+	for _, r := range p.sets {
+		if slices.Contains(names, r.name) {
+			res.sets = append(res.sets, r)
+		}
+	}
+	for _, name := range p.deletes {
+		if slices.Contains(names, name) {
+			res.deletes = append(res.deletes, name)
+		}
+	}
+	return res
+}
+
+// chunkLookupRecords splits the records into batches of at most
+// maxBytes and maxCount records. Records larger than maxBytes
+// get a batch of their own.
+func chunkLookupRecords(records []lookupRecord, maxBytes int, maxCount int) [][]lookupRecord {
+	chunks := [][]lookupRecord{}
+	current := []lookupRecord{}
+	currentSize := 0
+	for _, r := range records {
+		if len(current) != 0 && (currentSize+r.size > maxBytes || len(current) >= maxCount) {
+			chunks = append(chunks, current)
+			current = []lookupRecord{}
+			currentSize = 0
+		}
+		current = append(current, r)
+		currentSize += r.size
+	}
+	if len(current) != 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// pushLookups sets a batch of lookups in Hive and returns
+// the errors for the lookups that failed, by name.
+func (l *LookupExtension) pushLookups(org *limacharlie.Organization, records []lookupRecord) map[LookupName]string {
+	h := limacharlie.NewHiveClient(org)
+	batch := h.NewBatchOperations()
+	for _, r := range records {
+		batch.SetRecord(lookupRecordID(org, r.name), limacharlie.ConfigRecordMutation{
+			Data: limacharlie.Dict{
+				"lookup_data": r.data,
+			},
+			UsrMtd: &limacharlie.UsrMtd{
+				Enabled: true,
+				Expiry:  r.expiry,
+				Tags:    []string{l.tag},
+			},
+		})
+	}
+	failed := map[LookupName]string{}
+	ops, err := batch.Execute()
+	if err != nil {
+		for _, r := range records {
+			failed[r.name] = err.Error()
+		}
+		return failed
+	}
+	for i, op := range ops {
+		if op.Error != "" && i < len(records) {
+			failed[records[i].name] = op.Error
+		}
+	}
+	return failed
+}
+
+// deleteLookups removes lookups from Hive and returns
+// the errors for the lookups that failed, by name.
+func (l *LookupExtension) deleteLookups(org *limacharlie.Organization, names []LookupName) map[LookupName]string {
+	h := limacharlie.NewHiveClient(org)
+	failed := map[LookupName]string{}
+	for start := 0; start < len(names); start += maxLookupBatchCount {
+		chunk := names[start:min(start+maxLookupBatchCount, len(names))]
+		batch := h.NewBatchOperations()
+		for _, name := range chunk {
+			batch.DelRecord(lookupRecordID(org, name))
+		}
+		ops, err := batch.Execute()
+		if err != nil {
+			for _, name := range chunk {
+				failed[name] = err.Error()
+			}
+			continue
+		}
+		for i, op := range ops {
+			if op.Error != "" && i < len(chunk) && !strings.Contains(op.Error, "RECORD_NOT_FOUND") {
+				failed[chunk[i]] = op.Error
+			}
+		}
+	}
+	return failed
+}
+
+func lookupRecordID(org *limacharlie.Organization, name LookupName) limacharlie.RecordID {
+	return limacharlie.RecordID{
+		Hive: limacharlie.HiveID{
+			Name:      limacharlie.HiveName(lookupHive),
+			Partition: limacharlie.PartitionID(org.GetOID()),
+		},
+		Name: limacharlie.RecordName(name),
+	}
+}
+
+// syncTask is a unit of work of a sync on a set of lookups.
+// It returns the errors for the lookups that failed, by name.
+type syncTask struct {
+	names []LookupName
+	run   func(names []LookupName) map[LookupName]string
+}
+
+// runSyncTasks runs the tasks with at most concurrency tasks at once.
+// Each task is retried with an exponential backoff on the lookups that
+// failed. It returns the errors for the lookups still failing, by name.
+func runSyncTasks(ctx context.Context, tasks []syncTask, concurrency int, retries int, backoff time.Duration) map[LookupName]string {
+	failed := map[LookupName]string{}
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	queue := make(chan syncTask)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range queue {
+				taskFailed := runSyncTask(ctx, task, retries, backoff)
+				mu.Lock()
+				for name, e := range taskFailed {
+					failed[name] = e
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, task := range tasks {
+		queue <- task
+	}
+	close(queue)
+	wg.Wait()
+	return failed
+}
+
+func runSyncTask(ctx context.Context, task syncTask, retries int, backoff time.Duration) map[LookupName]string {
+	failed := task.run(task.names)
+	for attempt := 0; attempt < retries && len(failed) != 0; attempt++ {
+		select {
+		case <-ctx.Done():
+			return failed
+		case <-time.After(backoff << attempt):
+		}
+		names := []LookupName{}
+		for _, name := range task.names {
+			if _, ok := failed[name]; ok {
+				names = append(names, name)
+			}
+		}
+		failed = task.run(names)
+	}
+	return failed
+}
+
+// aggregateErrors joins the errors, only including the first max ones.
+func aggregateErrors(errs []string, max int) string {
+	if len(errs) <= max {
+		return strings.Join(errs, "; ")
+	}
+	return fmt.Sprintf("%s; and %d more errors", strings.Join(errs[:max], "; "), len(errs)-max)
+}
@@ -0,0 +1,172 @@
+package simplified
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/common"
+)
+
+func TestPlanLookupSync(t *testing.T) {
+	l := &LookupExtension{Name: "test"}
+	l.tag = "ext:test"
+
+	lookups := LookupData{
+		"unchanged": map[string]interface{}{"1.2.3.4": map[string]interface{}{}},
+		"changed":   map[string]interface{}{"evil.com": map[string]interface{}{}},
+		"new":       map[string]interface{}{"abc": map[string]interface{}{}},
+	}
+	first := l.planLookupSync(lookups, map[string]limacharlie.HiveData{}, nil, lookupState{}, time.Now())
+	if len(first.sets) != 3 || len(first.deletes) != 0 {
+		t.Fatalf("unexpected initial plan: %+v", first)
+	}
+	hashes := map[LookupName]string{}
+	for _, r := range first.sets {
+		if r.isUpdate {
+			t.Errorf("lookup %s should be an add", r.name)
+		}
+		hashes[r.name] = r.hash
+	}
+
+	state := lookupState{Records: map[LookupName]lookupRecordState{
+		"unchanged": {Hash: hashes["unchanged"], ETag: "e1"},
+		"changed":   {Hash: "0000", ETag: "e2"},
+		"modified":  {Hash: hashes["new"], ETag: "e3"},
+	}}
+	lookups["modified"] = lookups["new"]
+	existing := map[string]limacharlie.HiveData{
+		// Tags set by users don't matter.
+		"unchanged": {UsrMtd: limacharlie.UsrMtd{Enabled: true, Tags: []string{l.tag, "user-tag"}}, SysMtd: limacharlie.SysMtd{Etag: "e1"}},
+		"changed":   {UsrMtd: limacharlie.UsrMtd{Enabled: true, Tags: []string{l.tag}}, SysMtd: limacharlie.SysMtd{Etag: "e2"}},
+		// Modified by a user since we pushed it.
+		"modified": {UsrMtd: limacharlie.UsrMtd{Enabled: true, Tags: []string{l.tag}}, SysMtd: limacharlie.SysMtd{Etag: "e4"}},
+		"removed":  {UsrMtd: limacharlie.UsrMtd{Enabled: true, Tags: []string{l.tag}}},
+		"not-ours": {UsrMtd: limacharlie.UsrMtd{Enabled: true, Tags: []string{"other"}}},
+	}
+	plan := l.planLookupSync(lookups, existing, nil, state, time.Now())
+	names := []LookupName{}
+	for _, r := range plan.sets {
+		names = append(names, r.name)
+		if r.isUpdate != (r.name != "new") {
+			t.Errorf("unexpected update state for %s", r.name)
+		}
+	}
+	if !slices.Equal(names, []LookupName{"changed", "modified", "new"}) {
+		t.Errorf("unexpected sets: %v", names)
+	}
+	if !slices.Equal(plan.deletes, []LookupName{"removed"}) {
+		t.Errorf("unexpected deletes: %v", plan.deletes)
+	}
+	if !slices.Equal(plan.unchanged, []LookupName{"unchanged"}) {
+		t.Errorf("unexpected unchanged: %v", plan.unchanged)
+	}
+
+	// The state records what was pushed with the new etags.
+	listed := map[string]limacharlie.HiveData{
+		"unchanged": existing["unchanged"],
+		"changed":   {SysMtd: limacharlie.SysMtd{Etag: "e5"}},
+		"modified":  {SysMtd: limacharlie.SysMtd{Etag: "e6"}},
+		"new":       {SysMtd: limacharlie.SysMtd{Etag: "e7"}},
+	}
+	next := state.update(plan, map[LookupName]string{"new": "failed"}, listed)
+	expected := map[LookupName]lookupRecordState{
+		"unchanged": state.Records["unchanged"],
+		"changed":   {Hash: hashes["changed"], ETag: "e5"},
+		"modified":  {Hash: hashes["new"], ETag: "e6"},
+	}
+	if !reflect.DeepEqual(next.Records, expected) {
+		t.Errorf("unexpected state: %+v", next.Records)
+	}
+}
+
+func TestChunkLookupRecords(t *testing.T) {
+	records := []lookupRecord{
+		{name: "a", size: 10},
+		{name: "b", size: 10},
+		{name: "c", size: 100},
+		{name: "d", size: 5},
+		{name: "e", size: 5},
+		{name: "f", size: 5},
+	}
+	chunks := chunkLookupRecords(records, 50, 2)
+	sizes := []int{}
+	for _, c := range chunks {
+		sizes = append(sizes, len(c))
+	}
+	if !slices.Equal(sizes, []int{2, 1, 2, 1}) {
+		t.Errorf("unexpected chunks: %v", sizes)
+	}
+}
+
+func TestRunSyncTasks(t *testing.T) {
+	mu := sync.Mutex{}
+	calls := map[LookupName]int{}
+	// "flaky" fails once, "broken" always fails.
+	run := func(names []LookupName) map[LookupName]string {
+		mu.Lock()
+		defer mu.Unlock()
+		failed := map[LookupName]string{}
+		for _, name := range names {
+			calls[name]++
+			if name == "broken" || (name == "flaky" && calls[name] == 1) {
+				failed[name] = "error"
+			}
+		}
+		return failed
+	}
+	tasks := []syncTask{
+		{names: []LookupName{"ok1", "flaky"}, run: run},
+		{names: []LookupName{"ok2", "broken"}, run: run},
+		{names: []LookupName{"ok3"}, run: run},
+	}
+	failed := runSyncTasks(context.Background(), tasks, 2, 2, time.Millisecond)
+	if len(failed) != 1 || failed["broken"] == "" {
+		t.Errorf("unexpected failures: %v", failed)
+	}
+	expected := map[LookupName]int{"ok1": 1, "ok2": 1, "ok3": 1, "flaky": 2, "broken": 3}
+	for name, n := range expected {
+		if calls[name] != n {
+			t.Errorf("expected %d calls for %s, got %d", n, name, calls[name])
+		}
+	}
+
+	if e := aggregateErrors([]string{"a", "b", "c"}, 2); e != "a; b; and 1 more errors" {
+		t.Errorf("unexpected aggregated errors: %q", e)
+	}
+}
+
+func TestLookupSyncResponse(t *testing.T) {
+	status := SyncStatus{Errors: []string{"failed to update lookup a: boom"}}
+	failed := map[LookupName]string{"a": "boom"}
+
+	// The lookups that failed are retried in a continuation of a successful response.
+	resp := lookupSyncResponse(status, status.Errors, failed, 0)
+	if resp.Error != "" || len(resp.Continuations) != 1 {
+		t.Fatalf("expected a successful response with a continuation: %+v", resp)
+	}
+	if c := resp.Continuations[0]; c.Action != "update_lookup" || c.State["attempt"] != 1 || !slices.Equal(c.State["lookups"].([]LookupName), []LookupName{"a"}) {
+		t.Errorf("unexpected continuation: %+v", c)
+	}
+	if data := resp.Data.(lookupStatusResponse); len(data.Sync.Errors) != 1 {
+		t.Errorf("expected the errors in the sync status: %+v", data)
+	}
+
+	// Once the retries are exhausted, or if nothing can be retried, the sync fails.
+	for _, resp := range []common.Response{
+		lookupSyncResponse(status, status.Errors, failed, maxLookupSyncContinuations),
+		lookupSyncResponse(status, status.Errors, map[LookupName]string{}, 0),
+	} {
+		if resp.Error == "" || resp.Retriable == nil || *resp.Retriable || len(resp.Continuations) != 0 {
+			t.Errorf("expected a non-retriable error: %+v", resp)
+		}
+	}
+
+	if resp := lookupSyncResponse(SyncStatus{}, nil, nil, 0); resp.Error != "" || len(resp.Continuations) != 0 {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+}
@@ -0,0 +1,38 @@
+package simplified
+
+import (
+	"testing"
+
+	"github.com/refractionPOINT/lc-extension/common"
+)
+
+func TestLookupConfigSchema(t *testing.T) {
+	l := &LookupExtension{
+		ConfigSchema: common.SchemaObject{
+			Fields: map[common.SchemaKey]common.SchemaElement{
+				"api_key": {
+					DataType: common.SchemaDataTypes.Secret,
+				},
+			},
+			Requirements: [][]common.SchemaKey{{"api_key"}},
+		},
+	}
+	schema, err := l.configSchema()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := schema.Fields["sync_schedule"]; !ok {
+		t.Error("missing sync_schedule field")
+	}
+	if _, ok := schema.Fields["api_key"]; !ok {
+		t.Error("missing api_key field")
+	}
+	if len(schema.Requirements) != 1 {
+		t.Errorf("unexpected requirements: %v", schema.Requirements)
+	}
+
+	l.ConfigSchema.Fields["sync_schedule"] = common.SchemaElement{}
+	if _, err := l.configSchema(); err == nil {
+		t.Error("expected an error for a reserved field")
+	}
+}
@@ -0,0 +1,111 @@
+package simplified
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+// SyncSchedule is how often the simplified extensions sync an Org.
+type SyncSchedule = string
+
+var SyncSchedules = struct {
+	Hourly       SyncSchedule
+	Every3Hours  SyncSchedule
+	Every12Hours SyncSchedule
+	Daily        SyncSchedule
+	Manual       SyncSchedule
+}{
+	Hourly:       "1h",
+	Every3Hours:  "3h",
+	Every12Hours: "12h",
+	Daily:        "24h",
+	Manual:       "disabled", // Only synced on subscription and on request.
+}
+
+const defaultSyncSchedule = "12h"
+
+func syncScheduleValues() []interface{} {
+	return []interface{}{
+		SyncSchedules.Hourly,
+		SyncSchedules.Every3Hours,
+		SyncSchedules.Every12Hours,
+		SyncSchedules.Daily,
+		SyncSchedules.Manual,
+	}
+}
+
+func validateSyncSchedule(schedule SyncSchedule) error {
+	if schedule == "" {
+		return nil
+	}
+	for _, s := range syncScheduleValues() {
+		if s == schedule {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid sync schedule: %q", schedule)
+}
+
+// resolveSyncSchedule returns the schedule configured for an Org,
+// falling back to the one of the extension and then the default.
+func resolveSyncSchedule(extSchedule SyncSchedule, orgSchedule SyncSchedule) SyncSchedule {
+	if orgSchedule != "" {
+		return orgSchedule
+	}
+	if extSchedule != "" {
+		return extSchedule
+	}
+	return defaultSyncSchedule
+}
+
+// scheduleRuleData is the D&R rule making a request
+// to the extension on the given schedule.
+func scheduleRuleData(extName string, action string, schedule SyncSchedule) limacharlie.Dict {
+	return limacharlie.Dict{
+		"detect": limacharlie.Dict{
+			"target": "schedule",
+			"event":  fmt.Sprintf("%s_per_org", schedule),
+			"op":     "exists",
+			"path":   "event",
+		},
+		"respond": []limacharlie.Dict{{
+			"action":            "extension request",
+			"extension name":    extName,
+			"extension action":  action,
+			"extension request": limacharlie.Dict{},
+		}},
+	}
+}
+
+// setScheduleRule sets up the D&R rule for recurring syncs,
+// or removes it if the syncs are manual.
+func setScheduleRule(org *limacharlie.Organization, ruleName string, tag string, extName string, action string, schedule SyncSchedule) error {
+	if schedule == SyncSchedules.Manual {
+		return removeScheduleRule(org, ruleName)
+	}
+	h := limacharlie.NewHiveClient(org)
+	trueValue := true
+	_, err := h.Add(limacharlie.HiveArgs{
+		HiveName:     updateRuleHive,
+		PartitionKey: org.GetOID(),
+		Key:          ruleName,
+		Data:         scheduleRuleData(extName, action, schedule),
+		Tags:         []string{tag},
+		Enabled:      &trueValue,
+	})
+	return err
+}
+
+func removeScheduleRule(org *limacharlie.Organization, ruleName string) error {
+	h := limacharlie.NewHiveClient(org)
+	if _, err := h.Remove(limacharlie.HiveArgs{
+		HiveName:     updateRuleHive,
+		PartitionKey: org.GetOID(),
+		Key:          ruleName,
+	}); err != nil && !strings.Contains(err.Error(), "RECORD_NOT_FOUND") {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package simplified
+
+import (
+	"testing"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+func TestResolveSyncSchedule(t *testing.T) {
+	for _, test := range []struct {
+		ext      SyncSchedule
+		org      SyncSchedule
+		expected SyncSchedule
+	}{
+		{"", "", SyncSchedules.Every12Hours},
+		{SyncSchedules.Daily, "", SyncSchedules.Daily},
+		{SyncSchedules.Daily, SyncSchedules.Hourly, SyncSchedules.Hourly},
+		{"", SyncSchedules.Manual, SyncSchedules.Manual},
+	} {
+		if s := resolveSyncSchedule(test.ext, test.org); s != test.expected {
+			t.Errorf("resolveSyncSchedule(%q, %q) = %q, expected %q", test.ext, test.org, s, test.expected)
+		}
+	}
+
+	if err := validateSyncSchedule(SyncSchedules.Every3Hours); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := validateSyncSchedule("2h"); err == nil {
+		t.Error("expected an error for an unsupported schedule")
+	}
+
+	d := scheduleRuleData("ext1", "update_rules", SyncSchedules.Hourly)
+	if e := d["detect"].(limacharlie.Dict)["event"]; e != "1h_per_org" {
+		t.Errorf("unexpected schedule event: %v", e)
+	}
+}
@@ -0,0 +1,102 @@
+package simplified
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+// The per-Org state of the simplified extensions is kept as
+// disabled records in the secret Hive, serialized as the value of
+// the secret, so that it does not show up with the data of the Org
+// like lookups or rules do. The state is not secret, the hive only
+// keeps it out of the way. The records are tagged like the other
+// records of the extension.
+const stateHive = "secret"
+
+// Maximum size of a state record once serialized. The state growing
+// with the data of the extension, like the per-rule state, is split
+// in several records so that each of them stays under it.
+const maxStateSize = 512 * 1024
+
+func stateRecordName(extName string, kind string) string {
+	return fmt.Sprintf("ext-%s-%s", extName, kind)
+}
+
+// loadState reads a state record into out, which is
+// left untouched if there is no state yet.
+func loadState(org *limacharlie.Organization, recordName string, out interface{}) error {
+	h := limacharlie.NewHiveClient(org)
+	rec, err := h.Get(limacharlie.HiveArgs{
+		HiveName:     stateHive,
+		PartitionKey: org.GetOID(),
+		Key:          recordName,
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "RECORD_NOT_FOUND") {
+			return nil
+		}
+		return err
+	}
+	s, _ := rec.Data["secret"].(string)
+	if s == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(s), out)
+}
+
+func saveState(org *limacharlie.Organization, recordName string, tag string, state interface{}) error {
+	return saveExpiringState(org, recordName, tag, state, 0)
+}
+
+// saveExpiringState saves a state record which Hive removes
+// at the expiry, in epoch milliseconds, if it is not 0.
+func saveExpiringState(org *limacharlie.Organization, recordName string, tag string, state interface{}, expiry int64) error {
+	b, err := marshalState(recordName, state)
+	if err != nil {
+		return err
+	}
+	h := limacharlie.NewHiveClient(org)
+	isFalse := false
+	args := limacharlie.HiveArgs{
+		HiveName:     stateHive,
+		PartitionKey: org.GetOID(),
+		Key:          recordName,
+		Data: limacharlie.Dict{
+			"secret": string(b),
+		},
+		Tags:    []string{tag},
+		Enabled: &isFalse,
+	}
+	if expiry != 0 {
+		args.Expiry = &expiry
+	}
+	_, err = h.Add(args)
+	return err
+}
+
+func deleteState(org *limacharlie.Organization, recordName string) error {
+	h := limacharlie.NewHiveClient(org)
+	if _, err := h.Remove(limacharlie.HiveArgs{
+		HiveName:     stateHive,
+		PartitionKey: org.GetOID(),
+		Key:          recordName,
+	}); err != nil && !strings.Contains(err.Error(), "RECORD_NOT_FOUND") {
+		return err
+	}
+	return nil
+}
+
+// marshalState serializes a state, refusing the ones over maxStateSize.
+func marshalState(recordName string, state interface{}) ([]byte, error) {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxStateSize {
+		return nil, fmt.Errorf("state %s is too large: %d bytes, the maximum is %d", recordName, len(b), maxStateSize)
+	}
+	return b, nil
+}
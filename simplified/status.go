@@ -0,0 +1,126 @@
+package simplified
+
+import (
+	"time"
+
+	"github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/refractionPOINT/lc-extension/common"
+)
+
+// SyncStatus is the outcome of the latest syncs of an Org.
+type SyncStatus struct {
+	LastAttempt int64    `json:"last_attempt"`
+	LastSuccess int64    `json:"last_success"`
+	Adds        int      `json:"adds"`
+	Updates     int      `json:"updates"`
+	Deletes     int      `json:"deletes"`
+	Errors      []string `json:"errors"`
+	// Rules skipped by the last sync because they are invalid.
+	InvalidRules []string `json:"invalid_rules,omitempty"`
+	// Sizes of the lookups synced, by name.
+	Lookups map[LookupName]LookupSize `json:"lookups,omitempty"`
+}
+
+// Counts of records changed by a sync.
+type syncCounts struct {
+	adds    int
+	updates int
+	deletes int
+	invalid []string
+	lookups map[LookupName]LookupSize
+}
+
+var syncStatusSchema = common.SchemaElement{
+	DataType:    common.SchemaDataTypes.Object,
+	Description: "when the last sync was attempted and succeeded, what it changed and the errors it encountered",
+	Label:       "Sync status",
+	Object: &common.SchemaObject{
+		Fields: map[common.SchemaKey]common.SchemaElement{
+			"last_attempt": {
+				DataType:    common.SchemaDataTypes.Time,
+				Description: "when the last sync was attempted",
+				Label:       "Last attempt",
+			},
+			"last_success": {
+				DataType:    common.SchemaDataTypes.Time,
+				Description: "when the last successful sync completed",
+				Label:       "Last success",
+			},
+			"adds": {
+				DataType:    common.SchemaDataTypes.Integer,
+				Description: "number of records added by the last sync",
+				Label:       "Added",
+			},
+			"updates": {
+				DataType:    common.SchemaDataTypes.Integer,
+				Description: "number of records updated by the last sync",
+				Label:       "Updated",
+			},
+			"deletes": {
+				DataType:    common.SchemaDataTypes.Integer,
+				Description: "number of records deleted by the last sync",
+				Label:       "Deleted",
+			},
+			"errors": {
+				DataType:    common.SchemaDataTypes.String,
+				IsList:      true,
+				Description: "errors encountered by the last sync",
+				Label:       "Errors",
+			},
+			"invalid_rules": {
+				DataType:    common.SchemaDataTypes.String,
+				IsList:      true,
+				Description: "rules skipped by the last sync because they are invalid, with their problems",
+				Label:       "Invalid rules",
+			},
+			"lookups": {
+				DataType:    common.SchemaDataTypes.Object,
+				Description: "serialized size of each lookup and the number of records it is split into when too large",
+				Label:       "Lookup sizes",
+			},
+		},
+	},
+}
+
+// Views showing the sync status by default.
+var syncStatusViews = []common.View{
+	{
+		Name:            "",
+		LayoutType:      "action",
+		DefaultRequests: []string{"get_status"},
+	},
+}
+
+func loadSyncStatus(org *limacharlie.Organization, recordName string) (SyncStatus, error) {
+	status := SyncStatus{
+		Errors: []string{},
+	}
+	if err := loadState(org, recordName, &status); err != nil {
+		return status, err
+	}
+	return status, nil
+}
+
+// recordSyncStatus persists the outcome of a sync, which is
+// successful if it did not encounter any error.
+func recordSyncStatus(org *limacharlie.Organization, recordName string, tag string, counts syncCounts, errs []string) (SyncStatus, error) {
+	status, err := loadSyncStatus(org, recordName)
+	if err != nil {
+		return status, err
+	}
+	now := time.Now().UnixMilli()
+	status.LastAttempt = now
+	status.Adds = counts.adds
+	status.Updates = counts.updates
+	status.Deletes = counts.deletes
+	status.Errors = append([]string{}, errs...)
+	status.InvalidRules = counts.invalid
+	// Syncs failing before pushing the lookups leave them as they were.
+	if counts.lookups != nil {
+		status.Lookups = counts.lookups
+	}
+	if len(errs) == 0 {
+		status.LastSuccess = now
+	}
+	return status, saveState(org, recordName, tag, status)
+}